@@ -0,0 +1,17 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/fineas02/matching-engine/orderbook"
+)
+
+// VerifyChecksum checks a locally kept book against the checksum sent by the
+// exchange. Levels must be sorted best first and hold no empty levels.
+func VerifyChecksum(bids, asks []orderbook.PriceLevel, checksum uint32) error {
+	if local := orderbook.Checksum(bids, asks); local != checksum {
+		return fmt.Errorf("book checksum mismatch: local %d, exchange %d", local, checksum)
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/fineas02/matching-engine/orderbook"
+	"github.com/fineas02/matching-engine/server"
+)
+
+// deepBook has 30 levels per side, at prices and sizes that don't print as
+// round numbers, e.g. 100.30000000000001.
+func deepBook() *orderbook.Orderbook {
+	ob := orderbook.NewOrderbook()
+	for i := 1; i <= 30; i++ {
+		step := float64(i) * 0.1
+		ob.PlaceLimitOrder(100-step, orderbook.NewOrder(true, step/3, 1, 1))
+		ob.PlaceLimitOrder(100.05+step, orderbook.NewOrder(false, 1+step/7, 2, 1))
+	}
+	return ob
+}
+
+func TestChecksumMatchesExchange(t *testing.T) {
+	ob := deepBook()
+
+	// what the depth endpoint serves, as the client decodes it
+	depth := ob.Depth(50, 0)
+	data, err := json.Marshal(server.DepthResponse{
+		Market:   server.MarketETH,
+		Sequence: depth.Sequence,
+		Checksum: depth.Checksum,
+		Bids:     depth.Bids,
+		Asks:     depth.Asks,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := server.DepthResponse{}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(resp.Bids), 30)
+	assert(t, len(resp.Asks), 30)
+
+	// the client only hashes the best 25 levels, like the exchange
+	lb := newTestLocalBook()
+	applyLevels(lb.bids, resp.Bids)
+	applyLevels(lb.asks, resp.Asks)
+	bids := sortedLevels(lb.bids, true, orderbook.ChecksumDepth)
+	asks := sortedLevels(lb.asks, false, orderbook.ChecksumDepth)
+	assert(t, len(bids), orderbook.ChecksumDepth)
+	assert(t, VerifyChecksum(bids, asks, resp.Checksum), nil)
+
+	// levels past the 25th don't count, the ones before do
+	assert(t, VerifyChecksum(resp.Bids, resp.Asks, resp.Checksum), nil)
+	bids[orderbook.ChecksumDepth-1].Size += 0.5
+	assert(t, VerifyChecksum(bids, asks, resp.Checksum) != nil, true)
+}
+
+func TestChecksumFollowsUpdates(t *testing.T) {
+	ob := deepBook()
+	rec := &recorder{}
+	ob.SetListener(rec)
+
+	lb := newTestLocalBook()
+	assert(t, lb.apply(snapshotMessage(ob)), nil)
+
+	// a new level inside the top 25 pushes one out, a fill removes one
+	ob.PlaceLimitOrder(99.95, orderbook.NewOrder(true, 0.7, 3, 1))
+	ob.PlaceMarketOrder(orderbook.NewOrder(false, 0.7, 4, 1))
+	ob.PlaceLimitOrder(97.01, orderbook.NewOrder(true, 1.1, 3, 1))
+
+	assert(t, len(rec.updates) >= 3, true)
+	for _, u := range rec.updates {
+		msg := server.FeedMessage{}
+		data, err := json.Marshal(updateMessage(u))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert(t, json.Unmarshal(data, &msg), nil)
+		assert(t, lb.apply(msg), nil)
+	}
+	assert(t, lb.Sequence(), ob.Sequence())
+}
@@ -0,0 +1,306 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fineas02/matching-engine/orderbook"
+	"github.com/fineas02/matching-engine/server"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const localBookSyncTimeout = 5 * time.Second
+
+// LocalBook mirrors the orderbook of a market from the websocket feed. It
+// starts from a snapshot, applies updates in sequence order and takes a new
+// snapshot whenever it misses an update or its checksum drifts.
+type LocalBook struct {
+	market server.Market
+
+	mu     sync.RWMutex
+	seq    uint64
+	synced bool
+	bids   map[float64]orderbook.PriceLevel
+	asks   map[float64]orderbook.PriceLevel
+	conn   *websocket.Conn
+	closed bool
+
+	ready     chan struct{}
+	readyOnce sync.Once
+	done      chan struct{}
+}
+
+// NewLocalBook subscribes to the book of market and returns once the first
+// snapshot has been applied.
+func (c *Client) NewLocalBook(market server.Market) (*LocalBook, error) {
+	lb := &LocalBook{
+		market: market,
+		bids:   make(map[float64]orderbook.PriceLevel),
+		asks:   make(map[float64]orderbook.PriceLevel),
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	conn, err := lb.connect()
+	if err != nil {
+		return nil, err
+	}
+	lb.conn = conn
+
+	go lb.loop()
+
+	select {
+	case <-lb.ready:
+		return lb, nil
+	case <-time.After(localBookSyncTimeout):
+		lb.Close()
+		return nil, fmt.Errorf("timed out waiting for %s book snapshot", market)
+	}
+}
+
+func (lb *LocalBook) Close() {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if lb.closed {
+		return
+	}
+	lb.closed = true
+	close(lb.done)
+	if lb.conn != nil {
+		lb.conn.Close()
+	}
+}
+
+// Synced reports whether the book is currently in sync with the exchange.
+func (lb *LocalBook) Synced() bool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	return lb.synced
+}
+
+// Sequence returns the orderbook sequence the mirror is at.
+func (lb *LocalBook) Sequence() uint64 {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	return lb.seq
+}
+
+func (lb *LocalBook) BestBid() (orderbook.PriceLevel, bool) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	bids := sortedLevels(lb.bids, true, 1)
+	if len(bids) == 0 {
+		return orderbook.PriceLevel{}, false
+	}
+	return bids[0], true
+}
+
+func (lb *LocalBook) BestAsk() (orderbook.PriceLevel, bool) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	asks := sortedLevels(lb.asks, false, 1)
+	if len(asks) == 0 {
+		return orderbook.PriceLevel{}, false
+	}
+	return asks[0], true
+}
+
+// MidPrice returns the mid of the best bid and ask, false if a side is empty.
+func (lb *LocalBook) MidPrice() (float64, bool) {
+	bid, ok := lb.BestBid()
+	if !ok {
+		return 0, false
+	}
+	ask, ok := lb.BestAsk()
+	if !ok {
+		return 0, false
+	}
+
+	return (bid.Price + ask.Price) / 2, true
+}
+
+// Depth returns at most n levels per side, best first. n <= 0 returns all.
+func (lb *LocalBook) Depth(n int) (bids, asks []orderbook.PriceLevel) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	return sortedLevels(lb.bids, true, n), sortedLevels(lb.asks, false, n)
+}
+
+func (lb *LocalBook) connect() (*websocket.Conn, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(wsEndpoint()+"/ws", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lb.subscribe(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (lb *LocalBook) subscribe(conn *websocket.Conn) error {
+	return conn.WriteJSON(server.FeedRequest{
+		Op:      "subscribe",
+		Channel: server.ChannelBook,
+		Market:  lb.market,
+	})
+}
+
+// resync drops the current subscription and asks for a fresh snapshot.
+// Updates still in flight are ignored until it arrives.
+func (lb *LocalBook) resync(conn *websocket.Conn) error {
+	lb.mu.Lock()
+	lb.synced = false
+	lb.mu.Unlock()
+
+	err := conn.WriteJSON(server.FeedRequest{
+		Op:      "unsubscribe",
+		Channel: server.ChannelBook,
+		Market:  lb.market,
+	})
+	if err != nil {
+		return err
+	}
+
+	return lb.subscribe(conn)
+}
+
+func (lb *LocalBook) loop() {
+	for {
+		lb.mu.RLock()
+		conn := lb.conn
+		lb.mu.RUnlock()
+
+		if conn != nil {
+			lb.read(conn)
+		}
+
+		lb.mu.Lock()
+		lb.synced = false
+		lb.mu.Unlock()
+
+		select {
+		case <-lb.done:
+			return
+		case <-time.After(reconnectInterval):
+		}
+
+		conn, err := lb.connect()
+		if err != nil {
+			logrus.WithError(err).Warn("local book reconnect failed")
+			conn = nil
+		}
+
+		lb.mu.Lock()
+		if lb.closed {
+			if conn != nil {
+				conn.Close()
+			}
+			lb.mu.Unlock()
+			return
+		}
+		lb.conn = conn
+		lb.mu.Unlock()
+	}
+}
+
+func (lb *LocalBook) read(conn *websocket.Conn) {
+	defer conn.Close()
+
+	for {
+		msg := server.FeedMessage{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+
+		if msg.Channel != server.ChannelBook || msg.Market != lb.market {
+			continue
+		}
+
+		if err := lb.apply(msg); err != nil {
+			logrus.WithError(err).Warn("local book out of sync, re-snapshotting")
+			if err := lb.resync(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// apply applies a snapshot or update to the book. An error means the book
+// can't be trusted anymore and has to be re-snapshotted.
+func (lb *LocalBook) apply(msg server.FeedMessage) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	switch msg.Type {
+	case server.MessageSnapshot:
+		lb.bids = make(map[float64]orderbook.PriceLevel, len(msg.Bids))
+		lb.asks = make(map[float64]orderbook.PriceLevel, len(msg.Asks))
+		applyLevels(lb.bids, msg.Bids)
+		applyLevels(lb.asks, msg.Asks)
+		lb.seq = msg.Sequence
+		lb.synced = true
+		lb.readyOnce.Do(func() { close(lb.ready) })
+
+	case server.MessageUpdate:
+		// still waiting on a snapshot, or left over from before it
+		if !lb.synced || msg.Sequence <= lb.seq {
+			return nil
+		}
+		if msg.Sequence != lb.seq+1 {
+			return fmt.Errorf("sequence gap: at %d, got %d", lb.seq, msg.Sequence)
+		}
+		applyLevels(lb.bids, msg.Bids)
+		applyLevels(lb.asks, msg.Asks)
+		lb.seq = msg.Sequence
+
+	default:
+		return nil
+	}
+
+	return VerifyChecksum(
+		sortedLevels(lb.bids, true, orderbook.ChecksumDepth),
+		sortedLevels(lb.asks, false, orderbook.ChecksumDepth),
+		msg.Checksum,
+	)
+}
+
+func applyLevels(book map[float64]orderbook.PriceLevel, levels []orderbook.PriceLevel) {
+	for _, level := range levels {
+		if level.Size == 0 {
+			delete(book, level.Price)
+			continue
+		}
+		book[level.Price] = level
+	}
+}
+
+func sortedLevels(book map[float64]orderbook.PriceLevel, bid bool, n int) []orderbook.PriceLevel {
+	levels := make([]orderbook.PriceLevel, 0, len(book))
+	for _, level := range book {
+		levels = append(levels, level)
+	}
+
+	sort.Slice(levels, func(i, j int) bool {
+		if bid {
+			return levels[i].Price > levels[j].Price
+		}
+		return levels[i].Price < levels[j].Price
+	})
+
+	if n > 0 && len(levels) > n {
+		levels = levels[:n]
+	}
+	return levels
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fineas02/matching-engine/orderbook"
+	"github.com/fineas02/matching-engine/server"
+	"github.com/gorilla/websocket"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+// recorder keeps every update of a book.
+type recorder struct {
+	updates []orderbook.BookUpdate
+}
+
+func (r *recorder) OnBookUpdate(u orderbook.BookUpdate) { r.updates = append(r.updates, u) }
+func (r *recorder) OnTrade(*orderbook.Trade)            {}
+
+func newTestLocalBook() *LocalBook {
+	return &LocalBook{
+		market: server.MarketETH,
+		bids:   make(map[float64]orderbook.PriceLevel),
+		asks:   make(map[float64]orderbook.PriceLevel),
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func snapshotMessage(ob *orderbook.Orderbook) server.FeedMessage {
+	depth := ob.Depth(0, 0)
+	return server.FeedMessage{
+		Channel:  server.ChannelBook,
+		Type:     server.MessageSnapshot,
+		Market:   server.MarketETH,
+		Sequence: depth.Sequence,
+		Checksum: depth.Checksum,
+		Bids:     depth.Bids,
+		Asks:     depth.Asks,
+	}
+}
+
+func updateMessage(u orderbook.BookUpdate) server.FeedMessage {
+	return server.FeedMessage{
+		Channel:  server.ChannelBook,
+		Type:     server.MessageUpdate,
+		Market:   server.MarketETH,
+		Sequence: u.Sequence,
+		Checksum: u.Checksum,
+		Bids:     u.Bids,
+		Asks:     u.Asks,
+	}
+}
+
+func TestLocalBookAppliesUpdates(t *testing.T) {
+	ob := orderbook.NewOrderbook()
+	rec := &recorder{}
+	ob.SetListener(rec)
+
+	lb := newTestLocalBook()
+
+	// updates before the first snapshot are dropped
+	ob.PlaceLimitOrder(99.5, orderbook.NewOrder(true, 2, 1, 1))
+	assert(t, lb.apply(updateMessage(rec.updates[0])), nil)
+	assert(t, lb.Synced(), false)
+
+	assert(t, lb.apply(snapshotMessage(ob)), nil)
+	assert(t, lb.Synced(), true)
+	assert(t, lb.Sequence(), uint64(1))
+
+	ob.PlaceLimitOrder(100.25, orderbook.NewOrder(false, 1.5, 2, 1))
+	ob.PlaceLimitOrder(99.5, orderbook.NewOrder(true, 1, 3, 1))
+	for _, u := range rec.updates[1:] {
+		assert(t, lb.apply(updateMessage(u)), nil)
+	}
+
+	// replayed updates are ignored
+	assert(t, lb.apply(updateMessage(rec.updates[1])), nil)
+
+	bids, asks := lb.Depth(0)
+	assert(t, bids, []orderbook.PriceLevel{{Price: 99.5, Size: 3, Orders: 2}})
+	assert(t, asks, []orderbook.PriceLevel{{Price: 100.25, Size: 1.5, Orders: 1}})
+	assert(t, lb.Sequence(), uint64(3))
+
+	mid, ok := lb.MidPrice()
+	assert(t, ok, true)
+	assert(t, mid, 99.875)
+
+	// a book that drifted from the exchange fails its checksum
+	drifted := updateMessage(rec.updates[2])
+	drifted.Sequence = 4
+	drifted.Bids = []orderbook.PriceLevel{{Price: 99.5, Size: 5, Orders: 2}}
+	assert(t, lb.apply(drifted) != nil, true)
+}
+
+func TestLocalBookResnapshotsAfterGap(t *testing.T) {
+	ob := orderbook.NewOrderbook()
+	rec := &recorder{}
+	ob.SetListener(rec)
+
+	ob.PlaceLimitOrder(99.5, orderbook.NewOrder(true, 2, 1, 1))
+	ob.PlaceLimitOrder(100.25, orderbook.NewOrder(false, 1, 2, 1))
+	first := snapshotMessage(ob)
+
+	ob.PlaceLimitOrder(99, orderbook.NewOrder(true, 4, 1, 1))
+	ob.PlaceLimitOrder(101, orderbook.NewOrder(false, 3, 2, 1))
+	ob.PlaceLimitOrder(99.5, orderbook.NewOrder(true, 1, 3, 1))
+
+	requests := make(chan server.FeedRequest, 4)
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		// the update at sequence 4 never arrives
+		conn.WriteJSON(first)
+		conn.WriteJSON(updateMessage(rec.updates[2]))
+		conn.WriteJSON(updateMessage(rec.updates[4]))
+
+		// the client drops the subscription and asks for a new snapshot
+		for i := 0; i < 2; i++ {
+			req := server.FeedRequest{}
+			if err := conn.ReadJSON(&req); err != nil {
+				t.Error(err)
+				return
+			}
+			requests <- req
+		}
+
+		conn.WriteJSON(snapshotMessage(ob))
+		ob.PlaceLimitOrder(100.25, orderbook.NewOrder(false, 2, 2, 1))
+		conn.WriteJSON(updateMessage(rec.updates[5]))
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lb := newTestLocalBook()
+	lb.read(conn)
+
+	close(requests)
+	ops := []string{}
+	for req := range requests {
+		assert(t, req.Channel, server.ChannelBook)
+		ops = append(ops, req.Op)
+	}
+	assert(t, ops, []string{"unsubscribe", "subscribe"})
+
+	// the book picked up from the new snapshot and the update after it
+	assert(t, lb.Synced(), true)
+	assert(t, lb.Sequence(), uint64(6))
+
+	depth := ob.Depth(0, 0)
+	bids, asks := lb.Depth(0)
+	assert(t, bids, depth.Bids)
+	assert(t, asks, depth.Asks)
+	assert(t, asks[0], orderbook.PriceLevel{Price: 100.25, Size: 3, Orders: 2})
+}
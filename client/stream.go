@@ -0,0 +1,181 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fineas02/matching-engine/server"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const reconnectInterval = time.Second
+
+// UserStream receives the private events of a single user. It reconnects on
+// its own and replays whatever was missed from the last seen sequence.
+type UserStream struct {
+	Events <-chan server.UserEvent
+
+	apiKey  string
+	lastSeq uint64
+	events  chan server.UserEvent
+
+	mu     sync.Mutex
+	conn   *websocket.Conn
+	closed bool
+	done   chan struct{}
+}
+
+// IssueAPIKey creates or rotates the api key of the user with the exchange
+// admin key. The key is only returned this once.
+func (c *Client) IssueAPIKey(adminKey string, userID int64) (string, error) {
+	e := fmt.Sprintf("%s/keys/%d", Endpoint, userID)
+	req, err := http.NewRequest(http.MethodPost, e, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Admin-Key", adminKey)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := server.APIError{}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return "", fmt.Errorf("issue api key: %s %s", resp.Status, apiErr.Error)
+	}
+
+	key := server.APIKeyResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&key); err != nil {
+		return "", err
+	}
+	return key.APIKey, nil
+}
+
+// SubscribeUser opens the private stream of the user owning apiKey. Events
+// after since are replayed first, pass 0 to get everything still kept.
+func (c *Client) SubscribeUser(apiKey string, since uint64) (*UserStream, error) {
+	s := &UserStream{
+		apiKey:  apiKey,
+		lastSeq: since,
+		events:  make(chan server.UserEvent, 256),
+		done:    make(chan struct{}),
+	}
+	s.Events = s.events
+
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+
+	go s.loop()
+
+	return s, nil
+}
+
+// LastSequence returns the sequence of the last event delivered.
+func (s *UserStream) LastSequence() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastSeq
+}
+
+func (s *UserStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.done)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (s *UserStream) dial() (*websocket.Conn, error) {
+	e := fmt.Sprintf("%s/ws/user?since=%d", wsEndpoint(), s.LastSequence())
+
+	header := http.Header{}
+	header.Set("X-API-Key", s.apiKey)
+
+	conn, _, err := websocket.DefaultDialer.Dial(e, header)
+	return conn, err
+}
+
+func (s *UserStream) loop() {
+	defer close(s.events)
+
+	for {
+		s.mu.Lock()
+		conn := s.conn
+		s.mu.Unlock()
+
+		if conn != nil {
+			s.read(conn)
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-time.After(reconnectInterval):
+		}
+
+		conn, err := s.dial()
+		if err != nil {
+			logrus.WithError(err).Warn("user stream reconnect failed")
+			conn = nil
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			if conn != nil {
+				conn.Close()
+			}
+			s.mu.Unlock()
+			return
+		}
+		s.conn = conn
+		s.mu.Unlock()
+	}
+}
+
+func (s *UserStream) read(conn *websocket.Conn) {
+	defer conn.Close()
+
+	for {
+		event := server.UserEvent{}
+		if err := conn.ReadJSON(&event); err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		// replays can overlap with what was already delivered
+		if event.Type != server.UserEventReplayGap && event.Sequence <= s.lastSeq {
+			s.mu.Unlock()
+			continue
+		}
+		s.lastSeq = event.Sequence
+		s.mu.Unlock()
+
+		select {
+		case s.events <- event:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func wsEndpoint() string {
+	return "ws" + strings.TrimPrefix(Endpoint, "http")
+}
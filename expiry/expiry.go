@@ -0,0 +1,246 @@
+package expiry
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fineas02/matching-engine/clock"
+)
+
+const (
+	// StatusActive markets take new orders
+	StatusActive = "ACTIVE"
+	// StatusCancelOnly markets are close to expiry and only take cancels
+	StatusCancelOnly = "CANCEL_ONLY"
+	// StatusExpired markets are past expiry but have no settlement price
+	// yet, because the index was never sampled
+	StatusExpired = "EXPIRED"
+	// StatusSettled markets have settled every position and are archived
+	StatusSettled = "SETTLED"
+)
+
+type Config struct {
+	// CancelOnly is how long before expiry a market stops taking new orders
+	CancelOnly time.Duration
+	// Window is how long before expiry the index is averaged over for the
+	// settlement price
+	Window time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		CancelOnly: 30 * time.Minute,
+		Window:     30 * time.Minute,
+	}
+}
+
+// Contract is a market that expires at Expiry.
+type Contract struct {
+	Market string
+	Expiry time.Time
+}
+
+// Settlement is the price a contract settled at: the time weighted average
+// of the index over the window before expiry. Samples is the number of index
+// samples taken during the window.
+type Settlement struct {
+	Market    string
+	Price     float64
+	Samples   int
+	Expiry    int64
+	Timestamp int64
+}
+
+type sample struct {
+	at    time.Time
+	price float64
+}
+
+type contract struct {
+	Contract
+	// before is the last sample before the window, the index the window
+	// starts at
+	before     *sample
+	samples    []sample
+	settlement *Settlement
+}
+
+// Service tracks dated contracts through their life: active, cancel-only
+// before expiry and settled at the TWAP of their index after it.
+type Service struct {
+	clock  clock.Clock
+	config Config
+
+	mu        sync.RWMutex
+	contracts map[string]*contract
+}
+
+func NewService(clk clock.Clock, config Config) *Service {
+	return &Service{
+		clock:     clk,
+		config:    config,
+		contracts: make(map[string]*contract),
+	}
+}
+
+func (s *Service) Config() Config {
+	return s.config
+}
+
+// Add starts tracking a contract. Its expiry has to be in the future.
+func (s *Service) Add(c Contract) error {
+	if !c.Expiry.After(s.clock.Now()) {
+		return fmt.Errorf("contract %s expired at %s", c.Market, c.Expiry)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.contracts[c.Market]; ok {
+		return fmt.Errorf("contract %s already exists", c.Market)
+	}
+	s.contracts[c.Market] = &contract{Contract: c}
+
+	return nil
+}
+
+// Contract returns the contract of the market, false for markets that don't
+// expire.
+func (s *Service) Contract(market string) (Contract, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.contracts[market]
+	if !ok {
+		return Contract{}, false
+	}
+	return c.Contract, true
+}
+
+// Status returns where the market is in its life. Markets that don't expire
+// are always active.
+func (s *Service) Status(market string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.contracts[market]
+	if !ok {
+		return StatusActive
+	}
+
+	now := s.clock.Now()
+	switch {
+	case c.settlement != nil:
+		return StatusSettled
+	case !now.Before(c.Expiry):
+		return StatusExpired
+	case !now.Before(c.Expiry.Add(-s.config.CancelOnly)):
+		return StatusCancelOnly
+	default:
+		return StatusActive
+	}
+}
+
+// Sample records the index of the market. Only the samples in the window
+// before expiry and the last one before it count.
+func (s *Service) Sample(market string, index float64) {
+	if index <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.contracts[market]
+	if !ok {
+		return
+	}
+
+	now := s.clock.Now()
+	switch {
+	case now.After(c.Expiry):
+	case now.Before(c.Expiry.Add(-s.config.Window)):
+		c.before = &sample{at: now, price: index}
+	default:
+		c.samples = append(c.samples, sample{at: now, price: index})
+	}
+}
+
+// Settle settles every contract past its expiry and returns the
+// settlements, ordered by market. A contract whose index was never sampled
+// can't settle and stays expired.
+func (s *Service) Settle() []Settlement {
+	now := s.clock.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	settlements := []Settlement{}
+	for name, c := range s.contracts {
+		if c.settlement != nil || now.Before(c.Expiry) {
+			continue
+		}
+
+		price, ok := s.twap(c)
+		if !ok {
+			continue
+		}
+
+		c.settlement = &Settlement{
+			Market:    name,
+			Price:     price,
+			Samples:   len(c.samples),
+			Expiry:    c.Expiry.UnixNano(),
+			Timestamp: now.UnixNano(),
+		}
+		settlements = append(settlements, *c.settlement)
+	}
+
+	sort.Slice(settlements, func(i, j int) bool { return settlements[i].Market < settlements[j].Market })
+
+	return settlements
+}
+
+// Settlement returns the settlement of the market, false until it settled.
+func (s *Service) Settlement(market string) (Settlement, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.contracts[market]
+	if !ok || c.settlement == nil {
+		return Settlement{}, false
+	}
+	return *c.settlement, true
+}
+
+// twap returns the time weighted average index over the window before
+// expiry. Every sample holds until the next one, the last sample before the
+// window holds from its start. Must be called with s.mu held.
+func (s *Service) twap(c *contract) (float64, bool) {
+	points := make([]sample, 0, len(c.samples)+1)
+	if c.before != nil {
+		points = append(points, sample{at: c.Expiry.Add(-s.config.Window), price: c.before.price})
+	}
+	points = append(points, c.samples...)
+	if len(points) == 0 {
+		return 0, false
+	}
+
+	sum, total := 0.0, 0.0
+	for i, p := range points {
+		end := c.Expiry
+		if i+1 < len(points) {
+			end = points[i+1].at
+		}
+		d := end.Sub(p.at).Seconds()
+		sum += p.price * d
+		total += d
+	}
+
+	if total == 0 {
+		return points[len(points)-1].price, true
+	}
+	return sum / total, true
+}
@@ -0,0 +1,104 @@
+package expiry
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fineas02/matching-engine/clock"
+)
+
+func assert(t *testing.T, a, b any) {
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func assertClose(t *testing.T, a, b float64) {
+	if math.Abs(a-b) > 1e-9 {
+		t.Errorf("%v != %v", a, b)
+	}
+}
+
+var (
+	start  = time.Date(2024, 3, 29, 7, 0, 0, 0, time.UTC)
+	expiry = time.Date(2024, 3, 29, 8, 0, 0, 0, time.UTC)
+)
+
+func TestContractLifecycle(t *testing.T) {
+	clk := clock.NewFake(start)
+	s := NewService(clk, DefaultConfig())
+
+	assert(t, s.Add(Contract{Market: "PUNKS-0329", Expiry: expiry}), nil)
+	if err := s.Add(Contract{Market: "PUNKS-0329", Expiry: expiry}); err == nil {
+		t.Error("added a contract twice")
+	}
+	if err := s.Add(Contract{Market: "PUNKS-0101", Expiry: start}); err == nil {
+		t.Error("added an expired contract")
+	}
+
+	assert(t, s.Status("PUNKS-0329"), StatusActive)
+	assert(t, s.Status("ETH"), StatusActive)
+
+	clk.Advance(30 * time.Minute)
+	assert(t, s.Status("PUNKS-0329"), StatusCancelOnly)
+
+	// nothing settles before expiry
+	s.Sample("PUNKS-0329", 50)
+	assert(t, len(s.Settle()), 0)
+
+	clk.Advance(30 * time.Minute)
+	assert(t, s.Status("PUNKS-0329"), StatusExpired)
+
+	settlements := s.Settle()
+	assert(t, len(settlements), 1)
+	assertClose(t, settlements[0].Price, 50)
+	assert(t, settlements[0].Expiry, expiry.UnixNano())
+	assert(t, s.Status("PUNKS-0329"), StatusSettled)
+
+	// a contract settles once
+	assert(t, len(s.Settle()), 0)
+	settlement, ok := s.Settlement("PUNKS-0329")
+	assert(t, ok, true)
+	assert(t, settlement, settlements[0])
+}
+
+func TestSettlementIsTimeWeighted(t *testing.T) {
+	clk := clock.NewFake(start)
+	s := NewService(clk, DefaultConfig())
+	s.Add(Contract{Market: "PUNKS-0329", Expiry: expiry})
+
+	// before the window only the last sample counts, from the window start
+	s.Sample("PUNKS-0329", 10)
+	clk.Advance(10 * time.Minute)
+	s.Sample("PUNKS-0329", 40)
+
+	// 10 minutes at 40, 5 at 100 and 15 at 60
+	clk.Advance(30 * time.Minute)
+	s.Sample("PUNKS-0329", 100)
+	clk.Advance(5 * time.Minute)
+	s.Sample("PUNKS-0329", 60)
+
+	// samples after expiry don't count
+	clk.Advance(20 * time.Minute)
+	s.Sample("PUNKS-0329", 1000)
+
+	settlements := s.Settle()
+	assert(t, len(settlements), 1)
+	assertClose(t, settlements[0].Price, (10*40+5*100+15*60)/30.0)
+	assert(t, settlements[0].Samples, 2)
+}
+
+func TestUnsampledContractDoesNotSettle(t *testing.T) {
+	clk := clock.NewFake(start)
+	s := NewService(clk, DefaultConfig())
+	s.Add(Contract{Market: "PUNKS-0329", Expiry: expiry})
+
+	clk.Advance(2 * time.Hour)
+	assert(t, len(s.Settle()), 0)
+	assert(t, s.Status("PUNKS-0329"), StatusExpired)
+
+	_, ok := s.Settlement("PUNKS-0329")
+	assert(t, ok, false)
+}
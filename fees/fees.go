@@ -0,0 +1,204 @@
+package fees
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fineas02/matching-engine/clock"
+)
+
+const (
+	// VolumeWindow is how far back trading volume counts towards a tier
+	VolumeWindow = 30 * 24 * time.Hour
+
+	day = 24 * time.Hour
+)
+
+// Rates are the fees charged on the notional of a fill. A negative maker
+// rate is a rebate paid to the maker.
+type Rates struct {
+	Maker float64
+	Taker float64
+}
+
+// Tier applies its rates to users who traded at least MinVolume of notional
+// over the volume window.
+type Tier struct {
+	MinVolume float64
+	Maker     float64
+	Taker     float64
+}
+
+// Schedule is the fee schedule of a market, tiers ordered by MinVolume.
+type Schedule struct {
+	Tiers []Tier
+}
+
+func DefaultSchedule() Schedule {
+	return Schedule{
+		Tiers: []Tier{
+			{MinVolume: 0, Maker: 0.0002, Taker: 0.0005},
+			{MinVolume: 1_000_000, Maker: 0.0001, Taker: 0.0004},
+			{MinVolume: 5_000_000, Maker: 0, Taker: 0.00035},
+			{MinVolume: 25_000_000, Maker: -0.0001, Taker: 0.0003},
+		},
+	}
+}
+
+// tier returns the highest tier volume qualifies for.
+func (s Schedule) tier(volume float64) (Tier, bool) {
+	var (
+		tier  Tier
+		found bool
+	)
+
+	for _, t := range s.Tiers {
+		if volume >= t.MinVolume {
+			tier = t
+			found = true
+		}
+	}
+
+	return tier, found
+}
+
+// Service prices fills by market schedule, the user's trailing volume and
+// per user overrides.
+type Service struct {
+	clock clock.Clock
+
+	mu        sync.RWMutex
+	schedules map[string]Schedule
+	overrides map[int64]Rates
+	// volumes holds the traded notional of every user per day since epoch
+	volumes map[int64]map[int64]float64
+}
+
+func NewService(clk clock.Clock) *Service {
+	return &Service{
+		clock:     clk,
+		schedules: make(map[string]Schedule),
+		overrides: make(map[int64]Rates),
+		volumes:   make(map[int64]map[int64]float64),
+	}
+}
+
+func (s *Service) SetSchedule(market string, schedule Schedule) {
+	sort.Slice(schedule.Tiers, func(i, j int) bool {
+		return schedule.Tiers[i].MinVolume < schedule.Tiers[j].MinVolume
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.schedules[market] = schedule
+}
+
+func (s *Service) Schedule(market string) (Schedule, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	schedule, ok := s.schedules[market]
+	return schedule, ok
+}
+
+// SetOverride makes the user pay rates in every market regardless of its
+// volume.
+func (s *Service) SetOverride(userID int64, rates Rates) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.overrides[userID] = rates
+}
+
+func (s *Service) HasOverride(userID int64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.overrides[userID]
+	return ok
+}
+
+func (s *Service) ClearOverride(userID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.overrides, userID)
+}
+
+// Rates returns the rates the user currently pays in market.
+func (s *Service) Rates(market string, userID int64) Rates {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if rates, ok := s.overrides[userID]; ok {
+		return rates
+	}
+
+	tier, ok := s.schedules[market].tier(s.volume(userID))
+	if !ok {
+		return Rates{}
+	}
+	return Rates{Maker: tier.Maker, Taker: tier.Taker}
+}
+
+// Fee returns the fee the user pays on a fill of notional in market,
+// negative for a rebate.
+func (s *Service) Fee(market string, userID int64, notional float64, maker bool) float64 {
+	rates := s.Rates(market, userID)
+	if maker {
+		return notional * rates.Maker
+	}
+	return notional * rates.Taker
+}
+
+// RecordTrade adds notional to the user's trading volume.
+func (s *Service) RecordTrade(userID int64, notional float64) {
+	today := s.today()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	days, ok := s.volumes[userID]
+	if !ok {
+		days = make(map[int64]float64)
+		s.volumes[userID] = days
+	}
+	days[today] += notional
+
+	for d := range days {
+		if d <= today-windowDays() {
+			delete(days, d)
+		}
+	}
+}
+
+// Volume returns the notional the user traded over the volume window.
+func (s *Service) Volume(userID int64) float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.volume(userID)
+}
+
+// volume must be called with s.mu held.
+func (s *Service) volume(userID int64) float64 {
+	today := s.today()
+
+	volume := 0.0
+	for d, notional := range s.volumes[userID] {
+		if d > today-windowDays() {
+			volume += notional
+		}
+	}
+	return volume
+}
+
+func (s *Service) today() int64 {
+	return s.clock.Now().Unix() / int64(day/time.Second)
+}
+
+func windowDays() int64 {
+	return int64(VolumeWindow / day)
+}
@@ -0,0 +1,74 @@
+package fees
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fineas02/matching-engine/clock"
+)
+
+func assert(t *testing.T, a, b any) {
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+var start = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func testSchedule() Schedule {
+	return Schedule{
+		Tiers: []Tier{
+			{MinVolume: 1000, Maker: -0.001, Taker: 0.002},
+			{MinVolume: 0, Maker: 0.001, Taker: 0.003},
+		},
+	}
+}
+
+func TestFeeTiers(t *testing.T) {
+	s := NewService(clock.NewFake(start))
+	s.SetSchedule("ETH", testSchedule())
+
+	assert(t, s.Rates("ETH", 1), Rates{Maker: 0.001, Taker: 0.003})
+	assert(t, s.Fee("ETH", 1, 1000, false), 3.0)
+
+	s.RecordTrade(1, 600)
+	s.RecordTrade(1, 400)
+	assert(t, s.Volume(1), 1000.0)
+
+	// the maker now gets a rebate
+	assert(t, s.Rates("ETH", 1), Rates{Maker: -0.001, Taker: 0.002})
+	assert(t, s.Fee("ETH", 1, 1000, true), -1.0)
+
+	// other users and markets without a schedule are unaffected
+	assert(t, s.Rates("ETH", 2), Rates{Maker: 0.001, Taker: 0.003})
+	assert(t, s.Rates("BTC", 1), Rates{})
+}
+
+func TestVolumeWindow(t *testing.T) {
+	clk := clock.NewFake(start)
+	s := NewService(clk)
+	s.SetSchedule("ETH", testSchedule())
+
+	s.RecordTrade(1, 1000)
+	clk.Advance(10 * 24 * time.Hour)
+	s.RecordTrade(1, 500)
+	assert(t, s.Volume(1), 1500.0)
+
+	// the first trade drops out of the window 30 days later
+	clk.Advance(20 * 24 * time.Hour)
+	assert(t, s.Volume(1), 500.0)
+	assert(t, s.Rates("ETH", 1), Rates{Maker: 0.001, Taker: 0.003})
+}
+
+func TestFeeOverride(t *testing.T) {
+	s := NewService(clock.NewFake(start))
+	s.SetSchedule("ETH", testSchedule())
+
+	s.SetOverride(1, Rates{Maker: -0.0005, Taker: 0})
+	assert(t, s.Rates("ETH", 1), Rates{Maker: -0.0005, Taker: 0})
+	assert(t, s.Rates("BTC", 1), Rates{Maker: -0.0005, Taker: 0})
+
+	s.ClearOverride(1)
+	assert(t, s.Rates("ETH", 1), Rates{Maker: 0.001, Taker: 0.003})
+}
@@ -0,0 +1,203 @@
+package floor
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fineas02/matching-engine/clock"
+	"github.com/fineas02/matching-engine/price"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// KindSale is an item of the collection changing hands
+	KindSale = "SALE"
+	// KindListing is an item of the collection offered for sale
+	KindListing = "LISTING"
+)
+
+// Observation is a sale or listing of one item of a collection.
+type Observation struct {
+	Collection string
+	TokenID    string
+	Kind       string
+	Price      float64
+	Timestamp  time.Time
+}
+
+// Source provides the sales and listings of a collection seen since a time.
+type Source interface {
+	Observations(collection string, since time.Time) ([]Observation, error)
+}
+
+type Config struct {
+	// Window is how far back observations count towards the floor
+	Window time.Duration
+	// Trim is the share of observations dropped at each end before taking
+	// the median, in [0, 0.5)
+	Trim float64
+	// MinObservations is the fewest observations a floor is computed from
+	MinObservations int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Window:          24 * time.Hour,
+		Trim:            0.1,
+		MinObservations: 3,
+	}
+}
+
+// Value is the floor of a collection. Observations is the number of sales
+// and listings in the window, Used the number left after trimming.
+type Value struct {
+	Collection   string
+	Price        float64
+	Observations int
+	Used         int
+	Timestamp    int64
+}
+
+// Index prices markets by the floor of the NFT collection they track: the
+// trimmed median of the sales and listings of the collection over a window,
+// so a single wash trade or fat-fingered listing can't move it. Markets that
+// don't track a collection are priced by the fallback source. Index is a
+// price.Source, its floors are the index of the mark price, of funding and
+// of the settlement of dated markets.
+type Index struct {
+	clock    clock.Clock
+	config   Config
+	fallback price.Source
+	sources  []Source
+
+	mu          sync.RWMutex
+	collections map[string]string
+	floors      map[string]Value
+}
+
+// NewIndex creates an index over sources. A nil fallback leaves markets
+// without a collection unpriced.
+func NewIndex(clk clock.Clock, config Config, fallback price.Source, sources ...Source) *Index {
+	return &Index{
+		clock:       clk,
+		config:      config,
+		fallback:    fallback,
+		sources:     sources,
+		collections: make(map[string]string),
+		floors:      make(map[string]Value),
+	}
+}
+
+// Track prices market by the floor of collection.
+func (i *Index) Track(market, collection string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.collections[market] = collection
+}
+
+// Collection returns the collection the market tracks.
+func (i *Index) Collection(market string) (string, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	collection, ok := i.collections[market]
+	return collection, ok
+}
+
+// Floor computes the floor of the collection from what the sources saw
+// during the window. A failing source is skipped, the floor only fails when
+// the others don't have enough observations.
+func (i *Index) Floor(collection string) (Value, error) {
+	now := i.clock.Now()
+	since := now.Add(-i.config.Window)
+
+	var prices []float64
+	var failed []error
+	for _, source := range i.sources {
+		observations, err := source.Observations(collection, since)
+		if err != nil {
+			logrus.WithError(err).WithField("collection", collection).Warn("skipping failing floor source")
+			failed = append(failed, err)
+			continue
+		}
+		for _, o := range observations {
+			if o.Collection != collection || o.Price <= 0 || o.Timestamp.Before(since) || o.Timestamp.After(now) {
+				continue
+			}
+			prices = append(prices, o.Price)
+		}
+	}
+
+	minObservations := i.config.MinObservations
+	if minObservations < 1 {
+		minObservations = 1
+	}
+	if len(prices) < minObservations {
+		err := fmt.Errorf("not enough observations of %s: %d, need %d", collection, len(prices), minObservations)
+		return Value{}, errors.Join(append([]error{err}, failed...)...)
+	}
+
+	trimmed := trim(prices, i.config.Trim)
+	value := Value{
+		Collection:   collection,
+		Price:        median(trimmed),
+		Observations: len(prices),
+		Used:         len(trimmed),
+		Timestamp:    now.UnixNano(),
+	}
+
+	i.mu.Lock()
+	i.floors[collection] = value
+	i.mu.Unlock()
+
+	return value, nil
+}
+
+// Last returns the last floor computed for the collection.
+func (i *Index) Last(collection string) (Value, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	value, ok := i.floors[collection]
+	return value, ok
+}
+
+func (i *Index) IndexPrice(market string) (float64, error) {
+	collection, ok := i.Collection(market)
+	if !ok {
+		if i.fallback == nil {
+			return 0, fmt.Errorf("no index price for market %s", market)
+		}
+		return i.fallback.IndexPrice(market)
+	}
+
+	value, err := i.Floor(collection)
+	if err != nil {
+		return 0, err
+	}
+	return value.Price, nil
+}
+
+// trim sorts prices and drops share of them at each end, always keeping at
+// least one.
+func trim(prices []float64, share float64) []float64 {
+	sort.Float64s(prices)
+
+	cut := int(float64(len(prices)) * share)
+	if cut < 0 || 2*cut >= len(prices) {
+		cut = (len(prices) - 1) / 2
+	}
+	return prices[cut : len(prices)-cut]
+}
+
+func median(sorted []float64) float64 {
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
@@ -0,0 +1,165 @@
+package floor
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fineas02/matching-engine/clock"
+	"github.com/fineas02/matching-engine/price"
+)
+
+func assert(t *testing.T, a, b any) {
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func assertClose(t *testing.T, a, b float64) {
+	if math.Abs(a-b) > 1e-9 {
+		t.Errorf("%v != %v", a, b)
+	}
+}
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func sale(collection string, p float64, at time.Time) Observation {
+	return Observation{Collection: collection, TokenID: "1", Kind: KindSale, Price: p, Timestamp: at}
+}
+
+func TestFloorTrimsOutliers(t *testing.T) {
+	clk := clock.NewFake(start)
+	source := NewMemorySource()
+	index := NewIndex(clk, DefaultConfig(), nil, source)
+
+	// a wash trade and a fat-fingered listing around eight sane prints
+	for i, p := range []float64{0.01, 50, 51, 52, 53, 54, 55, 56, 57, 10000} {
+		source.Add(sale("punks", p, start.Add(-time.Duration(i)*time.Minute)))
+	}
+
+	value, err := index.Floor("punks")
+	assert(t, err, nil)
+	assertClose(t, value.Price, 53.5)
+	assert(t, value.Observations, 10)
+	assert(t, value.Used, 8)
+
+	last, ok := index.Last("punks")
+	assert(t, ok, true)
+	assert(t, last, value)
+}
+
+func TestFloorOnlyCountsTheWindow(t *testing.T) {
+	clk := clock.NewFake(start)
+	source := NewMemorySource()
+	index := NewIndex(clk, DefaultConfig(), nil, source)
+
+	source.Add(
+		sale("punks", 40, start),
+		sale("punks", 41, start),
+		sale("punks", 42, start),
+		sale("apes", 10, start),
+	)
+
+	clk.Advance(12 * time.Hour)
+	source.Add(
+		sale("punks", 60, clk.Now()),
+		sale("punks", 61, clk.Now()),
+		sale("punks", 62, clk.Now()),
+	)
+
+	value, err := index.Floor("punks")
+	assert(t, err, nil)
+	assertClose(t, value.Price, 51)
+
+	// the first prints fall out of the window
+	clk.Advance(13 * time.Hour)
+	value, err = index.Floor("punks")
+	assert(t, err, nil)
+	assertClose(t, value.Price, 61)
+	assert(t, value.Observations, 3)
+
+	_, err = index.Floor("apes")
+	assert(t, err != nil, true)
+}
+
+func TestFloorSkipsFailingSource(t *testing.T) {
+	clk := clock.NewFake(start)
+	source := NewMemorySource()
+	broken := NewFileSource(filepath.Join(t.TempDir(), "missing.json"))
+	index := NewIndex(clk, DefaultConfig(), nil, broken, source)
+
+	source.Add(sale("punks", 50, start), sale("punks", 52, start))
+
+	// the other source doesn't have enough on its own, the error says why
+	_, err := index.Floor("punks")
+	assert(t, err != nil, true)
+	assert(t, errors.Is(err, os.ErrNotExist), true)
+
+	source.Add(sale("punks", 54, start))
+	value, err := index.Floor("punks")
+	assert(t, err, nil)
+	assertClose(t, value.Price, 52)
+	assert(t, value.Observations, 3)
+}
+
+func TestIndexPricesTrackedMarkets(t *testing.T) {
+	clk := clock.NewFake(start)
+	source := NewMemorySource()
+	fallback := price.NewStaticSource(map[string]float64{"ETH": 1000})
+	index := NewIndex(clk, DefaultConfig(), fallback, source)
+
+	source.Add(sale("punks", 50, start), sale("punks", 52, start), sale("punks", 54, start))
+
+	_, err := index.IndexPrice("PUNKS")
+	assert(t, err != nil, true)
+
+	index.Track("PUNKS", "punks")
+	p, err := index.IndexPrice("PUNKS")
+	assert(t, err, nil)
+	assertClose(t, p, 52)
+
+	p, err = index.IndexPrice("ETH")
+	assert(t, err, nil)
+	assertClose(t, p, 1000)
+
+	// the floor is the index the price service marks the market at
+	prices := price.NewService(index, price.DefaultConfig())
+	mp := prices.Update("PUNKS", 0, 0)
+	assertClose(t, mp.Index, 52)
+	assertClose(t, mp.Mark, 52)
+}
+
+func TestFileSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sales.json")
+	data := `[
+		{"Collection": "punks", "TokenID": "1", "Kind": "SALE", "Price": 50, "Timestamp": "2024-01-01T00:00:00Z"},
+		{"Collection": "punks", "TokenID": "2", "Kind": "LISTING", "Price": 55, "Timestamp": "2023-12-31T23:00:00Z"},
+		{"Collection": "punks", "TokenID": "3", "Kind": "SALE", "Price": 45, "Timestamp": "2023-12-01T00:00:00Z"},
+		{"Collection": "apes", "TokenID": "1", "Kind": "SALE", "Price": 10, "Timestamp": "2024-01-01T00:00:00Z"}
+	]`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	source := NewFileSource(path)
+	observations, err := source.Observations("punks", start.Add(-24*time.Hour))
+	assert(t, err, nil)
+	assert(t, len(observations), 2)
+	assert(t, observations[1].Kind, KindListing)
+
+	config := DefaultConfig()
+	config.MinObservations = 2
+	index := NewIndex(clock.NewFake(start), config, nil, source)
+	index.Track("PUNKS", "punks")
+
+	p, err := index.IndexPrice("PUNKS")
+	assert(t, err, nil)
+	assertClose(t, p, 52.5)
+
+	_, err = NewFileSource(filepath.Join(t.TempDir(), "missing.json")).Observations("punks", start)
+	assert(t, err != nil, true)
+}
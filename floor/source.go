@@ -0,0 +1,71 @@
+package floor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemorySource is a Source backed by observations added locally, e.g. by a
+// marketplace indexer running in the same process or by a test.
+type MemorySource struct {
+	mu           sync.RWMutex
+	observations map[string][]Observation
+}
+
+func NewMemorySource() *MemorySource {
+	return &MemorySource{observations: make(map[string][]Observation)}
+}
+
+func (s *MemorySource) Add(observations ...Observation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, o := range observations {
+		s.observations[o.Collection] = append(s.observations[o.Collection], o)
+	}
+}
+
+func (s *MemorySource) Observations(collection string, since time.Time) ([]Observation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return filter(s.observations[collection], collection, since), nil
+}
+
+// FileSource is a Source backed by a JSON file holding an array of
+// observations, so the index can run offline. The file is read on every
+// call, replacing it updates the index.
+type FileSource struct {
+	path string
+}
+
+func NewFileSource(path string) *FileSource {
+	return &FileSource{path: path}
+}
+
+func (s *FileSource) Observations(collection string, since time.Time) ([]Observation, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var observations []Observation
+	if err := json.Unmarshal(data, &observations); err != nil {
+		return nil, fmt.Errorf("invalid observations in %s: %w", s.path, err)
+	}
+
+	return filter(observations, collection, since), nil
+}
+
+func filter(observations []Observation, collection string, since time.Time) []Observation {
+	var matching []Observation
+	for _, o := range observations {
+		if o.Collection == collection && !o.Timestamp.Before(since) {
+			matching = append(matching, o)
+		}
+	}
+	return matching
+}
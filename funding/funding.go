@@ -0,0 +1,181 @@
+package funding
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fineas02/matching-engine/clock"
+)
+
+type Config struct {
+	// Interval is the time between two funding payments. Funding happens on
+	// multiples of it, e.g. 00:00, 08:00 and 16:00 UTC for 8 hours.
+	Interval time.Duration
+	// MaxRate caps the funding rate of one interval in both directions
+	MaxRate float64
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Interval: 8 * time.Hour,
+		MaxRate:  0.0075,
+	}
+}
+
+// Rate is the funding of a market for one interval. Longs pay shorts Rate
+// times the notional of their position at MarkPrice, shorts pay longs when
+// it is negative. Premium is the average premium of the mark over the index
+// sampled during the interval, as a fraction of the index.
+type Rate struct {
+	Market     string
+	Rate       float64
+	Premium    float64
+	Samples    int
+	MarkPrice  float64
+	IndexPrice float64
+	Timestamp  int64
+}
+
+type market struct {
+	next       time.Time
+	premiumSum float64
+	samples    int
+	mark       float64
+	index      float64
+}
+
+// Service samples the premium of every market and turns it into a funding
+// rate at each funding time.
+type Service struct {
+	clock  clock.Clock
+	config Config
+
+	mu      sync.RWMutex
+	markets map[string]*market
+	history map[string][]Rate
+}
+
+func NewService(clk clock.Clock, config Config) *Service {
+	return &Service{
+		clock:   clk,
+		config:  config,
+		markets: make(map[string]*market),
+		history: make(map[string][]Rate),
+	}
+}
+
+// Sample records the premium of mark over index for the current interval.
+func (s *Service) Sample(name string, mark, index float64) {
+	if mark <= 0 || index <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.market(name)
+	m.premiumSum += (mark - index) / index
+	m.samples++
+	m.mark = mark
+	m.index = index
+}
+
+// Predicted returns the rate the market would fund at if the current
+// interval ended now.
+func (s *Service) Predicted(name string) float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m, ok := s.markets[name]
+	if !ok {
+		return 0
+	}
+	return s.rate(m)
+}
+
+// NextFunding returns the time the market funds next.
+func (s *Service) NextFunding(name string) time.Time {
+	s.mu.RLock()
+	m, ok := s.markets[name]
+	s.mu.RUnlock()
+
+	if !ok {
+		return s.nextFunding(s.clock.Now())
+	}
+	return m.next
+}
+
+// Settle closes the interval of every market whose funding time has passed
+// and returns their rates, ordered by market. A market that wasn't sampled
+// during the interval doesn't fund.
+func (s *Service) Settle() []Rate {
+	now := s.clock.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rates := []Rate{}
+	for name, m := range s.markets {
+		if now.Before(m.next) {
+			continue
+		}
+
+		if m.samples > 0 {
+			rate := Rate{
+				Market:     name,
+				Rate:       s.rate(m),
+				Premium:    m.premiumSum / float64(m.samples),
+				Samples:    m.samples,
+				MarkPrice:  m.mark,
+				IndexPrice: m.index,
+				Timestamp:  m.next.UnixNano(),
+			}
+			s.history[name] = append(s.history[name], rate)
+			rates = append(rates, rate)
+		}
+
+		m.premiumSum = 0
+		m.samples = 0
+		m.next = s.nextFunding(now)
+	}
+
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Market < rates[j].Market })
+
+	return rates
+}
+
+// History returns every rate the market funded at, oldest first.
+func (s *Service) History(name string) []Rate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	history := make([]Rate, len(s.history[name]))
+	copy(history, s.history[name])
+	return history
+}
+
+// market returns the state of the named market, starting its first interval
+// if it has none. Must be called with s.mu held.
+func (s *Service) market(name string) *market {
+	m, ok := s.markets[name]
+	if !ok {
+		m = &market{next: s.nextFunding(s.clock.Now())}
+		s.markets[name] = m
+	}
+	return m
+}
+
+func (s *Service) rate(m *market) float64 {
+	if m.samples == 0 {
+		return 0
+	}
+
+	premium := m.premiumSum / float64(m.samples)
+	return math.Max(-s.config.MaxRate, math.Min(s.config.MaxRate, premium))
+}
+
+func (s *Service) nextFunding(now time.Time) time.Time {
+	return now.Truncate(s.config.Interval).Add(s.config.Interval)
+}
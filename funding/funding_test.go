@@ -0,0 +1,77 @@
+package funding
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fineas02/matching-engine/clock"
+)
+
+func assert(t *testing.T, a, b any) {
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func assertClose(t *testing.T, a, b float64) {
+	if math.Abs(a-b) > 1e-9 {
+		t.Errorf("%v != %v", a, b)
+	}
+}
+
+var start = time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)
+
+func TestFundingAveragesPremium(t *testing.T) {
+	clk := clock.NewFake(start)
+	s := NewService(clk, DefaultConfig())
+
+	s.Sample("ETH", 1002, 1000)
+	s.Sample("ETH", 1004, 1000)
+	assertClose(t, s.Predicted("ETH"), 0.003)
+	assert(t, s.NextFunding("ETH"), time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC))
+
+	// nothing to settle before the funding time
+	clk.Advance(6 * time.Hour)
+	assert(t, len(s.Settle()), 0)
+
+	clk.Advance(time.Hour)
+	rates := s.Settle()
+	assert(t, len(rates), 1)
+	assertClose(t, rates[0].Rate, 0.003)
+	assert(t, rates[0].Samples, 2)
+	assertClose(t, rates[0].MarkPrice, 1004)
+	assert(t, rates[0].Timestamp, time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC).UnixNano())
+
+	// the next interval starts over
+	assertClose(t, s.Predicted("ETH"), 0)
+	assert(t, s.NextFunding("ETH"), time.Date(2024, 1, 1, 16, 0, 0, 0, time.UTC))
+	assert(t, len(s.History("ETH")), 1)
+}
+
+func TestFundingRateIsClamped(t *testing.T) {
+	clk := clock.NewFake(start)
+	s := NewService(clk, DefaultConfig())
+
+	s.Sample("ETH", 900, 1000)
+	clk.Advance(8 * time.Hour)
+
+	rates := s.Settle()
+	assert(t, len(rates), 1)
+	assertClose(t, rates[0].Premium, -0.1)
+	assertClose(t, rates[0].Rate, -0.0075)
+}
+
+func TestFundingSkipsUnsampledInterval(t *testing.T) {
+	clk := clock.NewFake(start)
+	s := NewService(clk, DefaultConfig())
+
+	s.Sample("ETH", 1001, 1000)
+	clk.Advance(7 * time.Hour)
+	assert(t, len(s.Settle()), 1)
+
+	clk.Advance(8 * time.Hour)
+	assert(t, len(s.Settle()), 0)
+	assert(t, len(s.History("ETH")), 1)
+}
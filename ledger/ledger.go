@@ -0,0 +1,201 @@
+package ledger
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/fineas02/matching-engine/clock"
+)
+
+const (
+	EntryDeposit     = "deposit"
+	EntryWithdrawal  = "withdrawal"
+	EntryTrade       = "trade"
+	EntryFee         = "fee"
+	EntryFunding     = "funding"
+	EntryLiquidation = "liquidation"
+	EntryCollateral  = "collateral"
+	EntryNFT         = "nft"
+
+	// AccountFees collects trading fees and pays maker rebates
+	AccountFees = "exchange:fees"
+	// AccountInsurance is the insurance fund
+	AccountInsurance = "exchange:insurance"
+	// AccountPnL is the other side of realized trading PnL. Its balance is
+	// the PnL still unrealized in open positions.
+	AccountPnL = "exchange:pnl"
+	// AccountFunding is the other side of funding payments
+	AccountFunding = "exchange:funding"
+	// AccountExternal is the other side of deposits and withdrawals, the
+	// world outside the exchange
+	AccountExternal = "external"
+
+	// epsilon absorbs float noise when checking that postings balance
+	epsilon = 1e-6
+)
+
+// UserAccount returns the ledger account of a user.
+func UserAccount(userID int64) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// Posting changes the balance of one account by Amount of Asset.
+type Posting struct {
+	Account string
+	Asset   string
+	Amount  float64
+}
+
+// Entry is a balanced set of postings: per asset its amounts sum to zero.
+// Reference points at the event that caused it, e.g. an order or a
+// liquidation.
+type Entry struct {
+	ID        int64
+	Type      string
+	Reference string
+	Timestamp int64
+	Postings  []Posting
+}
+
+// Transfer returns the postings that move amount of asset from one account
+// to another.
+func Transfer(from, to, asset string, amount float64) []Posting {
+	return []Posting{
+		{Account: from, Asset: asset, Amount: -amount},
+		{Account: to, Asset: asset, Amount: amount},
+	}
+}
+
+// Ledger is an append-only double-entry journal and the account balances
+// that follow from it.
+type Ledger struct {
+	clock clock.Clock
+
+	mu        sync.RWMutex
+	entries   []Entry
+	balances  map[string]map[string]float64
+	byAccount map[string][]int
+}
+
+func New(clk clock.Clock) *Ledger {
+	return &Ledger{
+		clock:     clk,
+		balances:  make(map[string]map[string]float64),
+		byAccount: make(map[string][]int),
+	}
+}
+
+// Post journals the postings as one entry. Zero postings are dropped, an
+// entry left without postings isn't journaled. Unbalanced postings are
+// rejected.
+func (l *Ledger) Post(entryType, reference string, postings ...Posting) (Entry, error) {
+	entry := Entry{
+		Type:      entryType,
+		Reference: reference,
+		Timestamp: l.clock.Now().UnixNano(),
+	}
+
+	sums := make(map[string]float64)
+	for _, posting := range postings {
+		if posting.Amount == 0 {
+			continue
+		}
+		entry.Postings = append(entry.Postings, posting)
+		sums[posting.Asset] += posting.Amount
+	}
+
+	for asset, sum := range sums {
+		if math.Abs(sum) > epsilon {
+			return Entry{}, fmt.Errorf("unbalanced %s entry %s: %s postings sum to %f", entryType, reference, asset, sum)
+		}
+	}
+
+	if len(entry.Postings) == 0 {
+		return entry, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.ID = int64(len(l.entries) + 1)
+	index := len(l.entries)
+	l.entries = append(l.entries, entry)
+
+	for _, posting := range entry.Postings {
+		balances, ok := l.balances[posting.Account]
+		if !ok {
+			balances = make(map[string]float64)
+			l.balances[posting.Account] = balances
+		}
+		balances[posting.Asset] += posting.Amount
+
+		indices := l.byAccount[posting.Account]
+		if len(indices) == 0 || indices[len(indices)-1] != index {
+			l.byAccount[posting.Account] = append(indices, index)
+		}
+	}
+
+	return entry, nil
+}
+
+// Balance returns the balance of asset in the account.
+func (l *Ledger) Balance(account, asset string) float64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.balances[account][asset]
+}
+
+// Balances returns every asset balance of the account.
+func (l *Ledger) Balances(account string) map[string]float64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	balances := make(map[string]float64, len(l.balances[account]))
+	for asset, amount := range l.balances[account] {
+		balances[asset] = amount
+	}
+	return balances
+}
+
+// Entries returns the entries that touch the account, oldest first.
+func (l *Ledger) Entries(account string) []Entry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	indices := l.byAccount[account]
+	entries := make([]Entry, len(indices))
+	for i, index := range indices {
+		entries[i] = l.entries[index]
+	}
+	return entries
+}
+
+// Check verifies the books: across all accounts every asset has to sum to
+// zero.
+func (l *Ledger) Check() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	sums := make(map[string]float64)
+	for _, balances := range l.balances {
+		for asset, amount := range balances {
+			sums[asset] += amount
+		}
+	}
+
+	assets := make([]string, 0, len(sums))
+	for asset := range sums {
+		assets = append(assets, asset)
+	}
+	sort.Strings(assets)
+
+	for _, asset := range assets {
+		if math.Abs(sums[asset]) > epsilon {
+			return fmt.Errorf("ledger out of balance: %s sums to %f", asset, sums[asset])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package ledger
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fineas02/matching-engine/clock"
+)
+
+func assert(t *testing.T, a, b any) {
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func TestPostTransfer(t *testing.T) {
+	l := New(clock.NewFake(time.Unix(0, 0)))
+	alice, bob := UserAccount(1), UserAccount(2)
+
+	_, err := l.Post(EntryDeposit, "deposit:1", Transfer(AccountExternal, alice, "ETH", 100)...)
+	assert(t, err, nil)
+	_, err = l.Post(EntryFee, "order:1", Transfer(alice, AccountFees, "ETH", 2)...)
+	assert(t, err, nil)
+	_, err = l.Post(EntryTrade, "order:2", Transfer(AccountPnL, bob, "ETH", 5)...)
+	assert(t, err, nil)
+
+	assert(t, l.Balance(alice, "ETH"), 98.0)
+	assert(t, l.Balance(bob, "ETH"), 5.0)
+	assert(t, l.Balance(AccountExternal, "ETH"), -100.0)
+	assert(t, l.Balances(AccountFees), map[string]float64{"ETH": 2})
+
+	entries := l.Entries(alice)
+	assert(t, len(entries), 2)
+	assert(t, entries[0].Type, EntryDeposit)
+	assert(t, entries[1].Reference, "order:1")
+
+	assert(t, l.Check(), nil)
+}
+
+func TestPostRejectsUnbalanced(t *testing.T) {
+	l := New(clock.NewFake(time.Unix(0, 0)))
+
+	_, err := l.Post(EntryTrade, "order:1",
+		Posting{Account: UserAccount(1), Asset: "ETH", Amount: 10},
+		Posting{Account: AccountPnL, Asset: "ETH", Amount: -9},
+	)
+	if err == nil {
+		t.Error("posted an unbalanced entry")
+	}
+	assert(t, len(l.Entries(UserAccount(1))), 0)
+	assert(t, l.Check(), nil)
+}
+
+func TestPostSkipsZeroAmounts(t *testing.T) {
+	l := New(clock.NewFake(time.Unix(0, 0)))
+
+	entry, err := l.Post(EntryFee, "order:1", Transfer(UserAccount(1), AccountFees, "ETH", 0)...)
+	assert(t, err, nil)
+	assert(t, entry.ID, int64(0))
+	assert(t, len(l.Entries(UserAccount(1))), 0)
+}
@@ -5,14 +5,38 @@ import (
 	"time"
 
 	"github.com/fineas02/matching-engine/client"
+	"github.com/fineas02/matching-engine/clock"
+	"github.com/fineas02/matching-engine/floor"
+	"github.com/fineas02/matching-engine/price"
 	"github.com/fineas02/matching-engine/server"
 )
 
 func main() {
-	exchange, err := server.NewExchange()
+	index := price.NewStaticSource(map[string]float64{"ETH": 1000, "USDC": 0.0004, "USDT": 0.0004})
+
+	// PUNKS tracks the floor of the collection from the sales and listings
+	// in floors.json, without the file its mark follows the book. Wrapped
+	// punks posted as collateral count at the same floor.
+	floors := floor.NewIndex(clock.System{}, floor.DefaultConfig(), index, floor.NewFileSource("floors.json"))
+	floors.Track("PUNKS", "cryptopunks")
+	floors.Track("WPUNK", "cryptopunks")
+
+	exchange, err := server.NewExchange(floors)
 	if err != nil {
 		log.Fatalf("Failed to create Exchange: %v", err)
 	}
+	exchange.CollateralPrices = floors
+
+	if err := exchange.AddMarket("PUNKS", server.NewMarketConfig(0.20, 5.0, 0.10, 0.01, 0.01, 0.01)); err != nil {
+		log.Fatalf("Failed to add market: %v", err)
+	}
+	if err := exchange.AddCollection("cryptopunks"); err != nil {
+		log.Fatalf("Failed to add collection: %v", err)
+	}
+	// trait bids need the traits of the tokens from the collection manifest
+	if err := exchange.NFTMetadata.LoadFile("cryptopunks-manifest.json"); err != nil {
+		log.Printf("No cryptopunks metadata, trait bids won't fill: %v", err)
+	}
 
 	go server.StartServer(exchange)
 	time.Sleep(1 * time.Second)
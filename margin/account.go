@@ -0,0 +1,245 @@
+package margin
+
+import (
+	"math"
+	"sort"
+)
+
+// Account is a point in time summary of a user's margin state.
+//
+// MarginUsed is the initial margin of cross positions at their mark price
+// plus the margin assigned to isolated positions, OrderMargin the initial
+// margin reserved for open orders. AvailableMargin is the cross equity left
+// on top of both. MaintenanceMargin is the equity needed to not get
+// liquidated. MarginRatio is equity over the notional of all positions and is
+// zero when the user is flat. CollateralValue is what the balances other than
+// the settlement asset count towards equity after their haircuts.
+type Account struct {
+	UserID            int64
+	Balance           map[string]float64
+	Collateral        []CollateralBalance
+	CollateralValue   float64
+	Positions         []Position
+	UnrealizedPNL     float64
+	RealizedPNL       float64
+	Equity            float64
+	Notional          float64
+	MarginUsed        float64
+	OrderMargin       float64
+	AvailableMargin   float64
+	MaintenanceMargin float64
+	MarginRatio       float64
+}
+
+// revalue recomputes the unrealized PnL of the position at its mark price.
+func (p *Position) revalue() {
+	p.UnrealizedPNL = p.signedSize() * (p.MarkPrice - p.OpenPrice)
+}
+
+// Notional returns the value of the position at its mark price.
+func (p *Position) Notional() float64 {
+	return p.Size * p.MarkPrice
+}
+
+// InitialMargin returns the margin the position ties up, as OrderMargin
+// prices it in the risk tier of its notional.
+func (p *Position) InitialMargin(config *MarketConfig) float64 {
+	tier := RiskTier{}
+	if config != nil {
+		tier, _ = config.Tier(p.Notional())
+	}
+	return OrderMargin(config, tier, p.Size, p.MarkPrice, p.Leverage)
+}
+
+// MaintenanceMargin returns the equity the position needs behind it to stay
+// open, at the rate of the risk tier its notional falls in.
+func (p *Position) MaintenanceMargin(config *MarketConfig) float64 {
+	if config == nil {
+		return 0
+	}
+	return p.Notional() * config.MaintenanceRate(p.Notional())
+}
+
+// MaintenanceRequirement returns the maintenance margin of all positions.
+func (u *User) MaintenanceRequirement(configs map[string]*MarketConfig) float64 {
+	requirement := 0.0
+	for asset, position := range u.Positions {
+		requirement += position.MaintenanceMargin(configs[asset])
+	}
+	return requirement
+}
+
+// crossRequirement returns the maintenance margin of the cross positions.
+func (u *User) crossRequirement(configs map[string]*MarketConfig) float64 {
+	requirement := 0.0
+	for asset, position := range u.Positions {
+		if position.MarginMode != MarginIsolated {
+			requirement += position.MaintenanceMargin(configs[asset])
+		}
+	}
+	return requirement
+}
+
+// IsLiquidatable reports whether any of the user's positions has to be
+// liquidated.
+func (u *User) IsLiquidatable(configs map[string]*MarketConfig) bool {
+	return len(u.LiquidatablePositions(configs)) > 0
+}
+
+// LiquidatablePositions returns the markets of the positions that have to be
+// liquidated: isolated positions whose margin dropped below their maintenance
+// margin, and all cross positions once the cross equity dropped below theirs.
+func (u *User) LiquidatablePositions(configs map[string]*MarketConfig) []string {
+	u.UpdateEquity()
+
+	crossLiquidatable := u.crossEquity() < u.crossRequirement(configs)
+
+	assets := []string{}
+	for asset, position := range u.Positions {
+		if position.MarginMode == MarginIsolated {
+			if position.isolatedEquity() < position.MaintenanceMargin(configs[asset]) {
+				assets = append(assets, asset)
+			}
+		} else if crossLiquidatable {
+			assets = append(assets, asset)
+		}
+	}
+	sort.Strings(assets)
+
+	return assets
+}
+
+// UpdateLiquidationPrices sets the liquidation price of every position: the
+// mark at which the equity backing it would meet its maintenance requirement.
+// Isolated positions only have their own margin, cross positions share the
+// cross equity, assuming all other positions keep their current mark and the
+// position stays in the risk tier of its current notional. Zero means the
+// position can't be liquidated by its own price moving.
+func (u *User) UpdateLiquidationPrices(configs map[string]*MarketConfig) {
+	u.UpdateEquity()
+	crossEquity := u.crossEquity()
+	crossRequirement := u.crossRequirement(configs)
+
+	for asset, position := range u.Positions {
+		mm := 0.0
+		if config := configs[asset]; config != nil {
+			mm = config.MaintenanceRate(position.Notional())
+		}
+
+		equity, otherRequirement := position.isolatedEquity(), 0.0
+		if position.MarginMode != MarginIsolated {
+			equity = crossEquity
+			otherRequirement = crossRequirement - position.MaintenanceMargin(configs[asset])
+		}
+
+		// equity + s*(P-mark) = otherRequirement + mm*|s|*P, solved for P
+		s := position.signedSize()
+		price := (otherRequirement - equity + s*position.MarkPrice) / (s - mm*position.Size)
+
+		position.LiquidationPrice = math.Max(price, 0)
+	}
+}
+
+// MarkToMarket values the user's position in asset at mark and refreshes the
+// unrealized PnL and equity of the user.
+func (u *User) MarkToMarket(asset string, mark float64) {
+	position, ok := u.Positions[asset]
+	if !ok || mark <= 0 {
+		return
+	}
+
+	position.MarkPrice = mark
+	position.revalue()
+	u.UpdateEquity()
+}
+
+// Account summarizes the margin state of the user. configs holds the market
+// config of every market the user may have a position in.
+func (u *User) Account(configs map[string]*MarketConfig) Account {
+	account := Account{
+		UserID:      u.ID,
+		Balance:     make(map[string]float64, len(u.Balance)),
+		Positions:   make([]Position, 0, len(u.Positions)),
+		RealizedPNL: u.RealizedPNL,
+		Equity:      u.UpdateEquity(),
+	}
+	account.UnrealizedPNL = u.UnrealizedPNL
+
+	for asset, amount := range u.Balance {
+		account.Balance[asset] = amount
+	}
+	account.Collateral = u.Collateral()
+	account.CollateralValue = u.CollateralValue()
+
+	u.UpdateLiquidationPrices(configs)
+	for asset, position := range u.Positions {
+		account.Positions = append(account.Positions, *position)
+		account.Notional += position.Notional()
+		if position.MarginMode == MarginIsolated {
+			account.MarginUsed += position.IsolatedMargin
+		} else {
+			account.MarginUsed += position.InitialMargin(configs[asset])
+		}
+	}
+	sort.Slice(account.Positions, func(i, j int) bool {
+		return account.Positions[i].Asset < account.Positions[j].Asset
+	})
+	account.MaintenanceMargin = u.MaintenanceRequirement(configs)
+
+	account.OrderMargin = u.ReservedMargin()
+	account.AvailableMargin = u.AvailableMargin(configs)
+	if account.Notional > 0 {
+		account.MarginRatio = account.Equity / account.Notional
+	}
+
+	return account
+}
+
+// BankruptcyPrice returns the mark at which the equity backing the position
+// in asset would be wiped out: its own margin when isolated, the cross equity
+// otherwise, assuming all other positions keep their current mark. Zero if
+// the user has no position in asset.
+func (u *User) BankruptcyPrice(asset string) float64 {
+	position, ok := u.Positions[asset]
+	if !ok {
+		return 0
+	}
+
+	u.UpdateEquity()
+	equity := u.crossEquity()
+	if position.MarginMode == MarginIsolated {
+		equity = position.isolatedEquity()
+	}
+
+	price := position.MarkPrice - equity/position.signedSize()
+	return math.Max(price, 0)
+}
+
+// Shortfall returns the loss the user can't cover at the current marks: the
+// negative cross equity plus the negative equity of isolated positions.
+func (u *User) Shortfall() float64 {
+	u.UpdateEquity()
+
+	shortfall := math.Max(-u.crossEquity(), 0)
+	for _, position := range u.Positions {
+		if position.MarginMode == MarginIsolated {
+			shortfall += math.Max(-position.isolatedEquity(), 0)
+		}
+	}
+	return shortfall
+}
+
+// EffectiveLeverage returns the notional of all positions over equity, zero
+// when equity is gone.
+func (u *User) EffectiveLeverage() float64 {
+	equity := u.UpdateEquity()
+	if equity <= 0 {
+		return 0
+	}
+
+	notional := 0.0
+	for _, position := range u.Positions {
+		notional += position.Notional()
+	}
+	return notional / equity
+}
@@ -0,0 +1,168 @@
+package margin
+
+import (
+	"math"
+	"sort"
+)
+
+// CollateralConfig is how an asset other than the settlement asset counts
+// towards margin. Haircut is the share of its value that doesn't count, the
+// riskier the asset the larger the haircut.
+type CollateralConfig struct {
+	Haircut float64
+}
+
+// CollateralBalance is one collateral asset of a user. Price is in the
+// settlement asset and Value is what the balance counts towards equity after
+// the haircut.
+type CollateralBalance struct {
+	Asset   string
+	Amount  float64
+	Price   float64
+	Haircut float64
+	Value   float64
+}
+
+// CollateralSale is collateral sold to cover a negative settlement balance.
+// Price is the marked price, the proceeds are what is left after the haircut.
+type CollateralSale struct {
+	Asset    string
+	Amount   float64
+	Price    float64
+	Haircut  float64
+	Proceeds float64
+}
+
+// collateralMark is the last price and haircut a collateral asset was valued
+// at.
+type collateralMark struct {
+	price   float64
+	haircut float64
+}
+
+// weight returns what one unit of the asset counts towards equity.
+func (m collateralMark) weight() float64 {
+	return m.price * (1 - m.haircut)
+}
+
+// MarkCollateral values the user's balance of asset at price in the
+// settlement asset, less the haircut of config. Assets that are never marked
+// don't count towards equity.
+func (u *User) MarkCollateral(asset string, price float64, config *CollateralConfig) {
+	if asset == SettlementAsset || config == nil || price <= 0 {
+		return
+	}
+
+	u.collateral[asset] = collateralMark{
+		price:   price,
+		haircut: math.Min(math.Max(config.Haircut, 0), 1),
+	}
+	u.UpdateEquity()
+}
+
+// CollateralValue returns what the user's balances other than the settlement
+// asset count towards equity.
+func (u *User) CollateralValue() float64 {
+	value := 0.0
+	for asset, amount := range u.Balance {
+		if asset == SettlementAsset || amount <= 0 {
+			continue
+		}
+		value += amount * u.collateral[asset].weight()
+	}
+	return value
+}
+
+// Collateral returns the user's collateral balances by asset.
+func (u *User) Collateral() []CollateralBalance {
+	balances := []CollateralBalance{}
+	for asset, amount := range u.Balance {
+		if asset == SettlementAsset || amount == 0 {
+			continue
+		}
+
+		mark := u.collateral[asset]
+		balance := CollateralBalance{
+			Asset:   asset,
+			Amount:  amount,
+			Price:   mark.price,
+			Haircut: mark.haircut,
+		}
+		if amount > 0 {
+			balance.Value = amount * mark.weight()
+		}
+		balances = append(balances, balance)
+	}
+	sort.Slice(balances, func(i, j int) bool { return balances[i].Asset < balances[j].Asset })
+
+	return balances
+}
+
+// Withdrawable returns how much of asset the user can take out without
+// dipping into the margin of open positions and orders.
+func (u *User) Withdrawable(asset string, configs map[string]*MarketConfig) float64 {
+	balance := math.Max(u.Balance[asset], 0)
+	available := math.Max(u.AvailableMargin(configs), 0)
+
+	if asset == SettlementAsset {
+		return math.Min(balance, available)
+	}
+
+	weight := u.collateral[asset].weight()
+	if weight <= 0 {
+		// it doesn't count towards margin, so it doesn't back anything
+		return balance
+	}
+	return math.Min(balance, available/weight)
+}
+
+// LiquidateCollateral sells collateral at its haircut value until the
+// settlement balance is no longer negative, the assets with the largest
+// haircut first. A forced sale doesn't fetch the marked price, the haircut
+// is what the user pays for it. It returns what it sold.
+func (u *User) LiquidateCollateral() []CollateralSale {
+	deficit := -u.Balance[SettlementAsset]
+	if deficit <= 0 {
+		return nil
+	}
+
+	assets := []string{}
+	for asset, amount := range u.Balance {
+		if asset != SettlementAsset && amount > 0 && u.collateral[asset].weight() > 0 {
+			assets = append(assets, asset)
+		}
+	}
+	sort.Slice(assets, func(i, j int) bool {
+		a, b := u.collateral[assets[i]], u.collateral[assets[j]]
+		if a.haircut == b.haircut {
+			return assets[i] < assets[j]
+		}
+		return a.haircut > b.haircut
+	})
+
+	sales := []CollateralSale{}
+	for _, asset := range assets {
+		if deficit <= 0 {
+			break
+		}
+
+		mark := u.collateral[asset]
+		amount := math.Min(u.Balance[asset], deficit/mark.weight())
+		proceeds := amount * mark.weight()
+
+		u.Balance[asset] -= amount
+		u.Balance[SettlementAsset] += proceeds
+		deficit -= proceeds
+
+		sales = append(sales, CollateralSale{
+			Asset:    asset,
+			Amount:   amount,
+			Price:    mark.price,
+			Haircut:  mark.haircut,
+			Proceeds: proceeds,
+		})
+	}
+	u.UpdateEquity()
+
+	return sales
+}
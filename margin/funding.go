@@ -0,0 +1,23 @@
+package margin
+
+// ApplyFunding pays funding on the user's position in the market: rate times
+// the notional at mark, paid by longs and received by shorts when the rate
+// is positive and the other way around when it is negative. Isolated
+// positions pay out of and receive into their own margin. It returns the
+// amount paid, negative when the user received funding.
+func (u *User) ApplyFunding(asset string, rate, mark float64) float64 {
+	position, ok := u.Positions[asset]
+	if !ok {
+		return 0
+	}
+
+	payment := position.signedSize() * mark * rate
+	if position.MarginMode == MarginIsolated {
+		position.IsolatedMargin -= payment
+	} else {
+		u.Balance[SettlementAsset] -= payment
+	}
+	u.UpdateEquity()
+
+	return payment
+}
@@ -0,0 +1,136 @@
+package margin
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// MarginCross positions share the equity of the whole account
+	MarginCross = "CROSS"
+	// MarginIsolated positions only have the margin assigned to them to lose
+	MarginIsolated = "ISOLATED"
+)
+
+// MarginMode returns the margin mode the user trades the market in.
+func (u *User) MarginMode(asset string) string {
+	if mode, ok := u.MarginModes[asset]; ok {
+		return mode
+	}
+	return MarginCross
+}
+
+// SetMarginMode switches the margin mode of the market. The user has to be
+// flat in it.
+func (u *User) SetMarginMode(asset, mode string) error {
+	if mode != MarginCross && mode != MarginIsolated {
+		return fmt.Errorf("invalid margin mode %q", mode)
+	}
+	if _, ok := u.Positions[asset]; ok {
+		return fmt.Errorf("can't change margin mode of %s with an open position", asset)
+	}
+
+	u.MarginModes[asset] = mode
+	return nil
+}
+
+// AdjustIsolatedMargin moves amount from the settlement balance into the
+// isolated margin of the user's position in asset, or back out of it when
+// amount is negative. Adding is limited by the margin available to cross
+// positions, removing has to leave the position its initial margin.
+func (u *User) AdjustIsolatedMargin(asset string, amount float64, configs map[string]*MarketConfig) error {
+	position, ok := u.Positions[asset]
+	if !ok || position.MarginMode != MarginIsolated {
+		return fmt.Errorf("no isolated position in %s", asset)
+	}
+
+	if amount > 0 {
+		if available := u.crossAvailableMargin(configs); amount > available {
+			return fmt.Errorf("insufficient margin: available %f, requested %f", available, amount)
+		}
+	} else {
+		remaining := position.IsolatedMargin + amount + math.Min(position.UnrealizedPNL, 0)
+		if required := position.InitialMargin(configs[asset]); remaining < required {
+			return fmt.Errorf("can't remove %f margin: position needs %f", -amount, required)
+		}
+	}
+
+	position.IsolatedMargin += amount
+	u.Balance[SettlementAsset] -= amount
+	u.UpdateEquity()
+
+	return nil
+}
+
+// allocateIsolatedMargin moves the margin needed to open notional at leverage
+// from the settlement balance to the isolated position.
+func (u *User) allocateIsolatedMargin(position *Position, notional, leverage float64) {
+	if leverage <= 0 {
+		leverage = 1
+	}
+
+	amount := notional / leverage
+	position.IsolatedMargin += amount
+	u.Balance[SettlementAsset] -= amount
+}
+
+// releaseIsolatedMargin moves share of the isolated position's margin back
+// to the settlement balance. A margin losses used up has nothing to give.
+func (u *User) releaseIsolatedMargin(position *Position, share float64) {
+	if position.IsolatedMargin <= 0 {
+		return
+	}
+
+	amount := position.IsolatedMargin * share
+	position.IsolatedMargin -= amount
+	u.Balance[SettlementAsset] += amount
+}
+
+// closeIsolatedMargin empties the margin of a closed isolated position:
+// what is left goes back to the settlement balance, a loss the margin
+// couldn't cover to the isolated deficit.
+func (u *User) closeIsolatedMargin(position *Position) {
+	if position.IsolatedMargin < 0 {
+		u.IsolatedDeficit -= position.IsolatedMargin
+		position.IsolatedMargin = 0
+		return
+	}
+	u.releaseIsolatedMargin(position, 1)
+}
+
+// TakeIsolatedDeficit returns the isolated deficit and clears it.
+func (u *User) TakeIsolatedDeficit() float64 {
+	deficit := u.IsolatedDeficit
+	u.IsolatedDeficit = 0
+	return deficit
+}
+
+// isolatedEquity returns what is left of the margin of an isolated position
+// at its mark price.
+func (p *Position) isolatedEquity() float64 {
+	return p.IsolatedMargin + p.UnrealizedPNL
+}
+
+// crossEquity returns the equity backing the user's cross positions: the
+// settlement balance and collateral plus their unrealized PnL.
+func (u *User) crossEquity() float64 {
+	equity := u.Balance[SettlementAsset] + u.CollateralValue()
+	for _, position := range u.Positions {
+		if position.MarginMode != MarginIsolated {
+			equity += position.UnrealizedPNL
+		}
+	}
+	return equity
+}
+
+// crossAvailableMargin returns the cross equity not tied up as initial
+// margin of cross positions.
+func (u *User) crossAvailableMargin(configs map[string]*MarketConfig) float64 {
+	available := u.crossEquity()
+	for asset, position := range u.Positions {
+		if position.MarginMode != MarginIsolated {
+			available -= position.InitialMargin(configs[asset])
+		}
+	}
+	return available
+}
@@ -0,0 +1,76 @@
+package margin
+
+import (
+	"fmt"
+	"math"
+)
+
+// Limits caps what a single user can hold on top of the market's risk
+// tiers. Zero means no limit.
+type Limits struct {
+	MaxPositionNotional float64
+	MaxOpenOrders       int
+}
+
+// pendingSize returns the size of the user's open orders in asset on one
+// side.
+func (u *User) pendingSize(asset string, bid bool) float64 {
+	pending := 0.0
+	for _, reservation := range u.reservations {
+		if reservation.Asset == asset && reservation.Bid == bid {
+			pending += reservation.Size
+		}
+	}
+	return pending
+}
+
+// CheckOpenOrders verifies that the user can have one more open order.
+func (u *User) CheckOpenOrders() error {
+	if limit := u.Limits.MaxOpenOrders; limit > 0 && len(u.reservations) >= limit {
+		return fmt.Errorf("open order limit of %d reached", limit)
+	}
+	return nil
+}
+
+// OrderTier returns the notional of the position the user would have if the
+// order and all open orders on the same side filled, and the risk tier it
+// falls in. ok is false when it is above the last tier.
+func (u *User) OrderTier(asset string, bid bool, size, price float64, config *MarketConfig) (RiskTier, float64, bool) {
+	// orders on the other side may be cancelled, so they don't offset the
+	// ones on this side
+	delta := size + u.pendingSize(asset, bid)
+	if !bid {
+		delta = -delta
+	}
+
+	position := u.Position(asset)
+	notional := math.Abs(position.signedSize()+delta) * price
+
+	tier, ok := config.Tier(notional)
+	return tier, notional, ok
+}
+
+// CheckOrder verifies that an order of size at price fits the user's limits
+// and the market's risk tiers. The notional of OrderTier decides the tier
+// the leverage has to fit.
+func (u *User) CheckOrder(asset string, bid bool, size, price, leverage float64, config *MarketConfig) error {
+	if config == nil {
+		return fmt.Errorf("no market config for %s", asset)
+	}
+	if err := u.CheckOpenOrders(); err != nil {
+		return err
+	}
+
+	tier, notional, ok := u.OrderTier(asset, bid, size, price, config)
+	if !ok {
+		return fmt.Errorf("position notional %f above the market risk limit %f", notional, tier.MaxNotional)
+	}
+	if limit := u.Limits.MaxPositionNotional; limit > 0 && notional > limit {
+		return fmt.Errorf("position notional %f above the user limit %f", notional, limit)
+	}
+	if leverage > tier.MaximumLeverage {
+		return fmt.Errorf("leverage %.2f above the maximum %.2f for a position of %f", leverage, tier.MaximumLeverage, notional)
+	}
+
+	return nil
+}
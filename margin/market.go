@@ -1,5 +1,15 @@
 package margin
 
+import (
+	"math"
+	"time"
+)
+
+const (
+	ContractPerpetual = "PERPETUAL"
+	ContractDated     = "DATED"
+)
+
 type MarketConfig struct {
 	InitialMarginRequirement float64
 	MaximumLeverage          float64
@@ -7,4 +17,55 @@ type MarketConfig struct {
 	TickSize                 float64
 	MinOrder                 float64
 	QuantityStep             float64
+
+	// ContractType is ContractPerpetual or ContractDated, empty means
+	// perpetual. Dated contracts settle at Expiry.
+	ContractType string
+	Expiry       time.Time
+
+	// RiskTiers, sorted by MaxNotional, replace MaximumLeverage and
+	// MaintenanceMargin when set. Positions above the last tier aren't
+	// allowed.
+	RiskTiers []RiskTier
+}
+
+// RiskTier caps the leverage and sets the maintenance margin of positions
+// with a notional up to MaxNotional. Larger positions fall into higher tiers
+// with less leverage and more maintenance margin.
+type RiskTier struct {
+	MaxNotional       float64
+	MaximumLeverage   float64
+	MaintenanceMargin float64
+}
+
+// IsDated reports whether the market expires.
+func (c *MarketConfig) IsDated() bool {
+	return c.ContractType == ContractDated
+}
+
+// Tier returns the risk tier a position of notional falls in. Markets
+// without tiers have a single unbounded one. ok is false when notional is
+// above the last tier, the tier returned is then the last one.
+func (c *MarketConfig) Tier(notional float64) (RiskTier, bool) {
+	if len(c.RiskTiers) == 0 {
+		return RiskTier{
+			MaxNotional:       math.Inf(1),
+			MaximumLeverage:   c.MaximumLeverage,
+			MaintenanceMargin: c.MaintenanceMargin,
+		}, true
+	}
+
+	for _, tier := range c.RiskTiers {
+		if notional <= tier.MaxNotional {
+			return tier, true
+		}
+	}
+	return c.RiskTiers[len(c.RiskTiers)-1], false
+}
+
+// MaintenanceRate returns the maintenance margin rate of a position of
+// notional.
+func (c *MarketConfig) MaintenanceRate(notional float64) float64 {
+	tier, _ := c.Tier(notional)
+	return tier.MaintenanceMargin
 }
@@ -0,0 +1,84 @@
+package margin
+
+import (
+	"fmt"
+	"math"
+)
+
+// orderReservation is the initial margin held back for the unfilled size of
+// an open order.
+type orderReservation struct {
+	Asset  string
+	Bid    bool
+	Size   float64
+	Amount float64
+}
+
+// OrderMargin returns the initial margin an order of size at price needs,
+// which is the largest of the market's initial margin requirement, 1 over
+// the maximum leverage of the risk tier it falls in and 1/leverage of its
+// notional.
+func OrderMargin(config *MarketConfig, tier RiskTier, size, price, leverage float64) float64 {
+	requirement := 0.0
+	if config != nil {
+		requirement = config.InitialMarginRequirement
+	}
+	if tier.MaximumLeverage > 0 {
+		requirement = math.Max(requirement, 1/tier.MaximumLeverage)
+	}
+	if leverage > 0 {
+		requirement = math.Max(requirement, 1/leverage)
+	}
+
+	return size * price * requirement
+}
+
+// ReservedMargin returns the margin held back for all open orders.
+func (u *User) ReservedMargin() float64 {
+	reserved := 0.0
+	for _, reservation := range u.reservations {
+		reserved += reservation.Amount
+	}
+	return reserved
+}
+
+// AvailableMargin returns the cross equity that is neither initial margin of
+// a cross position nor reserved for an open order.
+func (u *User) AvailableMargin(configs map[string]*MarketConfig) float64 {
+	u.UpdateEquity()
+	return u.crossAvailableMargin(configs) - u.ReservedMargin()
+}
+
+// ReserveOrderMargin holds back amount of margin for the open order, failing
+// if the user doesn't have that much available. Orders that reserve nothing
+// always fit.
+func (u *User) ReserveOrderMargin(orderID int64, asset string, bid bool, size, amount float64, configs map[string]*MarketConfig) error {
+	if available := u.AvailableMargin(configs); amount > 0 && amount > available {
+		return fmt.Errorf("insufficient margin: available %f, order needs %f", available, amount)
+	}
+
+	u.reservations[orderID] = &orderReservation{
+		Asset:  asset,
+		Bid:    bid,
+		Size:   size,
+		Amount: amount,
+	}
+	return nil
+}
+
+// ReleaseOrderMargin frees the margin reserved for size of the order, either
+// because it filled and became position margin or because it was cancelled.
+func (u *User) ReleaseOrderMargin(orderID int64, size float64) {
+	reservation, ok := u.reservations[orderID]
+	if !ok {
+		return
+	}
+
+	if size >= reservation.Size-sizeEpsilon {
+		delete(u.reservations, orderID)
+		return
+	}
+
+	reservation.Amount -= reservation.Amount * size / reservation.Size
+	reservation.Size = math.Max(reservation.Size-size, 0)
+}
@@ -2,68 +2,220 @@ package margin
 
 import (
 	"fmt"
+	"math"
 
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	SideLong  = "LONG"
+	SideShort = "SHORT"
+
+	// SettlementAsset is the balance realized PnL is paid out in
+	SettlementAsset = "ETH"
+
+	// sizeEpsilon absorbs float noise when a position is closed out
+	sizeEpsilon = 1e-9
+)
+
+// Position is the net position of a user in one market. Size is always
+// positive, the direction is in Side. OpenPrice is the volume weighted
+// average entry price of the open size, MarkPrice the price it was last
+// valued at. IsolatedMargin is the margin assigned to an isolated position,
+// it is zero for cross positions.
 type Position struct {
 	Asset            string
 	Side             string
+	MarginMode       string
+	IsolatedMargin   float64
 	Leverage         float64
 	Size             float64
 	OpenPrice        float64
+	MarkPrice        float64
 	UnrealizedPNL    float64
 	RealizedPNL      float64
 	LiquidationPrice float64
 }
 
+// signedSize returns the size of the position, negative when short.
+func (p *Position) signedSize() float64 {
+	if p.Side == SideShort {
+		return -p.Size
+	}
+	return p.Size
+}
+
 type User struct {
-	ID            int64
-	Balance       map[string]float64
-	Positions     []Position
-	UnrealizedPNL float64
-	RealizedPNL   float64
-	Fees          float64
-	Equity        float64
+	ID           int64
+	Balance      map[string]float64
+	Positions    map[string]*Position
+	MarginModes  map[string]string
+	reservations map[int64]*orderReservation
+	collateral   map[string]collateralMark
+	Limits       Limits
+	// IsolatedDeficit is the loss of closed isolated positions their margin
+	// didn't cover. It is never taken from the cross balance, the exchange
+	// settles it through TakeIsolatedDeficit.
+	IsolatedDeficit float64
+	UnrealizedPNL   float64
+	RealizedPNL     float64
+	Fees            float64
+	Equity          float64
 }
 
 func NewUser(id int64) *User {
 	return &User{
-		ID:        id,
-		Balance:   map[string]float64{"ETH": 1000},
-		Positions: []Position{},
-		Equity:    1000,
+		ID:           id,
+		Balance:      make(map[string]float64),
+		Positions:    make(map[string]*Position),
+		MarginModes:  make(map[string]string),
+		reservations: make(map[int64]*orderReservation),
+		collateral:   make(map[string]collateralMark),
+	}
+}
+
+// Clone returns a deep copy of the user that can be changed, e.g. marked to
+// hypothetical prices, without touching the user.
+func (u *User) Clone() *User {
+	c := *u
+	c.Balance = make(map[string]float64, len(u.Balance))
+	for asset, amount := range u.Balance {
+		c.Balance[asset] = amount
+	}
+	c.Positions = make(map[string]*Position, len(u.Positions))
+	for asset, position := range u.Positions {
+		p := *position
+		c.Positions[asset] = &p
+	}
+	c.MarginModes = make(map[string]string, len(u.MarginModes))
+	for asset, mode := range u.MarginModes {
+		c.MarginModes[asset] = mode
 	}
+	c.reservations = make(map[int64]*orderReservation, len(u.reservations))
+	for id, reservation := range u.reservations {
+		r := *reservation
+		c.reservations[id] = &r
+	}
+	c.collateral = make(map[string]collateralMark, len(u.collateral))
+	for asset, mark := range u.collateral {
+		c.collateral[asset] = mark
+	}
+	return &c
 }
 
-func (u *User) HandleTrade(asset string, size float64, leverage float64, isBuyer bool) {
-	// Update user's positions based on the trade
-	position := Position{
-		Asset: asset,
-		Size:  size * leverage, // The position size is multiplied by the leverage
+// Position returns a copy of the user's position in the market. The zero
+// Position (with Asset set) means the user is flat.
+func (u *User) Position(asset string) Position {
+	if position, ok := u.Positions[asset]; ok {
+		return *position
 	}
+	return Position{Asset: asset}
+}
 
-	u.Positions = append(u.Positions, position)
+// HandleTrade nets a fill of size contracts at price into the user's position
+// in the market. Adding to a position moves its average entry price, reducing
+// it realizes PnL against that entry price into the settlement balance, and a
+// trade larger than the position flips it to the other side at price.
+// Isolated positions take the initial margin of what they open out of the
+// settlement balance and give it back in proportion to what they close.
+// Their realized losses come out of their own margin, a loss beyond it
+// becomes the user's IsolatedDeficit once the position is closed.
+// It returns the PnL realized by the trade.
+func (u *User) HandleTrade(asset string, size float64, price float64, leverage float64, isBuyer bool) float64 {
+	position, ok := u.Positions[asset]
+	if !ok {
+		position = &Position{Asset: asset, MarginMode: u.MarginMode(asset)}
+		u.Positions[asset] = position
+	}
+	isolated := position.MarginMode == MarginIsolated
 
-	// If user is a buyer, the cost of the trade is deducted from user's balance
-	// If user is a seller, the revenue from the trade is added to user's balance
-	if isBuyer {
-		// For a buyer, the cost of the trade is size
-		u.Balance[asset] -= size
-	} else {
-		// For a seller, the revenue from the trade is size
-		u.Balance[asset] += size
+	current := position.signedSize()
+	delta := size
+	if !isBuyer {
+		delta = -size
 	}
 
+	realized := 0.0
+	next := current + delta
+
+	switch {
+	case current == 0 || (current > 0) == (delta > 0):
+		// opening or adding, the entry price becomes the weighted average
+		position.OpenPrice = (math.Abs(current)*position.OpenPrice + size*price) / (math.Abs(current) + size)
+		position.Leverage = leverage
+		if isolated {
+			u.allocateIsolatedMargin(position, size*price, leverage)
+		}
+	default:
+		// reducing, closing or flipping
+		closed := math.Min(math.Abs(current), size)
+		if current > 0 {
+			realized = closed * (price - position.OpenPrice)
+		} else {
+			realized = closed * (position.OpenPrice - price)
+		}
+
+		if isolated {
+			if realized < 0 {
+				position.IsolatedMargin += realized
+			}
+			u.releaseIsolatedMargin(position, closed/math.Abs(current))
+			if closed >= math.Abs(current)-sizeEpsilon {
+				u.closeIsolatedMargin(position)
+			}
+		}
+
+		if size > math.Abs(current)+sizeEpsilon {
+			// flipped, the remainder is a new position opened at price
+			position.OpenPrice = price
+			position.Leverage = leverage
+			if isolated {
+				u.allocateIsolatedMargin(position, (size-math.Abs(current))*price, leverage)
+			}
+		}
+	}
+
+	position.RealizedPNL += realized
+	u.RealizedPNL += realized
+	if !isolated || realized > 0 {
+		u.Balance[SettlementAsset] += realized
+	}
+
+	switch {
+	case math.Abs(next) <= sizeEpsilon:
+		delete(u.Positions, asset)
+		u.closeIsolatedMargin(position)
+		position.Size = 0
+		position.Side = ""
+	case next > 0:
+		position.Size = next
+		position.Side = SideLong
+	default:
+		position.Size = -next
+		position.Side = SideShort
+	}
+
+	if position.MarkPrice == 0 {
+		position.MarkPrice = price
+	}
+	position.revalue()
+	u.UpdateEquity()
+
 	// Log the updated user state
 	logrus.WithFields(logrus.Fields{
 		"userID":       u.ID,
 		"asset":        asset,
-		"balance":      u.Balance[asset],
+		"balance":      u.Balance[SettlementAsset],
 		"leverage":     leverage,
 		"tradeSize":    size,
+		"tradePrice":   price,
+		"side":         position.Side,
 		"positionSize": position.Size,
+		"openPrice":    position.OpenPrice,
+		"realizedPNL":  realized,
 	}).Info("updated user state after trade")
+
+	return realized
 }
 
 func (u *User) CalculatePotentialLeverage(size float64, price float64, marketConfig *MarketConfig) error {
@@ -76,6 +228,19 @@ func (u *User) CalculatePotentialLeverage(size float64, price float64, marketCon
 	return nil
 }
 
+// UpdateEquity sums the unrealized PnL of all positions and returns the
+// settlement balance plus the haircut value of the other collateral plus the
+// margin of isolated positions plus that PnL. Realized PnL and fees are
+// already booked into the balance or the isolated margin.
 func (u *User) UpdateEquity() float64 {
-	return u.Balance["ETH"] + u.UnrealizedPNL + u.RealizedPNL - u.Fees
+	unrealized, isolated := 0.0, 0.0
+	for _, position := range u.Positions {
+		unrealized += position.UnrealizedPNL
+		isolated += position.IsolatedMargin
+	}
+
+	u.UnrealizedPNL = unrealized
+	u.Equity = u.Balance[SettlementAsset] + u.CollateralValue() + isolated + unrealized
+
+	return u.Equity
 }
@@ -0,0 +1,538 @@
+package margin
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func assert(t *testing.T, a, b any) {
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+// newFundedUser returns a user with 1000 in the settlement asset, users
+// start out empty.
+func newFundedUser(id int64) *User {
+	u := NewUser(id)
+	u.Balance[SettlementAsset] = 1000
+	u.UpdateEquity()
+	return u
+}
+
+func TestNewUserStartsEmpty(t *testing.T) {
+	u := NewUser(0)
+	assert(t, u.Balance, map[string]float64{})
+	assert(t, u.UpdateEquity(), 0.0)
+}
+
+func TestHandleTradeNetsToFlat(t *testing.T) {
+	u := newFundedUser(0)
+
+	u.HandleTrade("ETH", 10, 100, 1, true)
+	u.HandleTrade("ETH", 10, 100, 1, false)
+
+	assert(t, len(u.Positions), 0)
+	assert(t, u.Position("ETH"), Position{Asset: "ETH"})
+	assert(t, u.Balance[SettlementAsset], 1000.0)
+}
+
+func TestHandleTradeAverageEntryPrice(t *testing.T) {
+	u := newFundedUser(0)
+
+	u.HandleTrade("ETH", 10, 100, 5, true)
+	u.HandleTrade("ETH", 30, 120, 5, true)
+
+	position := u.Position("ETH")
+	assert(t, position.Side, SideLong)
+	assert(t, position.Size, 40.0)
+	assert(t, position.OpenPrice, 115.0)
+	assert(t, position.Leverage, 5.0)
+}
+
+func TestHandleTradeRealizesOnReduce(t *testing.T) {
+	u := newFundedUser(0)
+
+	u.HandleTrade("ETH", 10, 100, 1, false)
+	realized := u.HandleTrade("ETH", 4, 90, 1, true)
+
+	assert(t, realized, 40.0)
+	position := u.Position("ETH")
+	assert(t, position.Side, SideShort)
+	assert(t, position.Size, 6.0)
+	assert(t, position.OpenPrice, 100.0)
+	assert(t, position.RealizedPNL, 40.0)
+	assert(t, u.RealizedPNL, 40.0)
+	assert(t, u.Balance[SettlementAsset], 1040.0)
+}
+
+func TestHandleTradeFlipsLongToShort(t *testing.T) {
+	u := newFundedUser(0)
+
+	u.HandleTrade("ETH", 5, 100, 1, true)
+	realized := u.HandleTrade("ETH", 8, 110, 2, false)
+
+	assert(t, realized, 50.0)
+	position := u.Position("ETH")
+	assert(t, position.Side, SideShort)
+	assert(t, position.Size, 3.0)
+	assert(t, position.OpenPrice, 110.0)
+	assert(t, position.Leverage, 2.0)
+
+	// closing the flipped short realizes against the new entry price
+	realized = u.HandleTrade("ETH", 3, 120, 2, true)
+	assert(t, realized, -30.0)
+	assert(t, len(u.Positions), 0)
+	assert(t, u.Balance[SettlementAsset], 1020.0)
+}
+
+func TestHandleTradeKeepsMarketsApart(t *testing.T) {
+	u := newFundedUser(0)
+
+	u.HandleTrade("ETH", 1, 100, 1, true)
+	u.HandleTrade("BTC", 2, 200, 1, false)
+
+	assert(t, len(u.Positions), 2)
+	assert(t, u.Position("ETH").Side, SideLong)
+	assert(t, u.Position("BTC").Side, SideShort)
+}
+
+func TestMarkToMarket(t *testing.T) {
+	u := newFundedUser(0)
+
+	u.HandleTrade("ETH", 10, 100, 5, true)
+	u.HandleTrade("BTC", 1, 200, 5, false)
+	assert(t, u.UnrealizedPNL, 0.0)
+
+	u.MarkToMarket("ETH", 110)
+	u.MarkToMarket("BTC", 150)
+
+	assert(t, u.Position("ETH").UnrealizedPNL, 100.0)
+	assert(t, u.Position("BTC").UnrealizedPNL, 50.0)
+	assert(t, u.UnrealizedPNL, 150.0)
+	assert(t, u.Equity, 1150.0)
+}
+
+func TestAccount(t *testing.T) {
+	u := newFundedUser(0)
+	configs := map[string]*MarketConfig{
+		"ETH": {InitialMarginRequirement: 0.1, MaximumLeverage: 10},
+	}
+
+	u.HandleTrade("ETH", 10, 100, 5, true)
+	u.MarkToMarket("ETH", 90)
+
+	account := u.Account(configs)
+	assert(t, account.Equity, 900.0)
+	assert(t, account.Notional, 900.0)
+	// 5x leverage ties up 20%, more than the 10% requirement
+	assert(t, account.MarginUsed, 180.0)
+	assert(t, account.AvailableMargin, 720.0)
+	assert(t, account.MarginRatio, 1.0)
+	assert(t, len(account.Positions), 1)
+}
+
+func TestLiquidationPrice(t *testing.T) {
+	configs := map[string]*MarketConfig{
+		"ETH": {InitialMarginRequirement: 0.1, MaximumLeverage: 10, MaintenanceMargin: 0.05},
+	}
+
+	long := newFundedUser(0)
+	long.Balance[SettlementAsset] = 100
+	long.HandleTrade("ETH", 10, 100, 10, true)
+	long.UpdateLiquidationPrices(configs)
+
+	// 100 + 10*(P-100) = 0.05*10*P
+	liq := long.Position("ETH").LiquidationPrice
+	if math.Abs(liq-900.0/9.5) > 1e-9 {
+		t.Errorf("long liquidation price %v", liq)
+	}
+
+	long.MarkToMarket("ETH", liq+0.01)
+	assert(t, long.IsLiquidatable(configs), false)
+	long.MarkToMarket("ETH", liq-0.01)
+	assert(t, long.IsLiquidatable(configs), true)
+
+	short := newFundedUser(1)
+	short.Balance[SettlementAsset] = 100
+	short.HandleTrade("ETH", 10, 100, 10, false)
+	short.UpdateLiquidationPrices(configs)
+
+	// 100 - 10*(P-100) = 0.05*10*P
+	liq = short.Position("ETH").LiquidationPrice
+	if math.Abs(liq-1100.0/10.5) > 1e-9 {
+		t.Errorf("short liquidation price %v", liq)
+	}
+}
+
+func TestBankruptcyPrice(t *testing.T) {
+	long := newFundedUser(0)
+	long.Balance[SettlementAsset] = 100
+	long.HandleTrade("ETH", 10, 100, 10, true)
+	assert(t, long.BankruptcyPrice("ETH"), 90.0)
+
+	short := newFundedUser(1)
+	short.Balance[SettlementAsset] = 100
+	short.HandleTrade("ETH", 10, 100, 10, false)
+	short.MarkToMarket("ETH", 105)
+	assert(t, short.BankruptcyPrice("ETH"), 110.0)
+
+	assert(t, short.BankruptcyPrice("BTC"), 0.0)
+}
+
+func TestApplyFunding(t *testing.T) {
+	long := newFundedUser(0)
+	short := newFundedUser(1)
+	flat := newFundedUser(2)
+
+	long.HandleTrade("ETH", 10, 100, 1, true)
+	short.HandleTrade("ETH", 10, 100, 1, false)
+
+	assert(t, long.ApplyFunding("ETH", 0.001, 200), 2.0)
+	assert(t, short.ApplyFunding("ETH", 0.001, 200), -2.0)
+	assert(t, flat.ApplyFunding("ETH", 0.001, 200), 0.0)
+
+	assert(t, long.Balance[SettlementAsset], 998.0)
+	assert(t, short.Balance[SettlementAsset], 1002.0)
+	assert(t, long.Equity, 998.0)
+}
+
+func TestIsolatedMargin(t *testing.T) {
+	u := newFundedUser(0)
+	assert(t, u.SetMarginMode("ETH", MarginIsolated), nil)
+
+	u.HandleTrade("ETH", 10, 100, 10, true)
+	position := u.Position("ETH")
+	assert(t, position.MarginMode, MarginIsolated)
+	assert(t, position.IsolatedMargin, 100.0)
+	assert(t, u.Balance[SettlementAsset], 900.0)
+	assert(t, u.UpdateEquity(), 1000.0)
+
+	// closing half gives back half of the margin next to the PnL
+	u.HandleTrade("ETH", 5, 110, 10, false)
+	assert(t, u.Position("ETH").IsolatedMargin, 50.0)
+	assert(t, u.Balance[SettlementAsset], 1000.0)
+
+	u.HandleTrade("ETH", 5, 110, 10, false)
+	assert(t, len(u.Positions), 0)
+	assert(t, u.Balance[SettlementAsset], 1100.0)
+}
+
+func TestIsolatedLossStaysIsolated(t *testing.T) {
+	u := newFundedUser(0)
+	assert(t, u.SetMarginMode("ETH", MarginIsolated), nil)
+
+	u.HandleTrade("ETH", 10, 100, 10, true)
+	assert(t, u.Balance[SettlementAsset], 900.0)
+
+	// half closes 60 below entry, the loss comes out of the position's
+	// margin and what is left of it is released in proportion
+	assert(t, u.HandleTrade("ETH", 5, 88, 10, false), -60.0)
+	assert(t, u.Position("ETH").IsolatedMargin, 20.0)
+	assert(t, u.Balance[SettlementAsset], 920.0)
+
+	// the rest closes 75 below its entry with 20 of margin left, the cross
+	// balance doesn't pay for the difference
+	assert(t, u.HandleTrade("ETH", 5, 85, 10, false), -75.0)
+	assert(t, len(u.Positions), 0)
+	assert(t, u.Balance[SettlementAsset], 920.0)
+	assert(t, u.IsolatedDeficit, 55.0)
+
+	assert(t, u.TakeIsolatedDeficit(), 55.0)
+	assert(t, u.IsolatedDeficit, 0.0)
+}
+
+func TestIsolatedLiquidationPrice(t *testing.T) {
+	configs := map[string]*MarketConfig{
+		"ETH": {InitialMarginRequirement: 0.1, MaximumLeverage: 10, MaintenanceMargin: 0.05},
+	}
+
+	u := newFundedUser(0)
+	u.SetMarginMode("ETH", MarginIsolated)
+	u.HandleTrade("ETH", 10, 100, 10, true)
+	u.UpdateLiquidationPrices(configs)
+
+	// only the 100 of isolated margin backs the position, not the balance
+	liq := u.Position("ETH").LiquidationPrice
+	if math.Abs(liq-900.0/9.5) > 1e-9 {
+		t.Errorf("isolated liquidation price %v", liq)
+	}
+	assert(t, u.BankruptcyPrice("ETH"), 90.0)
+
+	u.MarkToMarket("ETH", liq-0.01)
+	assert(t, u.LiquidatablePositions(configs), []string{"ETH"})
+
+	// a cross position next to it is not affected
+	u.HandleTrade("BTC", 1, 100, 1, true)
+	assert(t, u.LiquidatablePositions(configs), []string{"ETH"})
+}
+
+func TestSetMarginMode(t *testing.T) {
+	u := newFundedUser(0)
+	assert(t, u.MarginMode("ETH"), MarginCross)
+
+	u.HandleTrade("ETH", 1, 100, 1, true)
+	if err := u.SetMarginMode("ETH", MarginIsolated); err == nil {
+		t.Error("changed margin mode with an open position")
+	}
+	if err := u.SetMarginMode("BTC", "PORTFOLIO"); err == nil {
+		t.Error("accepted an invalid margin mode")
+	}
+}
+
+func TestAdjustIsolatedMargin(t *testing.T) {
+	configs := map[string]*MarketConfig{
+		"ETH": {InitialMarginRequirement: 0.1, MaximumLeverage: 10, MaintenanceMargin: 0.05},
+	}
+
+	u := newFundedUser(0)
+	if err := u.AdjustIsolatedMargin("ETH", 10, configs); err == nil {
+		t.Error("adjusted margin without a position")
+	}
+
+	u.SetMarginMode("ETH", MarginIsolated)
+	u.HandleTrade("ETH", 10, 100, 10, true)
+
+	assert(t, u.AdjustIsolatedMargin("ETH", 50, configs), nil)
+	assert(t, u.Position("ETH").IsolatedMargin, 150.0)
+	assert(t, u.Balance[SettlementAsset], 850.0)
+
+	if err := u.AdjustIsolatedMargin("ETH", -100, configs); err == nil {
+		t.Error("removed margin below the initial margin")
+	}
+	if err := u.AdjustIsolatedMargin("ETH", 1000, configs); err == nil {
+		t.Error("added more margin than available")
+	}
+
+	assert(t, u.AdjustIsolatedMargin("ETH", -50, configs), nil)
+	assert(t, u.Position("ETH").IsolatedMargin, 100.0)
+	assert(t, u.Balance[SettlementAsset], 900.0)
+}
+
+func TestOrderMarginReservation(t *testing.T) {
+	configs := map[string]*MarketConfig{
+		"ETH": {InitialMarginRequirement: 0.1, MaximumLeverage: 10},
+	}
+
+	u := newFundedUser(0)
+	tier, _ := configs["ETH"].Tier(1000)
+	assert(t, OrderMargin(configs["ETH"], tier, 10, 100, 10), 100.0)
+	assert(t, OrderMargin(configs["ETH"], tier, 10, 100, 2), 500.0)
+
+	assert(t, u.ReserveOrderMargin(1, "ETH", true, 10, 600, configs), nil)
+	assert(t, u.AvailableMargin(configs), 400.0)
+
+	// the second order doesn't fit next to the first one
+	if err := u.ReserveOrderMargin(2, "ETH", true, 10, 500, configs); err == nil {
+		t.Error("reserved more margin than available")
+	}
+
+	// a partial fill frees its share of the reservation
+	u.ReleaseOrderMargin(1, 4)
+	assert(t, u.ReservedMargin(), 360.0)
+
+	u.ReleaseOrderMargin(1, 6)
+	assert(t, u.ReservedMargin(), 0.0)
+	assert(t, u.Account(configs).AvailableMargin, 1000.0)
+}
+
+func TestOrderMarginFollowsTier(t *testing.T) {
+	config := &MarketConfig{
+		InitialMarginRequirement: 0.1,
+		RiskTiers: []RiskTier{
+			{MaxNotional: 10000, MaximumLeverage: 10, MaintenanceMargin: 0.05},
+			{MaxNotional: 50000, MaximumLeverage: 5, MaintenanceMargin: 0.1},
+			{MaxNotional: 200000, MaximumLeverage: 2, MaintenanceMargin: 0.25},
+		},
+	}
+
+	// without a leverage an order in the 2x tier still needs half its
+	// notional, not the flat requirement
+	u := newFundedUser(0)
+	tier, notional, ok := u.OrderTier("ETH", true, 600, 100, config)
+	assert(t, ok, true)
+	assert(t, notional, 60000.0)
+	assert(t, tier.MaximumLeverage, 2.0)
+	assert(t, OrderMargin(config, tier, 600, 100, 0), 30000.0)
+	assert(t, OrderMargin(config, tier, 600, 100, 10), 30000.0)
+	assert(t, OrderMargin(config, tier, 600, 100, 1), 60000.0)
+
+	// a position priced the same way
+	u.HandleTrade("ETH", 600, 100, 0, true)
+	u.MarkToMarket("ETH", 100)
+	position := u.Position("ETH")
+	assert(t, position.InitialMargin(config), 30000.0)
+}
+
+func TestCollateralCountsTowardsEquity(t *testing.T) {
+	u := newFundedUser(0)
+	u.Balance["USDC"] = 1000
+	u.Balance["PUNK"] = 2
+
+	// unpriced collateral doesn't count
+	assert(t, u.UpdateEquity(), 1000.0)
+
+	u.MarkCollateral("USDC", 0.5, &CollateralConfig{Haircut: 0.1})
+	u.MarkCollateral("PUNK", 100, &CollateralConfig{Haircut: 0.5})
+	assert(t, u.CollateralValue(), 550.0)
+	assert(t, u.UpdateEquity(), 1550.0)
+
+	configs := map[string]*MarketConfig{
+		"ETH": {InitialMarginRequirement: 0.1, MaximumLeverage: 10},
+	}
+	account := u.Account(configs)
+	assert(t, account.CollateralValue, 550.0)
+	assert(t, account.AvailableMargin, 1550.0)
+	assert(t, account.Collateral, []CollateralBalance{
+		{Asset: "PUNK", Amount: 2, Price: 100, Haircut: 0.5, Value: 100},
+		{Asset: "USDC", Amount: 1000, Price: 0.5, Haircut: 0.1, Value: 450},
+	})
+}
+
+func TestWithdrawableCollateral(t *testing.T) {
+	configs := map[string]*MarketConfig{
+		"ETH": {InitialMarginRequirement: 0.1, MaximumLeverage: 10},
+	}
+
+	u := NewUser(0)
+	u.Balance[SettlementAsset] = 100
+	u.Balance["USDC"] = 1000
+	u.MarkCollateral("USDC", 0.5, &CollateralConfig{Haircut: 0.2})
+
+	// 500 of margin is tied up, 100 + 400 of collateral backs it
+	u.HandleTrade("ETH", 10, 100, 2, true)
+	assert(t, u.AvailableMargin(configs), 0.0)
+	assert(t, u.Withdrawable("USDC", configs), 0.0)
+
+	u.HandleTrade("ETH", 2, 100, 2, false)
+	assert(t, u.AvailableMargin(configs), 100.0)
+	assert(t, u.Withdrawable("USDC", configs), 250.0)
+	assert(t, u.Withdrawable(SettlementAsset, configs), 100.0)
+}
+
+func TestLiquidateCollateralSellsRiskiestFirst(t *testing.T) {
+	u := NewUser(0)
+	u.Balance[SettlementAsset] = -150
+	u.Balance["USDC"] = 1000
+	u.Balance["PUNK"] = 1
+	u.MarkCollateral("USDC", 0.5, &CollateralConfig{Haircut: 0.2})
+	u.MarkCollateral("PUNK", 200, &CollateralConfig{Haircut: 0.5})
+
+	// both sell at their haircut value, not the marked price
+	sales := u.LiquidateCollateral()
+	assert(t, sales, []CollateralSale{
+		{Asset: "PUNK", Amount: 1, Price: 200, Haircut: 0.5, Proceeds: 100},
+		{Asset: "USDC", Amount: 125, Price: 0.5, Haircut: 0.2, Proceeds: 50},
+	})
+	assert(t, u.Balance, map[string]float64{SettlementAsset: 0, "USDC": 875, "PUNK": 0})
+
+	assert(t, len(u.LiquidateCollateral()), 0)
+}
+
+func TestRiskTiers(t *testing.T) {
+	config := &MarketConfig{
+		MaximumLeverage:   20,
+		MaintenanceMargin: 0.01,
+		RiskTiers: []RiskTier{
+			{MaxNotional: 1000, MaximumLeverage: 10, MaintenanceMargin: 0.05},
+			{MaxNotional: 5000, MaximumLeverage: 5, MaintenanceMargin: 0.1},
+		},
+	}
+
+	tier, ok := config.Tier(1000)
+	assert(t, ok, true)
+	assert(t, tier.MaximumLeverage, 10.0)
+	assert(t, config.MaintenanceRate(2000), 0.1)
+
+	_, ok = config.Tier(5001)
+	assert(t, ok, false)
+
+	// without tiers the flat values apply to any size
+	flat := &MarketConfig{MaximumLeverage: 20, MaintenanceMargin: 0.01}
+	tier, ok = flat.Tier(1e12)
+	assert(t, ok, true)
+	assert(t, tier.MaximumLeverage, 20.0)
+
+	u := newFundedUser(0)
+	u.HandleTrade("ETH", 20, 100, 5, true)
+	position := u.Position("ETH")
+	assert(t, position.MaintenanceMargin(config), 200.0)
+	assert(t, u.MaintenanceRequirement(map[string]*MarketConfig{"ETH": config}), 200.0)
+}
+
+func TestCheckOrder(t *testing.T) {
+	config := &MarketConfig{
+		RiskTiers: []RiskTier{
+			{MaxNotional: 1000, MaximumLeverage: 10, MaintenanceMargin: 0.05},
+			{MaxNotional: 5000, MaximumLeverage: 5, MaintenanceMargin: 0.1},
+		},
+	}
+	configs := map[string]*MarketConfig{"ETH": config}
+
+	u := newFundedUser(0)
+	assert(t, u.CheckOrder("ETH", true, 10, 100, 10, config), nil)
+	if err := u.CheckOrder("ETH", true, 20, 100, 10, config); err == nil {
+		t.Error("allowed 10x leverage in the second tier")
+	}
+	assert(t, u.CheckOrder("ETH", true, 20, 100, 5, config), nil)
+	if err := u.CheckOrder("ETH", true, 60, 100, 1, config); err == nil {
+		t.Error("allowed a position above the last tier")
+	}
+
+	// open orders on the same side count towards the position, the other
+	// side doesn't
+	u.ReserveOrderMargin(1, "ETH", true, 40, 0, configs)
+	if err := u.CheckOrder("ETH", true, 20, 100, 1, config); err == nil {
+		t.Error("ignored open orders on the same side")
+	}
+	assert(t, u.CheckOrder("ETH", false, 20, 100, 5, config), nil)
+
+	u.Limits = Limits{MaxPositionNotional: 3000, MaxOpenOrders: 1}
+	if err := u.CheckOrder("ETH", false, 1, 100, 1, config); err == nil {
+		t.Error("allowed more open orders than the limit")
+	}
+	u.ReleaseOrderMargin(1, 40)
+	if err := u.CheckOrder("ETH", false, 40, 100, 1, config); err == nil {
+		t.Error("allowed a position above the user limit")
+	}
+	assert(t, u.CheckOrder("ETH", false, 30, 100, 1, config), nil)
+}
+
+func TestCheckOrderOnlyCountsItsOwnSide(t *testing.T) {
+	config := &MarketConfig{
+		RiskTiers: []RiskTier{
+			{MaxNotional: 5000, MaximumLeverage: 10, MaintenanceMargin: 0.05},
+			{MaxNotional: 10000, MaximumLeverage: 2, MaintenanceMargin: 0.1},
+		},
+	}
+	configs := map[string]*MarketConfig{"ETH": config}
+
+	u := newFundedUser(0)
+	u.ReserveOrderMargin(1, "ETH", true, 40, 0, configs)
+	u.ReserveOrderMargin(2, "ETH", false, 40, 0, configs)
+
+	// a bid of 40 is checked as a long of 80 whatever rests on the ask
+	if err := u.CheckOrder("ETH", true, 40, 100, 5, config); err == nil {
+		t.Error("netted the resting ask against the bids")
+	}
+	assert(t, u.CheckOrder("ETH", true, 40, 100, 2, config), nil)
+	if err := u.CheckOrder("ETH", false, 40, 100, 5, config); err == nil {
+		t.Error("netted the resting bid against the asks")
+	}
+}
+
+func TestCloneIsIndependent(t *testing.T) {
+	u := newFundedUser(0)
+	u.HandleTrade("ETH", 10, 100, 10, true)
+
+	c := u.Clone()
+	c.MarkToMarket("ETH", 50)
+	c.Balance[SettlementAsset] = 0
+
+	assert(t, u.Position("ETH").MarkPrice, 100.0)
+	assert(t, u.Balance[SettlementAsset], 1000.0)
+	assert(t, c.Position("ETH").UnrealizedPNL, -500.0)
+	assert(t, c.Shortfall(), 500.0)
+	assert(t, u.Shortfall(), 0.0)
+}
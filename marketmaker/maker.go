@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/fineas02/matching-engine/client"
+	"github.com/fineas02/matching-engine/server"
 	"github.com/sirupsen/logrus"
 )
 
@@ -19,6 +20,7 @@ type Config struct {
 }
 
 type MarketMaker struct {
+	book           *client.LocalBook
 	userID         int64
 	orderSize      float64
 	minSpread      float64
@@ -41,7 +43,13 @@ func NewMarketMaker(cfg Config) *MarketMaker {
 	}
 }
 
-func (mm *MarketMaker) Start() {
+func (mm *MarketMaker) Start() error {
+	book, err := mm.exchangeClient.NewLocalBook(server.MarketETH)
+	if err != nil {
+		return err
+	}
+	mm.book = book
+
 	logrus.WithFields(logrus.Fields{
 		"id":           mm.userID,
 		"orderSize":    mm.orderSize,
@@ -51,23 +59,23 @@ func (mm *MarketMaker) Start() {
 	}).Info("starting market maker")
 
 	go mm.makerLoop()
+
+	return nil
 }
 
 func (mm *MarketMaker) makerLoop() {
 	ticker := time.NewTicker(mm.makeInterval)
+	defer mm.book.Close()
 
-	for {
-		bestBid, err := mm.exchangeClient.GetBestBid()
-		if err != nil {
-			logrus.Error(err)
-			break
+	// the ticker is waited on after every iteration, continue included
+	for ; ; <-ticker.C {
+		if !mm.book.Synced() {
+			continue
 		}
 
-		bestAsk, err := mm.exchangeClient.GetBestAsk()
-		if err != nil {
-			logrus.Error(err)
-			break
-		}
+		// an empty side reads as a zero price
+		bestBid, _ := mm.book.BestBid()
+		bestAsk, _ := mm.book.BestAsk()
 
 		if bestAsk.Price == 0 && bestBid.Price == 0 {
 			if err := mm.seedMarket(); err != nil {
@@ -99,8 +107,6 @@ func (mm *MarketMaker) makerLoop() {
 			logrus.Error(err)
 			break
 		}
-
-		<-ticker.C
 	}
 }
 
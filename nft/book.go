@@ -0,0 +1,472 @@
+package nft
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Order is a listing of one token or a bid for one. A bid without a TokenID
+// is a collection bid, any token of the collection fills it unless it has
+// Traits, then only tokens with every one of them do. Every order is for a
+// single item.
+type Order struct {
+	ID         int64
+	UserID     int64
+	Collection string
+	TokenID    string            `json:",omitempty"`
+	Traits     map[string]string `json:",omitempty"`
+	Bid        bool
+	Price      float64
+	Timestamp  int64
+}
+
+var idCounter int64
+
+func NewOrder(userID int64, collection, tokenID string, bid bool, price float64) *Order {
+	return &Order{
+		ID:         atomic.AddInt64(&idCounter, 1),
+		UserID:     userID,
+		Collection: collection,
+		TokenID:    tokenID,
+		Bid:        bid,
+		Price:      price,
+		Timestamp:  time.Now().UnixNano(),
+	}
+}
+
+// Trade is a token changing hands. It settles at the price of the resting
+// order, BidTaker is set when the bid was the incoming order.
+type Trade struct {
+	Collection string
+	TokenID    string
+	Price      float64
+	BidOrderID int64
+	AskOrderID int64
+	Buyer      int64
+	Seller     int64
+	BidTaker   bool
+	Timestamp  int64
+}
+
+// Snapshot is the resting orders of a book, best first.
+type Snapshot struct {
+	Collection     string
+	Listings       []Order
+	CollectionBids []Order
+	TraitBids      []Order
+	TokenBids      []Order
+}
+
+// traitGroup holds the bids with the same trait filter, ordered like the
+// collection bids.
+type traitGroup struct {
+	key    string
+	traits map[string]string
+	bids   []*Order
+}
+
+// Book is the spot order book of an NFT collection. Listings sell a
+// specific token, bids buy either a specific token or any token of the
+// collection. An incoming listing fills against the best of the collection
+// bids and the bids for its token, an incoming bid against the cheapest
+// listing it accepts. Filled tokens change owner in the registry.
+//
+// Trait bids are grouped by their filter and the groups indexed by the
+// first of their traits. The best trait bid for a listing is found by
+// looking up the groups under each trait of the token and comparing the
+// head of those whose filter the token matches, never every bid.
+type Book struct {
+	Collection string
+
+	registry *Registry
+	metadata *Metadata
+
+	mu sync.RWMutex
+	// asks are the listings ordered by price, then time
+	asks     []*Order
+	listings map[string]*Order
+	// collectionBids and every slice of tokenBids are ordered by price
+	// descending, then time
+	collectionBids []*Order
+	tokenBids      map[string][]*Order
+	// traitBids holds the trait groups by filter key, byTrait by the key of
+	// the first trait of their filter
+	traitBids map[string]*traitGroup
+	byTrait   map[string]map[string]*traitGroup
+	Orders    map[int64]*Order
+	trades    []Trade
+}
+
+// NewBook creates the book of a collection. Trait bids need the metadata of
+// the collection, a nil metadata only takes bids without traits.
+func NewBook(collection string, registry *Registry, metadata *Metadata) *Book {
+	return &Book{
+		Collection: collection,
+		registry:   registry,
+		metadata:   metadata,
+		listings:   make(map[string]*Order),
+		tokenBids:  make(map[string][]*Order),
+		traitBids:  make(map[string]*traitGroup),
+		byTrait:    make(map[string]map[string]*traitGroup),
+		Orders:     make(map[int64]*Order),
+		trades:     []Trade{},
+	}
+}
+
+// Place fills the order against the book or rests it. It returns the trade
+// when the order filled.
+func (b *Book) Place(o *Order) (*Trade, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.check(o); err != nil {
+		return nil, err
+	}
+
+	if o.Bid {
+		return b.placeBid(o)
+	}
+	return b.placeAsk(o)
+}
+
+func (b *Book) check(o *Order) error {
+	if o.Collection != b.Collection {
+		return fmt.Errorf("order for %s placed in the %s book", o.Collection, b.Collection)
+	}
+	if o.Price <= 0 {
+		return fmt.Errorf("invalid price %f", o.Price)
+	}
+	if _, ok := b.Orders[o.ID]; ok {
+		return fmt.Errorf("order %d already placed", o.ID)
+	}
+
+	if len(o.Traits) > 0 {
+		if !o.Bid || o.TokenID != "" {
+			return fmt.Errorf("only collection bids can filter by trait")
+		}
+		if b.metadata == nil {
+			return fmt.Errorf("no metadata for %s to filter by", o.Collection)
+		}
+		for name := range o.Traits {
+			if name == "" {
+				return fmt.Errorf("trait without a name")
+			}
+		}
+	}
+
+	if o.TokenID == "" {
+		if !o.Bid {
+			return fmt.Errorf("a listing needs a token id")
+		}
+		return nil
+	}
+
+	owner, ok := b.registry.Owner(o.Collection, o.TokenID)
+	if !ok {
+		return fmt.Errorf("unknown token %s #%s", o.Collection, o.TokenID)
+	}
+	if o.Bid && owner == o.UserID {
+		return fmt.Errorf("token %s #%s is already yours", o.Collection, o.TokenID)
+	}
+	if !o.Bid {
+		if owner != o.UserID {
+			return fmt.Errorf("token %s #%s is not yours", o.Collection, o.TokenID)
+		}
+		if _, listed := b.listings[o.TokenID]; listed {
+			return fmt.Errorf("token %s #%s is already listed", o.Collection, o.TokenID)
+		}
+	}
+	return nil
+}
+
+func (b *Book) placeAsk(o *Order) (*Trade, error) {
+	if bid := b.bestBid(o.TokenID, o.UserID); bid != nil && bid.Price >= o.Price {
+		trade, err := b.settle(bid, o, bid.Price, false)
+		if err != nil {
+			return nil, err
+		}
+		b.removeBid(bid)
+		return trade, nil
+	}
+
+	b.asks = insert(b.asks, o, func(a, x *Order) bool { return a.Price < x.Price })
+	b.listings[o.TokenID] = o
+	b.Orders[o.ID] = o
+	return nil, nil
+}
+
+func (b *Book) placeBid(o *Order) (*Trade, error) {
+	for {
+		ask := b.bestAsk(o)
+		if ask == nil {
+			break
+		}
+
+		b.removeAsk(ask)
+		if owner, _ := b.registry.Owner(ask.Collection, ask.TokenID); owner != ask.UserID {
+			// the token left the seller since it was listed
+			continue
+		}
+		return b.settle(o, ask, ask.Price, true)
+	}
+
+	if len(o.Traits) > 0 {
+		b.addTraitBid(o)
+	} else if o.TokenID == "" {
+		b.collectionBids = insert(b.collectionBids, o, outbids)
+	} else {
+		b.tokenBids[o.TokenID] = insert(b.tokenBids[o.TokenID], o, outbids)
+	}
+	b.Orders[o.ID] = o
+	return nil, nil
+}
+
+func (b *Book) settle(bid, ask *Order, price float64, bidTaker bool) (*Trade, error) {
+	if err := b.registry.Transfer(ask.Collection, ask.TokenID, ask.UserID, bid.UserID); err != nil {
+		return nil, err
+	}
+
+	trade := &Trade{
+		Collection: b.Collection,
+		TokenID:    ask.TokenID,
+		Price:      price,
+		BidOrderID: bid.ID,
+		AskOrderID: ask.ID,
+		Buyer:      bid.UserID,
+		Seller:     ask.UserID,
+		BidTaker:   bidTaker,
+		Timestamp:  time.Now().UnixNano(),
+	}
+	b.trades = append(b.trades, *trade)
+
+	return trade, nil
+}
+
+// bestBid returns the highest bid of another user for the token: collection
+// bids, trait bids the token qualifies for and bids for the token alike.
+// Ties go to the earlier bid.
+func (b *Book) bestBid(tokenID string, seller int64) *Order {
+	best := first(b.collectionBids, seller)
+	if bid := first(b.tokenBids[tokenID], seller); better(bid, best) {
+		best = bid
+	}
+
+	traits, ok := b.metadata.traitsOf(b.Collection, tokenID)
+	if !ok {
+		return best
+	}
+	for _, key := range traitKeys(traits) {
+		for _, group := range b.byTrait[key] {
+			if !Matches(group.traits, traits) {
+				continue
+			}
+			if bid := first(group.bids, seller); better(bid, best) {
+				best = bid
+			}
+		}
+	}
+	return best
+}
+
+// bestAsk returns the cheapest listing of another user the bid accepts.
+func (b *Book) bestAsk(bid *Order) *Order {
+	if bid.TokenID != "" {
+		ask, ok := b.listings[bid.TokenID]
+		if !ok || ask.UserID == bid.UserID || ask.Price > bid.Price {
+			return nil
+		}
+		return ask
+	}
+
+	for _, ask := range b.asks {
+		if ask.Price > bid.Price {
+			break
+		}
+		if ask.UserID == bid.UserID {
+			continue
+		}
+		if len(bid.Traits) > 0 {
+			traits, _ := b.metadata.traitsOf(b.Collection, ask.TokenID)
+			if !Matches(bid.Traits, traits) {
+				continue
+			}
+		}
+		return ask
+	}
+	return nil
+}
+
+func (b *Book) addTraitBid(o *Order) {
+	key := filterKey(o.Traits)
+	group, ok := b.traitBids[key]
+	if !ok {
+		group = &traitGroup{key: key, traits: o.Traits}
+		b.traitBids[key] = group
+
+		index := traitKeys(o.Traits)[0]
+		if b.byTrait[index] == nil {
+			b.byTrait[index] = make(map[string]*traitGroup)
+		}
+		b.byTrait[index][key] = group
+	}
+	group.bids = insert(group.bids, o, outbids)
+}
+
+func (b *Book) removeTraitBid(o *Order) {
+	key := filterKey(o.Traits)
+	group, ok := b.traitBids[key]
+	if !ok {
+		return
+	}
+
+	group.bids = remove(group.bids, o)
+	if len(group.bids) > 0 {
+		return
+	}
+
+	delete(b.traitBids, key)
+	index := traitKeys(group.traits)[0]
+	delete(b.byTrait[index], key)
+	if len(b.byTrait[index]) == 0 {
+		delete(b.byTrait, index)
+	}
+}
+
+// Cancel removes the resting order from the book.
+func (b *Book) Cancel(id int64) (*Order, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o, ok := b.Orders[id]
+	if !ok {
+		return nil, fmt.Errorf("order %d not found", id)
+	}
+
+	if o.Bid {
+		b.removeBid(o)
+	} else {
+		b.removeAsk(o)
+	}
+	return o, nil
+}
+
+// Order returns the resting order.
+func (b *Book) Order(id int64) (*Order, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	o, ok := b.Orders[id]
+	return o, ok
+}
+
+// Trades returns every trade of the book, oldest first.
+func (b *Book) Trades() []Trade {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	trades := make([]Trade, len(b.trades))
+	copy(trades, b.trades)
+	return trades
+}
+
+// Snapshot returns a copy of the resting orders.
+func (b *Book) Snapshot() Snapshot {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	tokenBids := []Order{}
+	for _, bids := range b.tokenBids {
+		tokenBids = append(tokenBids, copyOrders(bids)...)
+	}
+	traitBids := []Order{}
+	for _, group := range b.traitBids {
+		traitBids = append(traitBids, copyOrders(group.bids)...)
+	}
+	sortBids(tokenBids)
+	sortBids(traitBids)
+
+	return Snapshot{
+		Collection:     b.Collection,
+		Listings:       copyOrders(b.asks),
+		CollectionBids: copyOrders(b.collectionBids),
+		TraitBids:      traitBids,
+		TokenBids:      tokenBids,
+	}
+}
+
+func (b *Book) removeAsk(o *Order) {
+	b.asks = remove(b.asks, o)
+	delete(b.listings, o.TokenID)
+	delete(b.Orders, o.ID)
+}
+
+func (b *Book) removeBid(o *Order) {
+	if len(o.Traits) > 0 {
+		b.removeTraitBid(o)
+	} else if o.TokenID == "" {
+		b.collectionBids = remove(b.collectionBids, o)
+	} else if bids := remove(b.tokenBids[o.TokenID], o); len(bids) > 0 {
+		b.tokenBids[o.TokenID] = bids
+	} else {
+		delete(b.tokenBids, o.TokenID)
+	}
+	delete(b.Orders, o.ID)
+}
+
+func outbids(a, x *Order) bool {
+	return a.Price > x.Price
+}
+
+// better reports whether bid a ranks before x, a nil x ranks last.
+func better(a, x *Order) bool {
+	if a == nil {
+		return false
+	}
+	return x == nil || outbids(a, x) || (a.Price == x.Price && a.Timestamp < x.Timestamp)
+}
+
+func sortBids(bids []Order) {
+	sort.Slice(bids, func(i, j int) bool {
+		return better(&bids[i], &bids[j])
+	})
+}
+
+// insert adds o to orders after every order it doesn't beat, keeping time
+// priority among equal prices.
+func insert(orders []*Order, o *Order, beats func(a, x *Order) bool) []*Order {
+	i := sort.Search(len(orders), func(i int) bool { return beats(o, orders[i]) })
+	orders = append(orders, nil)
+	copy(orders[i+1:], orders[i:])
+	orders[i] = o
+	return orders
+}
+
+func remove(orders []*Order, o *Order) []*Order {
+	for i, order := range orders {
+		if order == o {
+			return append(orders[:i], orders[i+1:]...)
+		}
+	}
+	return orders
+}
+
+// first returns the first order not placed by userID.
+func first(orders []*Order, userID int64) *Order {
+	for _, o := range orders {
+		if o.UserID != userID {
+			return o
+		}
+	}
+	return nil
+}
+
+func copyOrders(orders []*Order) []Order {
+	copies := make([]Order, len(orders))
+	for i, o := range orders {
+		copies[i] = *o
+	}
+	return copies
+}
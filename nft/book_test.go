@@ -0,0 +1,276 @@
+package nft
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func assert(t *testing.T, a, b any) {
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func newTestBook(t *testing.T) *Book {
+	registry := NewRegistry()
+	for _, tokenID := range []string{"1", "2", "3"} {
+		if err := registry.Mint("punks", tokenID, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewBook("punks", registry, nil)
+}
+
+func TestCollectionBidFillsCheapestListing(t *testing.T) {
+	b := newTestBook(t)
+
+	for tokenID, p := range map[string]float64{"1": 60, "2": 55, "3": 70} {
+		trade, err := b.Place(NewOrder(1, "punks", tokenID, false, p))
+		assert(t, err, nil)
+		assert(t, trade == nil, true)
+	}
+
+	trade, err := b.Place(NewOrder(2, "punks", "", true, 65))
+	assert(t, err, nil)
+	assert(t, trade.TokenID, "2")
+	assert(t, trade.Price, 55.0)
+	assert(t, trade.Buyer, int64(2))
+	assert(t, trade.Seller, int64(1))
+	assert(t, trade.BidTaker, true)
+
+	owner, _ := b.registry.Owner("punks", "2")
+	assert(t, owner, int64(2))
+	assert(t, len(b.Snapshot().Listings), 2)
+
+	// nothing left at or below the bid, so it rests
+	trade, err = b.Place(NewOrder(2, "punks", "", true, 58))
+	assert(t, err, nil)
+	assert(t, trade == nil, true)
+	assert(t, len(b.Snapshot().CollectionBids), 1)
+}
+
+func TestListingFillsBestBid(t *testing.T) {
+	b := newTestBook(t)
+
+	collectionBid := NewOrder(2, "punks", "", true, 50)
+	tokenBid := NewOrder(3, "punks", "1", true, 52)
+	otherTokenBid := NewOrder(4, "punks", "2", true, 80)
+	for _, o := range []*Order{collectionBid, tokenBid, otherTokenBid} {
+		_, err := b.Place(o)
+		assert(t, err, nil)
+	}
+
+	// the bid for token 1 beats the collection bid, the one for token 2
+	// doesn't apply
+	trade, err := b.Place(NewOrder(1, "punks", "1", false, 45))
+	assert(t, err, nil)
+	assert(t, trade.BidOrderID, tokenBid.ID)
+	assert(t, trade.Price, 52.0)
+	assert(t, trade.BidTaker, false)
+
+	trade, err = b.Place(NewOrder(1, "punks", "3", false, 45))
+	assert(t, err, nil)
+	assert(t, trade.BidOrderID, collectionBid.ID)
+	assert(t, trade.Price, 50.0)
+
+	snapshot := b.Snapshot()
+	assert(t, len(snapshot.CollectionBids), 0)
+	assert(t, len(snapshot.TokenBids), 1)
+	assert(t, len(b.Trades()), 2)
+}
+
+func TestListingNeedsOwnership(t *testing.T) {
+	b := newTestBook(t)
+
+	_, err := b.Place(NewOrder(2, "punks", "1", false, 50))
+	assert(t, err != nil, true)
+
+	_, err = b.Place(NewOrder(1, "punks", "9", false, 50))
+	assert(t, err != nil, true)
+
+	_, err = b.Place(NewOrder(1, "punks", "", false, 50))
+	assert(t, err != nil, true)
+
+	_, err = b.Place(NewOrder(1, "punks", "1", false, 50))
+	assert(t, err, nil)
+	_, err = b.Place(NewOrder(1, "punks", "1", false, 40))
+	assert(t, err != nil, true)
+
+	// owners can't bid for their own token
+	_, err = b.Place(NewOrder(1, "punks", "2", true, 50))
+	assert(t, err != nil, true)
+}
+
+func TestStaleListingIsSkipped(t *testing.T) {
+	b := newTestBook(t)
+
+	_, err := b.Place(NewOrder(1, "punks", "1", false, 40))
+	assert(t, err, nil)
+	_, err = b.Place(NewOrder(1, "punks", "2", false, 45))
+	assert(t, err, nil)
+
+	// token 1 leaves the seller outside the book
+	assert(t, b.registry.Transfer("punks", "1", 1, 5), nil)
+
+	trade, err := b.Place(NewOrder(2, "punks", "", true, 50))
+	assert(t, err, nil)
+	assert(t, trade.TokenID, "2")
+	assert(t, len(b.Snapshot().Listings), 0)
+}
+
+func TestCancel(t *testing.T) {
+	b := newTestBook(t)
+
+	bid := NewOrder(2, "punks", "1", true, 30)
+	_, err := b.Place(bid)
+	assert(t, err, nil)
+
+	o, err := b.Cancel(bid.ID)
+	assert(t, err, nil)
+	assert(t, o, bid)
+	assert(t, len(b.Snapshot().TokenBids), 0)
+
+	_, err = b.Cancel(bid.ID)
+	assert(t, err != nil, true)
+
+	// the cancelled bid no longer fills
+	trade, err := b.Place(NewOrder(1, "punks", "1", false, 30))
+	assert(t, err, nil)
+	assert(t, trade == nil, true)
+}
+
+func newTraitBook(t *testing.T) *Book {
+	registry := NewRegistry()
+	metadata := NewMetadata()
+	err := metadata.Load(Manifest{
+		Collection: "punks",
+		Tokens: []TokenMetadata{
+			{TokenID: "1", Traits: map[string]string{"Background": "Gold", "Type": "Alien"}},
+			{TokenID: "2", Traits: map[string]string{"Background": "Blue", "Type": "Ape"}},
+			{TokenID: "3", Traits: map[string]string{"Background": "Gold", "Type": "Ape"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tokenID := range []string{"1", "2", "3"} {
+		if err := registry.Mint("punks", tokenID, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewBook("punks", registry, metadata)
+}
+
+func traitBid(userID int64, price float64, traits map[string]string) *Order {
+	o := NewOrder(userID, "punks", "", true, price)
+	o.Traits = traits
+	return o
+}
+
+func TestListingFillsBestQualifyingTraitBid(t *testing.T) {
+	b := newTraitBook(t)
+
+	collectionBid := NewOrder(2, "punks", "", true, 60)
+	goldBid := traitBid(3, 70, map[string]string{"Background": "Gold"})
+	goldApeBid := traitBid(4, 80, map[string]string{"Type": "Ape", "Background": "Gold"})
+	for _, o := range []*Order{collectionBid, goldBid, goldApeBid} {
+		_, err := b.Place(o)
+		assert(t, err, nil)
+	}
+	assert(t, len(b.Snapshot().TraitBids), 2)
+
+	trade, err := b.Place(NewOrder(1, "punks", "3", false, 50))
+	assert(t, err, nil)
+	assert(t, trade.BidOrderID, goldApeBid.ID)
+	assert(t, trade.Price, 80.0)
+
+	// token 2 is blue, only the collection bid takes it
+	trade, err = b.Place(NewOrder(1, "punks", "2", false, 50))
+	assert(t, err, nil)
+	assert(t, trade.BidOrderID, collectionBid.ID)
+
+	trade, err = b.Place(NewOrder(1, "punks", "1", false, 50))
+	assert(t, err, nil)
+	assert(t, trade.BidOrderID, goldBid.ID)
+
+	snapshot := b.Snapshot()
+	assert(t, len(snapshot.TraitBids), 0)
+	assert(t, len(b.traitBids), 0)
+	assert(t, len(b.byTrait), 0)
+}
+
+func TestTraitBidSkipsListingsWithoutTheTraits(t *testing.T) {
+	b := newTraitBook(t)
+
+	_, err := b.Place(NewOrder(1, "punks", "1", false, 40))
+	assert(t, err, nil)
+	_, err = b.Place(NewOrder(1, "punks", "2", false, 45))
+	assert(t, err, nil)
+
+	trade, err := b.Place(traitBid(2, 50, map[string]string{"Type": "Ape"}))
+	assert(t, err, nil)
+	assert(t, trade.TokenID, "2")
+	assert(t, trade.Price, 45.0)
+
+	// nothing left with the trait, so it rests and cancels like any bid
+	bid := traitBid(2, 50, map[string]string{"Type": "Ape"})
+	trade, err = b.Place(bid)
+	assert(t, err, nil)
+	assert(t, trade == nil, true)
+
+	_, err = b.Cancel(bid.ID)
+	assert(t, err, nil)
+	assert(t, len(b.Snapshot().TraitBids), 0)
+}
+
+func TestTraitBidNeedsMetadata(t *testing.T) {
+	_, err := newTestBook(t).Place(traitBid(2, 50, map[string]string{"Type": "Ape"}))
+	assert(t, err != nil, true)
+
+	b := newTraitBook(t)
+	listing := NewOrder(1, "punks", "1", false, 50)
+	listing.Traits = map[string]string{"Type": "Ape"}
+	_, err = b.Place(listing)
+	assert(t, err != nil, true)
+
+	tokenBid := NewOrder(2, "punks", "1", true, 50)
+	tokenBid.Traits = map[string]string{"Type": "Ape"}
+	_, err = b.Place(tokenBid)
+	assert(t, err != nil, true)
+}
+
+func TestMetadataLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	data := `{"Collection": "punks", "Tokens": [{"TokenID": "7", "Traits": {"Background": "Gold"}}]}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMetadata()
+	assert(t, m.LoadFile(path), nil)
+
+	traits, ok := m.Traits("punks", "7")
+	assert(t, ok, true)
+	assert(t, traits, map[string]string{"Background": "Gold"})
+
+	_, ok = m.Traits("punks", "8")
+	assert(t, ok, false)
+
+	assert(t, m.Load(Manifest{Tokens: []TokenMetadata{{TokenID: "1"}}}) != nil, true)
+	assert(t, m.LoadFile(filepath.Join(t.TempDir(), "missing.json")) != nil, true)
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	assert(t, r.Mint("punks", "1", 1), nil)
+	assert(t, r.Mint("punks", "1", 2) != nil, true)
+	assert(t, r.Mint("apes", "7", 1), nil)
+
+	assert(t, r.Transfer("punks", "1", 2, 3) != nil, true)
+	assert(t, r.Transfer("punks", "1", 1, 3), nil)
+
+	assert(t, r.Tokens(1), []Token{{Collection: "apes", TokenID: "7"}})
+	assert(t, r.Tokens(3), []Token{{Collection: "punks", TokenID: "1"}})
+}
@@ -0,0 +1,127 @@
+package nft
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// Manifest describes the tokens of a collection, as shipped alongside it.
+	Manifest struct {
+		Collection string
+		Tokens     []TokenMetadata
+	}
+
+	// TokenMetadata holds the traits of a token, e.g. "Background": "Gold".
+	TokenMetadata struct {
+		TokenID string
+		Traits  map[string]string
+	}
+)
+
+// Metadata holds the traits of every token of the collections it loaded.
+type Metadata struct {
+	mu     sync.RWMutex
+	traits map[Token]map[string]string
+}
+
+func NewMetadata() *Metadata {
+	return &Metadata{traits: make(map[Token]map[string]string)}
+}
+
+// Load adds the tokens of the manifest, replacing what was known about
+// them.
+func (m *Metadata) Load(manifest Manifest) error {
+	if manifest.Collection == "" {
+		return fmt.Errorf("manifest without a collection")
+	}
+	for _, token := range manifest.Tokens {
+		if token.TokenID == "" {
+			return fmt.Errorf("manifest of %s has a token without an id", manifest.Collection)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, token := range manifest.Tokens {
+		traits := make(map[string]string, len(token.Traits))
+		for name, value := range token.Traits {
+			traits[name] = value
+		}
+		m.traits[Token{Collection: manifest.Collection, TokenID: token.TokenID}] = traits
+	}
+	return nil
+}
+
+// LoadFile loads a manifest from a JSON file.
+func (m *Metadata) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+	return m.Load(manifest)
+}
+
+// Traits returns a copy of the traits of the token.
+func (m *Metadata) Traits(collection, tokenID string) (map[string]string, bool) {
+	traits, ok := m.traitsOf(collection, tokenID)
+	if !ok {
+		return nil, false
+	}
+
+	copied := make(map[string]string, len(traits))
+	for name, value := range traits {
+		copied[name] = value
+	}
+	return copied, true
+}
+
+// traitsOf returns the traits of the token, which must not be modified.
+func (m *Metadata) traitsOf(collection, tokenID string) (map[string]string, bool) {
+	if m == nil {
+		return nil, false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	traits, ok := m.traits[Token{Collection: collection, TokenID: tokenID}]
+	return traits, ok
+}
+
+// Matches reports whether traits have every trait of the filter.
+func Matches(filter, traits map[string]string) bool {
+	for name, value := range filter {
+		if v, ok := traits[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// traitKeys returns the traits as sorted "name"="value" keys, quoted so
+// that no name or value can pass for another.
+func traitKeys(traits map[string]string) []string {
+	keys := make([]string, 0, len(traits))
+	for name, value := range traits {
+		keys = append(keys, strconv.Quote(name)+"="+strconv.Quote(value))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// filterKey identifies a trait filter regardless of the order of its traits.
+func filterKey(filter map[string]string) string {
+	return strings.Join(traitKeys(filter), ";")
+}
@@ -0,0 +1,89 @@
+package nft
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Token is one item of a collection.
+type Token struct {
+	Collection string
+	TokenID    string
+}
+
+// Registry records who owns every token held by the exchange. Tokens enter
+// it when deposited and change hands when a trade settles.
+type Registry struct {
+	mu     sync.RWMutex
+	owners map[Token]int64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{owners: make(map[Token]int64)}
+}
+
+// Mint registers a token deposited by owner.
+func (r *Registry) Mint(collection, tokenID string, owner int64) error {
+	if collection == "" || tokenID == "" {
+		return fmt.Errorf("missing collection or token id")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	token := Token{Collection: collection, TokenID: tokenID}
+	if _, ok := r.owners[token]; ok {
+		return fmt.Errorf("token %s #%s is already registered", collection, tokenID)
+	}
+	r.owners[token] = owner
+	return nil
+}
+
+// Owner returns the owner of the token.
+func (r *Registry) Owner(collection, tokenID string) (int64, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	owner, ok := r.owners[Token{Collection: collection, TokenID: tokenID}]
+	return owner, ok
+}
+
+// Transfer moves the token from one owner to another. It fails when from
+// doesn't own it.
+func (r *Registry) Transfer(collection, tokenID string, from, to int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	token := Token{Collection: collection, TokenID: tokenID}
+	owner, ok := r.owners[token]
+	if !ok {
+		return fmt.Errorf("token %s #%s is not registered", collection, tokenID)
+	}
+	if owner != from {
+		return fmt.Errorf("token %s #%s is not owned by user %d", collection, tokenID, from)
+	}
+	r.owners[token] = to
+	return nil
+}
+
+// Tokens returns the tokens owned by the user.
+func (r *Registry) Tokens(owner int64) []Token {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	tokens := []Token{}
+	for token, o := range r.owners {
+		if o == owner {
+			tokens = append(tokens, token)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].Collection != tokens[j].Collection {
+			return tokens[i].Collection < tokens[j].Collection
+		}
+		return tokens[i].TokenID < tokens[j].TokenID
+	})
+	return tokens
+}
@@ -0,0 +1,46 @@
+package orderbook
+
+import (
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+// ChecksumDepth is the number of levels per side covered by the checksum.
+const ChecksumDepth = 25
+
+// Checksum is a CRC32 (IEEE) over the best ChecksumDepth levels of each side,
+// so a client mirroring the book can check it hasn't drifted. Levels must be
+// sorted best first. The hashed string is every bid and then every ask
+// written as "price:size", joined by "|", with numbers in their shortest
+// decimal form, e.g. "99.5:2|100:1.25".
+func Checksum(bids, asks []PriceLevel) uint32 {
+	var sb strings.Builder
+
+	write := func(levels []PriceLevel) {
+		for i, level := range levels {
+			if i == ChecksumDepth {
+				break
+			}
+			if sb.Len() > 0 {
+				sb.WriteByte('|')
+			}
+			sb.WriteString(strconv.FormatFloat(level.Price, 'f', -1, 64))
+			sb.WriteByte(':')
+			sb.WriteString(strconv.FormatFloat(level.Size, 'f', -1, 64))
+		}
+	}
+
+	write(bids)
+	write(asks)
+
+	return crc32.ChecksumIEEE([]byte(sb.String()))
+}
+
+// checksum must be called with the book locked.
+func (ob *Orderbook) checksum() uint32 {
+	return Checksum(
+		aggregateLevels(ob.Bids(), ChecksumDepth, 0, true),
+		aggregateLevels(ob.Asks(), ChecksumDepth, 0, false),
+	)
+}
@@ -0,0 +1,141 @@
+package orderbook
+
+import "math"
+
+// PriceLevel is the aggregated view of all resting orders at one price.
+type PriceLevel struct {
+	Price  float64
+	Size   float64
+	Orders int
+}
+
+// BookDepth is an aggregated snapshot of the book taken at Sequence.
+// Checksum always covers the ungrouped book, whatever depth and grouping the
+// snapshot was taken with.
+type BookDepth struct {
+	Sequence uint64
+	Checksum uint32
+	Bids     []PriceLevel
+	Asks     []PriceLevel
+}
+
+// Depth aggregates both sides of the book into at most depth levels each,
+// best price first. A depth of zero or less returns every level.
+//
+// When grouping is greater than zero, prices are bucketed into multiples of
+// grouping. Bids round down and asks round up, so a bucket never shows a
+// better price than the orders it contains.
+func (ob *Orderbook) Depth(depth int, grouping float64) BookDepth {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	return BookDepth{
+		Sequence: ob.Sequence(),
+		Checksum: ob.checksum(),
+		Bids:     aggregateLevels(ob.Bids(), depth, grouping, true),
+		Asks:     aggregateLevels(ob.Asks(), depth, grouping, false),
+	}
+}
+
+func aggregateLevels(limits []*Limit, depth int, grouping float64, bid bool) []PriceLevel {
+	levels := []PriceLevel{}
+
+	for _, limit := range limits {
+		if len(limit.Orders) == 0 {
+			continue
+		}
+
+		price := groupPrice(limit.Price, grouping, bid)
+
+		// limits are sorted best first, so a bucket only ever merges with the last level
+		if n := len(levels); n > 0 && levels[n-1].Price == price {
+			levels[n-1].Size += limit.TotalVolume
+			levels[n-1].Orders += len(limit.Orders)
+			continue
+		}
+
+		if depth > 0 && len(levels) == depth {
+			break
+		}
+
+		levels = append(levels, PriceLevel{
+			Price:  price,
+			Size:   limit.TotalVolume,
+			Orders: len(limit.Orders),
+		})
+	}
+
+	return levels
+}
+
+// groupPrice snaps price onto the grouping grid. The small epsilon keeps
+// prices that already sit on the grid from being pushed a bucket away by
+// floating point noise.
+func groupPrice(price, grouping float64, bid bool) float64 {
+	if grouping <= 0 {
+		return price
+	}
+
+	const eps = 1e-9
+
+	var bucket float64
+	if bid {
+		bucket = math.Floor(price/grouping + eps)
+	} else {
+		bucket = math.Ceil(price/grouping - eps)
+	}
+
+	return math.Round(bucket*grouping*1e8) / 1e8
+}
+
+// MidPrice returns the mid of the best bid and ask, zero if a side is empty.
+func (ob *Orderbook) MidPrice() float64 {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	bids, asks := ob.Bids(), ob.Asks()
+	if len(bids) == 0 || len(asks) == 0 {
+		return 0
+	}
+
+	return (bids[0].Price + asks[0].Price) / 2
+}
+
+// LastPrice returns the price of the last trade, zero if nothing traded yet.
+func (ob *Orderbook) LastPrice() float64 {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if len(ob.Trades) == 0 {
+		return 0
+	}
+
+	return ob.Trades[len(ob.Trades)-1].Price
+}
+
+// MarketOrderPrice walks the side of the book a market order would take and
+// returns the average price and size it would fill, without placing it.
+func (ob *Orderbook) MarketOrderPrice(bid bool, size float64) (avgPrice float64, filled float64) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	limits := ob.Bids()
+	if bid {
+		limits = ob.Asks()
+	}
+
+	notional := 0.0
+	for _, limit := range limits {
+		if filled >= size {
+			break
+		}
+		take := math.Min(size-filled, limit.TotalVolume)
+		filled += take
+		notional += take * limit.Price
+	}
+
+	if filled == 0 {
+		return 0, 0
+	}
+	return notional / filled, filled
+}
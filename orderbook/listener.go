@@ -0,0 +1,61 @@
+package orderbook
+
+// BookUpdate lists the price levels touched by a single change to the book,
+// with their size after the change. A level with zero size has been removed.
+// Checksum is the checksum of the book after the change.
+type BookUpdate struct {
+	Sequence uint64
+	Checksum uint32
+	Bids     []PriceLevel
+	Asks     []PriceLevel
+}
+
+// Listener is notified of every change to the book. It is called while the
+// book is locked, so implementations must not block or call back into it.
+type Listener interface {
+	OnBookUpdate(BookUpdate)
+	OnTrade(*Trade)
+}
+
+func (ob *Orderbook) SetListener(l Listener) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.listener = l
+}
+
+// notify sends the current state of the given price levels to the listener.
+// Must be called with the book locked, right after the sequence was bumped.
+func (ob *Orderbook) notify(bidPrices, askPrices []float64) {
+	if ob.listener == nil {
+		return
+	}
+
+	ob.listener.OnBookUpdate(BookUpdate{
+		Sequence: ob.Sequence(),
+		Checksum: ob.checksum(),
+		Bids:     levelsAt(ob.BidLimits, bidPrices),
+		Asks:     levelsAt(ob.AskLimits, askPrices),
+	})
+}
+
+func levelsAt(limits map[float64]*Limit, prices []float64) []PriceLevel {
+	levels := []PriceLevel{}
+	seen := make(map[float64]bool, len(prices))
+
+	for _, price := range prices {
+		if seen[price] {
+			continue
+		}
+		seen[price] = true
+
+		level := PriceLevel{Price: price}
+		if limit, ok := limits[price]; ok {
+			level.Size = limit.TotalVolume
+			level.Orders = len(limit.Orders)
+		}
+		levels = append(levels, level)
+	}
+
+	return levels
+}
@@ -23,6 +23,9 @@ type Match struct {
 	Bid        *Order
 	SizeFilled float64
 	Price      float64
+	// BidTaker is set when the bid was the incoming order that took
+	// liquidity from the book, the ask was the taker otherwise
+	BidTaker bool
 }
 
 type Order struct {
@@ -31,6 +34,7 @@ type Order struct {
 	Size      float64
 	Bid       bool
 	Price     float64
+	Leverage  float64
 	Limit     *Limit
 	Timestamp int64
 }
@@ -50,6 +54,7 @@ func NewOrder(bid bool, size float64, userID int64, leverage float64) *Order {
 		ID:        newID,
 		Size:      size,
 		Bid:       bid,
+		Leverage:  leverage,
 		Timestamp: time.Now().UnixNano(),
 	}
 }
@@ -203,6 +208,7 @@ func (l *Limit) fillOrder(a, b *Order) (Match, []int64) {
 		Ask:        ask,
 		SizeFilled: sizeFilled,
 		Price:      l.Price,
+		BidTaker:   b.Bid,
 	}, filledOrders
 }
 
@@ -212,6 +218,10 @@ type Orderbook struct {
 
 	Trades []*Trade
 
+	// seq is bumped on every change to the resting orders
+	seq      uint64
+	listener Listener
+
 	mu        sync.RWMutex
 	AskLimits map[float64]*Limit
 	BidLimits map[float64]*Limit
@@ -233,6 +243,7 @@ func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
 	ob.mu.Lock()
 
 	matches := []Match{}
+	touched := []float64{}
 
 	if o.Bid {
 		if o.Size > ob.AskTotalVolume() {
@@ -242,6 +253,9 @@ func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
 		for _, limit := range ob.Asks() {
 			limitMatches, filledOrders, ordersToDelete := limit.Fill(o)
 			matches = append(matches, limitMatches...)
+			if len(limitMatches) > 0 {
+				touched = append(touched, limit.Price)
+			}
 
 			for _, id := range filledOrders {
 				delete(ob.Orders, id)
@@ -263,6 +277,9 @@ func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
 		for _, limit := range ob.Bids() {
 			limitMatches, filledOrders, ordersToDelete := limit.Fill(o)
 			matches = append(matches, limitMatches...)
+			if len(limitMatches) > 0 {
+				touched = append(touched, limit.Price)
+			}
 
 			for _, id := range filledOrders {
 				delete(ob.Orders, id)
@@ -278,7 +295,14 @@ func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
 		}
 	}
 
-	ob.mu.Unlock() //unlock before the loop begins
+	if len(matches) > 0 {
+		atomic.AddUint64(&ob.seq, 1)
+		if o.Bid {
+			ob.notify(nil, touched)
+		} else {
+			ob.notify(touched, nil)
+		}
+	}
 
 	for _, match := range matches {
 		trade := &Trade{
@@ -288,8 +312,14 @@ func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
 			Bid:       o.Bid,
 		}
 		ob.Trades = append(ob.Trades, trade)
+
+		if ob.listener != nil {
+			ob.listener.OnTrade(trade)
+		}
 	}
 
+	ob.mu.Unlock()
+
 	// logrus.WithFields(logrus.Fields{
 	// 	"currentPrice": ob.Trades[len(ob.Trades)-1].Price,
 	// }).Info()
@@ -321,6 +351,13 @@ func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 	}
 
 	ob.Orders[o.ID] = o
+	limit.AddOrder(o)
+	atomic.AddUint64(&ob.seq, 1)
+	if o.Bid {
+		ob.notify([]float64{price}, nil)
+	} else {
+		ob.notify(nil, []float64{price})
+	}
 	ob.mu.Unlock()
 
 	logrus.WithFields(logrus.Fields{
@@ -329,8 +366,6 @@ func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 		"size":   o.Size,
 		"userID": o.UserID,
 	}).Info("new limit order")
-
-	limit.AddOrder(o)
 }
 
 func (ob *Orderbook) clearLimit(bid bool, l *Limit) {
@@ -366,6 +401,9 @@ func (ob *Orderbook) clearLimit(bid bool, l *Limit) {
 }
 
 func (ob *Orderbook) CancelOrder(o *Order) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
 	limit := o.Limit
 	limit.DeleteOrder(o)
 	delete(ob.Orders, o.ID)
@@ -373,6 +411,46 @@ func (ob *Orderbook) CancelOrder(o *Order) {
 	if len(limit.Orders) == 0 {
 		ob.clearLimit(o.Bid, limit)
 	}
+
+	atomic.AddUint64(&ob.seq, 1)
+	if o.Bid {
+		ob.notify([]float64{limit.Price}, nil)
+	} else {
+		ob.notify(nil, []float64{limit.Price})
+	}
+}
+
+// ReduceOrder shrinks a resting order to size, keeping its place in the
+// queue. A size of zero or less cancels it, a size larger than the order is
+// ignored.
+func (ob *Orderbook) ReduceOrder(o *Order, size float64) {
+	if size <= 0 {
+		ob.CancelOrder(o)
+		return
+	}
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	limit := o.Limit
+	if limit == nil || size >= o.Size {
+		return
+	}
+
+	limit.TotalVolume -= o.Size - size
+	o.Size = size
+
+	atomic.AddUint64(&ob.seq, 1)
+	if o.Bid {
+		ob.notify([]float64{limit.Price}, nil)
+	} else {
+		ob.notify(nil, []float64{limit.Price})
+	}
+}
+
+// Sequence returns the number of changes applied to the book so far.
+func (ob *Orderbook) Sequence() uint64 {
+	return atomic.LoadUint64(&ob.seq)
 }
 
 func (ob *Orderbook) BidTotalVolume() float64 {
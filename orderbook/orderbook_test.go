@@ -2,6 +2,7 @@ package orderbook
 
 import (
 	"fmt"
+	"hash/crc32"
 	"math/rand"
 	"reflect"
 	"sync"
@@ -18,10 +19,10 @@ func TestLastMarketTrades(t *testing.T) {
 	ob := NewOrderbook()
 	price := 10000.0
 
-	sellOrder := NewOrder(false, 10, 0)
+	sellOrder := NewOrder(false, 10, 0, 1)
 	ob.PlaceLimitOrder(price, sellOrder)
 
-	marketOrder := NewOrder(true, 10, 0)
+	marketOrder := NewOrder(true, 10, 0, 1)
 	matches := ob.PlaceMarketOrder(marketOrder)
 	assert(t, len(matches), 1)
 	match := matches[0]
@@ -35,9 +36,9 @@ func TestLastMarketTrades(t *testing.T) {
 
 func TestLimit(t *testing.T) {
 	l := NewLimit(10_000)
-	buyOrderA := NewOrder(true, 5, 0)
-	buyOrderB := NewOrder(true, 8, 0)
-	buyOrderC := NewOrder(true, 10, 0)
+	buyOrderA := NewOrder(true, 5, 0, 1)
+	buyOrderB := NewOrder(true, 8, 0, 1)
+	buyOrderC := NewOrder(true, 10, 0, 1)
 
 	l.AddOrder(buyOrderA)
 	l.AddOrder(buyOrderB)
@@ -51,8 +52,8 @@ func TestLimit(t *testing.T) {
 func TestPlaceLimitOrder(t *testing.T) {
 	ob := NewOrderbook()
 
-	sellOrderA := NewOrder(false, 10, 0)
-	sellOrderB := NewOrder(false, 5, 0)
+	sellOrderA := NewOrder(false, 10, 0, 1)
+	sellOrderB := NewOrder(false, 5, 0, 1)
 	ob.PlaceLimitOrder(10_000, sellOrderA)
 	ob.PlaceLimitOrder(9_000, sellOrderB)
 
@@ -65,10 +66,10 @@ func TestPlaceLimitOrder(t *testing.T) {
 func TestPlaceMarketOrder(t *testing.T) {
 	ob := NewOrderbook()
 
-	sellOrder := NewOrder(false, 20, 0)
+	sellOrder := NewOrder(false, 20, 0, 1)
 	ob.PlaceLimitOrder(10_000, sellOrder)
 
-	buyOrder := NewOrder(true, 10, 0)
+	buyOrder := NewOrder(true, 10, 0, 1)
 	matches := ob.PlaceMarketOrder(buyOrder)
 
 	assert(t, len(matches), 1)
@@ -78,16 +79,17 @@ func TestPlaceMarketOrder(t *testing.T) {
 	assert(t, matches[0].Bid, buyOrder)
 	assert(t, matches[0].SizeFilled, 10.0)
 	assert(t, matches[0].Price, 10_000.0)
+	assert(t, matches[0].BidTaker, true)
 	assert(t, buyOrder.IsFilled(), true)
 }
 
 func TestPlaceMarketOrderMultiFill(t *testing.T) {
 	ob := NewOrderbook()
 
-	buyOrderA := NewOrder(true, 5, 0) // filled fully
-	buyOrderB := NewOrder(true, 8, 0) // partially filled
-	buyOrderD := NewOrder(true, 1, 0)
-	buyOrderC := NewOrder(true, 1, 0)
+	buyOrderA := NewOrder(true, 5, 0, 1) // filled fully
+	buyOrderB := NewOrder(true, 8, 0, 1) // partially filled
+	buyOrderD := NewOrder(true, 1, 0, 1)
+	buyOrderC := NewOrder(true, 1, 0, 1)
 
 	ob.PlaceLimitOrder(5_000, buyOrderC)
 	ob.PlaceLimitOrder(5_000, buyOrderD)
@@ -96,7 +98,7 @@ func TestPlaceMarketOrderMultiFill(t *testing.T) {
 
 	assert(t, ob.BidTotalVolume(), 15.00)
 
-	sellOrder := NewOrder(false, 10, 0)
+	sellOrder := NewOrder(false, 10, 0, 1)
 	matches := ob.PlaceMarketOrder(sellOrder)
 
 	assert(t, ob.BidTotalVolume(), 5.00)
@@ -106,7 +108,7 @@ func TestPlaceMarketOrderMultiFill(t *testing.T) {
 
 func TestCancelOrderAsk(t *testing.T) {
 	ob := NewOrderbook()
-	sellOrder := NewOrder(false, 4, 0)
+	sellOrder := NewOrder(false, 4, 0, 1)
 	price := 10_000.0
 	ob.PlaceLimitOrder(price, sellOrder)
 
@@ -124,7 +126,7 @@ func TestCancelOrderAsk(t *testing.T) {
 
 func TestCancelOrderBid(t *testing.T) {
 	ob := NewOrderbook()
-	buyOrder := NewOrder(true, 4, 0)
+	buyOrder := NewOrder(true, 4, 0, 1)
 	price := 10_000.0
 	ob.PlaceLimitOrder(price, buyOrder)
 
@@ -140,13 +142,39 @@ func TestCancelOrderBid(t *testing.T) {
 	assert(t, ok, false)
 }
 
+func TestReduceOrder(t *testing.T) {
+	ob := NewOrderbook()
+	first := NewOrder(false, 4, 0, 1)
+	second := NewOrder(false, 2, 1, 1)
+	ob.PlaceLimitOrder(10_000, first)
+	ob.PlaceLimitOrder(10_000, second)
+
+	ob.ReduceOrder(first, 1)
+	assert(t, first.Size, 1.0)
+	assert(t, ob.AskTotalVolume(), 3.0)
+
+	// growing an order would jump the queue
+	ob.ReduceOrder(first, 5)
+	assert(t, first.Size, 1.0)
+
+	// the reduced order keeps its priority
+	matches := ob.PlaceMarketOrder(NewOrder(true, 1, 2, 1))
+	assert(t, len(matches), 1)
+	assert(t, matches[0].Ask, first)
+
+	ob.ReduceOrder(second, 0)
+	assert(t, ob.AskTotalVolume(), 0.0)
+	_, ok := ob.Orders[second.ID]
+	assert(t, ok, false)
+}
+
 // func TestPlaceLargeNumberOfOrders(t *testing.T) {
 // 	ob := NewOrderbook()
 
 // 	const ordersCount = 1000000
 // 	for i := 0; i < ordersCount; i++ {
 // 		price := float64(1 + rand.Intn(1_000))
-// 		order := NewOrder(rand.Intn(2) == 0, rand.Float64()*100, rand.Int63())
+// 		order := NewOrder(rand.Intn(2) == 0, rand.Float64()*100, rand.Int63(), 1)
 // 		ob.PlaceLimitOrder(price, order)
 // 	}
 
@@ -171,7 +199,7 @@ func TestPlaceAndFillOrdersConcurrently(t *testing.T) {
 		for i := 0; i < numOrders; i++ {
 			price := rand.Float64() * 1000
 			size := rand.Float64() * 100
-			bid := NewOrder(true, size, int64(i))
+			bid := NewOrder(true, size, int64(i), 1)
 			ob.PlaceLimitOrder(price, bid)
 
 			// Signal that a new limit order has been placed
@@ -187,7 +215,7 @@ func TestPlaceAndFillOrdersConcurrently(t *testing.T) {
 			<-limitOrderPlaced
 
 			size := rand.Float64() * 100
-			ask := NewOrder(false, size, int64(i))
+			ask := NewOrder(false, size, int64(i), 1)
 
 			// Only try to place market order if enough bid volume exists
 			// If not enough volume, the order will be skipped, imitating real-life scenarios
@@ -212,7 +240,7 @@ func TestOrdersStateUnderLoad(t *testing.T) {
 	const ordersCount = 1_000_000
 	for i := 0; i < ordersCount; i++ {
 		price := float64(1 + rand.Intn(1_000))
-		order := NewOrder(rand.Intn(2) == 0, rand.Float64()*100, rand.Int63())
+		order := NewOrder(rand.Intn(2) == 0, rand.Float64()*100, rand.Int63(), 1)
 		ob.PlaceLimitOrder(price, order)
 	}
 
@@ -223,3 +251,136 @@ func TestOrdersStateUnderLoad(t *testing.T) {
 		t.Errorf("Expected orders count to be %d, got %d", ordersCount, len(orders))
 	}
 }
+
+func TestDepthAggregatesLevels(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(100.0, NewOrder(true, 2, 0, 1))
+	ob.PlaceLimitOrder(100.0, NewOrder(true, 3, 1, 1))
+	ob.PlaceLimitOrder(99.5, NewOrder(true, 1, 0, 1))
+	ob.PlaceLimitOrder(101.0, NewOrder(false, 4, 2, 1))
+	ob.PlaceLimitOrder(102.0, NewOrder(false, 1, 2, 1))
+
+	depth := ob.Depth(1, 0)
+	assert(t, depth.Sequence, uint64(5))
+	assert(t, depth.Bids, []PriceLevel{{Price: 100.0, Size: 5.0, Orders: 2}})
+	assert(t, depth.Asks, []PriceLevel{{Price: 101.0, Size: 4.0, Orders: 1}})
+
+	depth = ob.Depth(0, 0)
+	assert(t, len(depth.Bids), 2)
+	assert(t, len(depth.Asks), 2)
+}
+
+func TestDepthGrouping(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(100.3, NewOrder(true, 1, 0, 1))
+	ob.PlaceLimitOrder(100.7, NewOrder(true, 2, 0, 1))
+	ob.PlaceLimitOrder(99.9, NewOrder(true, 4, 0, 1))
+	ob.PlaceLimitOrder(101.2, NewOrder(false, 1, 1, 1))
+	ob.PlaceLimitOrder(101.8, NewOrder(false, 2, 1, 1))
+	ob.PlaceLimitOrder(102.0, NewOrder(false, 3, 1, 1))
+
+	depth := ob.Depth(0, 1.0)
+	assert(t, depth.Bids, []PriceLevel{
+		{Price: 100.0, Size: 3.0, Orders: 2},
+		{Price: 99.0, Size: 4.0, Orders: 1},
+	})
+	assert(t, depth.Asks, []PriceLevel{
+		{Price: 102.0, Size: 6.0, Orders: 3},
+	})
+
+	depth = ob.Depth(0, 0.1)
+	assert(t, depth.Bids[0].Price, 100.7)
+}
+
+func TestSequenceAdvancesOnChanges(t *testing.T) {
+	ob := NewOrderbook()
+	assert(t, ob.Sequence(), uint64(0))
+
+	order := NewOrder(false, 5, 0, 1)
+	ob.PlaceLimitOrder(100.0, order)
+	assert(t, ob.Sequence(), uint64(1))
+
+	ob.PlaceMarketOrder(NewOrder(true, 1, 1, 1))
+	assert(t, ob.Sequence(), uint64(2))
+
+	ob.CancelOrder(order)
+	assert(t, ob.Sequence(), uint64(3))
+}
+
+type recordingListener struct {
+	updates []BookUpdate
+	trades  []*Trade
+}
+
+func (r *recordingListener) OnBookUpdate(u BookUpdate) { r.updates = append(r.updates, u) }
+func (r *recordingListener) OnTrade(t *Trade)          { r.trades = append(r.trades, t) }
+
+func TestListenerReceivesUpdates(t *testing.T) {
+	ob := NewOrderbook()
+	l := &recordingListener{}
+	ob.SetListener(l)
+
+	sellOrderA := NewOrder(false, 5, 0, 1)
+	sellOrderB := NewOrder(false, 2, 0, 1)
+	ob.PlaceLimitOrder(100.0, sellOrderA)
+	ob.PlaceLimitOrder(101.0, sellOrderB)
+	ob.PlaceMarketOrder(NewOrder(true, 6, 1, 1))
+	ob.CancelOrder(sellOrderB)
+
+	assert(t, len(l.updates), 4)
+	assert(t, l.updates[0].Sequence, uint64(1))
+	assert(t, l.updates[0].Bids, []PriceLevel{})
+	assert(t, l.updates[0].Asks, []PriceLevel{{Price: 100.0, Size: 5.0, Orders: 1}})
+	assert(t, l.updates[2].Sequence, uint64(3))
+	assert(t, l.updates[2].Asks, []PriceLevel{
+		{Price: 100.0, Size: 0.0, Orders: 0},
+		{Price: 101.0, Size: 1.0, Orders: 1},
+	})
+	assert(t, l.updates[3].Asks, []PriceLevel{{Price: 101.0, Size: 0.0, Orders: 0}})
+
+	assert(t, len(l.trades), 2)
+	assert(t, l.trades[0].Size, 5.0)
+	assert(t, l.trades[1].Size, 1.0)
+}
+
+func TestChecksum(t *testing.T) {
+	bids := []PriceLevel{{Price: 99.5, Size: 2}}
+	asks := []PriceLevel{{Price: 100, Size: 1.25}}
+	assert(t, Checksum(bids, asks), crc32.ChecksumIEEE([]byte("99.5:2|100:1.25")))
+
+	ob := NewOrderbook()
+	l := &recordingListener{}
+	ob.SetListener(l)
+
+	ob.PlaceLimitOrder(99.5, NewOrder(true, 2, 0, 1))
+	ob.PlaceLimitOrder(100, NewOrder(false, 1.25, 0, 1))
+
+	depth := ob.Depth(0, 0)
+	assert(t, depth.Checksum, Checksum(bids, asks))
+	assert(t, l.updates[1].Checksum, depth.Checksum)
+
+	// grouping and depth don't change what the checksum covers
+	assert(t, ob.Depth(1, 10).Checksum, depth.Checksum)
+}
+
+func TestMarketOrderPrice(t *testing.T) {
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(100, NewOrder(false, 2, 0, 1))
+	ob.PlaceLimitOrder(110, NewOrder(false, 2, 0, 1))
+
+	price, filled := ob.MarketOrderPrice(true, 3)
+	assert(t, price, 310.0/3)
+	assert(t, filled, 3.0)
+
+	price, filled = ob.MarketOrderPrice(true, 10)
+	assert(t, price, 105.0)
+	assert(t, filled, 4.0)
+
+	_, filled = ob.MarketOrderPrice(false, 1)
+	assert(t, filled, 0.0)
+
+	// nothing was taken off the book
+	assert(t, ob.AskTotalVolume(), 4.0)
+}
@@ -0,0 +1,183 @@
+package price
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Source provides the index price of a market from outside the exchange.
+type Source interface {
+	IndexPrice(market string) (float64, error)
+}
+
+// StaticSource is a Source backed by prices set locally, e.g. from a config
+// file or by a test.
+type StaticSource struct {
+	mu     sync.RWMutex
+	prices map[string]float64
+}
+
+func NewStaticSource(prices map[string]float64) *StaticSource {
+	s := &StaticSource{prices: make(map[string]float64)}
+	for market, p := range prices {
+		s.prices[market] = p
+	}
+	return s
+}
+
+func (s *StaticSource) Set(market string, p float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prices[market] = p
+}
+
+func (s *StaticSource) IndexPrice(market string) (float64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.prices[market]
+	if !ok {
+		return 0, fmt.Errorf("no index price for market %s", market)
+	}
+	return p, nil
+}
+
+type Config struct {
+	// PremiumSmoothing is the EMA weight of the newest premium sample, in (0, 1]
+	PremiumSmoothing float64
+	// MaxPremium caps the smoothed premium as a fraction of the index price
+	MaxPremium float64
+}
+
+func DefaultConfig() Config {
+	return Config{
+		PremiumSmoothing: 0.1,
+		MaxPremium:       0.05,
+	}
+}
+
+// MarketPrice is the price state of a market after an update.
+type MarketPrice struct {
+	Market    string
+	Index     float64
+	Mid       float64
+	Last      float64
+	Premium   float64
+	Mark      float64
+	Timestamp int64
+}
+
+// Service computes the mark price of every market. The mark is the index
+// plus a smoothed and capped premium of the book over the index, and when
+// the book has both a mid and a last trade, the median of those three,
+// capped to the same band around the index as the premium. A single print
+// or a thin book can therefore only drag the mark so far.
+type Service struct {
+	source Source
+	config Config
+
+	mu        sync.RWMutex
+	prices    map[string]MarketPrice
+	premiums  map[string]float64
+	listeners []func(MarketPrice)
+}
+
+func NewService(source Source, config Config) *Service {
+	return &Service{
+		source:   source,
+		config:   config,
+		prices:   make(map[string]MarketPrice),
+		premiums: make(map[string]float64),
+	}
+}
+
+// OnUpdate registers fn to be called after every update of a market's price.
+func (s *Service) OnUpdate(fn func(MarketPrice)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.listeners = append(s.listeners, fn)
+}
+
+// Update feeds the current mid and last trade price of the market (zero when
+// unknown) into the service and returns the new price state.
+func (s *Service) Update(market string, mid, last float64) MarketPrice {
+	index, err := s.source.IndexPrice(market)
+	if err != nil {
+		index = 0
+	}
+
+	s.mu.Lock()
+
+	mp := MarketPrice{
+		Market:    market,
+		Index:     index,
+		Mid:       mid,
+		Last:      last,
+		Timestamp: time.Now().UnixNano(),
+	}
+
+	if index > 0 {
+		premium, seen := s.premiums[market]
+		if mid > 0 {
+			sample := mid - index
+			if !seen {
+				premium = sample
+			} else {
+				premium += s.config.PremiumSmoothing * (sample - premium)
+			}
+		}
+
+		maxPremium := s.config.MaxPremium * index
+		premium = math.Max(-maxPremium, math.Min(maxPremium, premium))
+		s.premiums[market] = premium
+
+		mp.Premium = premium
+		mp.Mark = index + premium
+		if mid > 0 && last > 0 {
+			// mid and last both come from the book, so the median alone
+			// can be dragged anywhere by moving the book and printing once
+			mp.Mark = median(mp.Mark, mid, last)
+			mp.Mark = math.Max(index-maxPremium, math.Min(index+maxPremium, mp.Mark))
+		}
+	} else if mid > 0 {
+		// without an index there is nothing to anchor to but the book
+		mp.Mark = mid
+	} else {
+		mp.Mark = last
+	}
+
+	s.prices[market] = mp
+	listeners := s.listeners
+	s.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(mp)
+	}
+
+	return mp
+}
+
+// Get returns the last computed price state of the market.
+func (s *Service) Get(market string) (MarketPrice, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	mp, ok := s.prices[market]
+	return mp, ok
+}
+
+// Mark returns the last mark price of the market, zero if it has none yet.
+func (s *Service) Mark(market string) float64 {
+	mp, _ := s.Get(market)
+	return mp.Mark
+}
+
+func median(values ...float64) float64 {
+	sort.Float64s(values)
+	return values[len(values)/2]
+}
@@ -0,0 +1,97 @@
+package price
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func assert(t *testing.T, a, b any) {
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func assertClose(t *testing.T, a, b float64) {
+	if math.Abs(a-b) > 1e-9 {
+		t.Errorf("%v != %v", a, b)
+	}
+}
+
+func TestMarkFollowsSmoothedPremium(t *testing.T) {
+	s := NewService(NewStaticSource(map[string]float64{"ETH": 1000}), Config{
+		PremiumSmoothing: 0.5,
+		MaxPremium:       0.05,
+	})
+
+	mp := s.Update("ETH", 1010, 0)
+	assertClose(t, mp.Premium, 10)
+	assertClose(t, mp.Mark, 1010)
+
+	// the premium moves halfway towards the new sample
+	mp = s.Update("ETH", 1030, 0)
+	assertClose(t, mp.Premium, 20)
+	assertClose(t, mp.Mark, 1020)
+	assertClose(t, s.Mark("ETH"), 1020)
+}
+
+func TestMarkCapsPremium(t *testing.T) {
+	s := NewService(NewStaticSource(map[string]float64{"ETH": 1000}), Config{
+		PremiumSmoothing: 1,
+		MaxPremium:       0.05,
+	})
+
+	mp := s.Update("ETH", 2000, 0)
+	assertClose(t, mp.Premium, 50)
+	assertClose(t, mp.Mark, 1050)
+}
+
+func TestMarkIgnoresOutlierTrade(t *testing.T) {
+	s := NewService(NewStaticSource(map[string]float64{"ETH": 1000}), Config{
+		PremiumSmoothing: 1,
+		MaxPremium:       0.05,
+	})
+
+	// a single print far away from the book doesn't move the mark
+	mp := s.Update("ETH", 1002, 5000)
+	assertClose(t, mp.Mark, 1002)
+
+	mp = s.Update("ETH", 1002, 1)
+	assertClose(t, mp.Mark, 1002)
+}
+
+func TestMarkStaysInBandWhenBookIsPushed(t *testing.T) {
+	s := NewService(NewStaticSource(map[string]float64{"ETH": 1000}), Config{
+		PremiumSmoothing: 0.1,
+		MaxPremium:       0.05,
+	})
+
+	// moving the top of book and printing there outvotes the index in the
+	// median, the band around the index still holds
+	mp := s.Update("ETH", 3000, 3000)
+	assertClose(t, mp.Mark, 1050)
+
+	mp = s.Update("ETH", 10, 10)
+	assertClose(t, mp.Mark, 950)
+}
+
+func TestMarkWithoutIndex(t *testing.T) {
+	s := NewService(NewStaticSource(nil), DefaultConfig())
+
+	assertClose(t, s.Update("ETH", 0, 990).Mark, 990)
+	assertClose(t, s.Update("ETH", 1001, 990).Mark, 1001)
+}
+
+func TestOnUpdate(t *testing.T) {
+	src := NewStaticSource(map[string]float64{"ETH": 1000})
+	s := NewService(src, DefaultConfig())
+
+	updates := []MarketPrice{}
+	s.OnUpdate(func(mp MarketPrice) { updates = append(updates, mp) })
+
+	src.Set("ETH", 1100)
+	s.Update("ETH", 0, 0)
+
+	assert(t, len(updates), 1)
+	assertClose(t, updates[0].Mark, 1100)
+}
@@ -0,0 +1,130 @@
+package risk
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/fineas02/matching-engine/margin"
+)
+
+// Scenario moves the mark price of markets by a relative shock, -0.2 is a
+// 20% drop. Markets without a shock keep their mark.
+type Scenario struct {
+	Name   string
+	Shocks map[string]float64
+}
+
+// Shock returns a scenario that moves every one of markets by shock.
+func Shock(shock float64, markets ...string) Scenario {
+	s := Scenario{
+		Name:   fmt.Sprintf("%+.0f%%", shock*100),
+		Shocks: make(map[string]float64, len(markets)),
+	}
+	for _, market := range markets {
+		s.Shocks[market] = shock
+	}
+	return s
+}
+
+// DefaultScenarios moves all markets together up and down by 5, 10, 25 and
+// 50 percent.
+func DefaultScenarios(markets ...string) []Scenario {
+	scenarios := []Scenario{}
+	for _, shock := range []float64{-0.5, -0.25, -0.1, -0.05, 0.05, 0.1, 0.25, 0.5} {
+		scenarios = append(scenarios, Shock(shock, markets...))
+	}
+	return scenarios
+}
+
+// AccountResult is what a scenario does to one account. Shortfall is the
+// loss the account's equity can't cover.
+type AccountResult struct {
+	UserID            int64
+	Equity            float64
+	ProjectedEquity   float64
+	MaintenanceMargin float64
+	Liquidated        bool
+	Positions         []string `json:",omitempty"`
+	Shortfall         float64
+}
+
+// Result is what a scenario does to the exchange. InsuranceShortfall is the
+// part of the accounts' shortfall the insurance fund can't cover, which
+// would have to be auto-deleveraged.
+type Result struct {
+	Scenario           Scenario
+	Equity             float64
+	ProjectedEquity    float64
+	Liquidated         []int64
+	Shortfall          float64
+	InsuranceFund      float64
+	InsuranceShortfall float64
+	Accounts           []AccountResult
+}
+
+// Report holds the result of every scenario.
+type Report struct {
+	Results []Result
+}
+
+// Run applies every scenario to copies of users, leaving them untouched, and
+// reports the projected equity, the accounts that would be liquidated and
+// how much of their shortfall the insurance fund can cover. Only accounts
+// with positions are reported.
+func Run(users []*margin.User, configs map[string]*margin.MarketConfig, insurance float64, scenarios []Scenario) Report {
+	sorted := make([]*margin.User, 0, len(users))
+	for _, user := range users {
+		if len(user.Positions) > 0 {
+			sorted = append(sorted, user)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	report := Report{Results: make([]Result, 0, len(scenarios))}
+	for _, scenario := range scenarios {
+		report.Results = append(report.Results, runScenario(sorted, configs, insurance, scenario))
+	}
+	return report
+}
+
+func runScenario(users []*margin.User, configs map[string]*margin.MarketConfig, insurance float64, scenario Scenario) Result {
+	result := Result{
+		Scenario:      scenario,
+		Liquidated:    []int64{},
+		InsuranceFund: insurance,
+		Accounts:      make([]AccountResult, 0, len(users)),
+	}
+
+	for _, user := range users {
+		shocked := user.Clone()
+		equity := shocked.UpdateEquity()
+		for asset, position := range shocked.Positions {
+			if shock, ok := scenario.Shocks[asset]; ok {
+				shocked.MarkToMarket(asset, position.MarkPrice*(1+shock))
+			}
+		}
+
+		account := AccountResult{
+			UserID:            user.ID,
+			Equity:            equity,
+			ProjectedEquity:   shocked.UpdateEquity(),
+			MaintenanceMargin: shocked.MaintenanceRequirement(configs),
+		}
+		if liquidated := shocked.LiquidatablePositions(configs); len(liquidated) > 0 {
+			account.Liquidated = true
+			account.Positions = liquidated
+			account.Shortfall = shocked.Shortfall()
+			result.Liquidated = append(result.Liquidated, user.ID)
+		}
+
+		result.Equity += account.Equity
+		result.ProjectedEquity += account.ProjectedEquity
+		result.Shortfall += account.Shortfall
+		result.Accounts = append(result.Accounts, account)
+	}
+
+	result.InsuranceShortfall = math.Max(result.Shortfall-math.Max(insurance, 0), 0)
+
+	return result
+}
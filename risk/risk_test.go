@@ -0,0 +1,83 @@
+package risk
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/fineas02/matching-engine/margin"
+)
+
+func assert(t *testing.T, a, b any) {
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func assertClose(t *testing.T, a, b float64) {
+	if math.Abs(a-b) > 1e-9 {
+		t.Errorf("%v != %v", a, b)
+	}
+}
+
+var configs = map[string]*margin.MarketConfig{
+	"ETH": {InitialMarginRequirement: 0.1, MaximumLeverage: 10, MaintenanceMargin: 0.05},
+}
+
+func newUser(id int64, balance, size float64, long bool) *margin.User {
+	u := margin.NewUser(id)
+	u.Balance[margin.SettlementAsset] = balance
+	u.HandleTrade("ETH", size, 100, 10, long)
+	return u
+}
+
+func TestStressScenarios(t *testing.T) {
+	long := newUser(0, 100, 10, true)
+	short := newUser(1, 1000, 10, false)
+	flat := margin.NewUser(2)
+	flat.Balance[margin.SettlementAsset] = 500
+
+	report := Run([]*margin.User{short, flat, long}, configs, 50, []Scenario{
+		Shock(-0.2, "ETH"),
+		Shock(0.05, "ETH"),
+	})
+	assert(t, len(report.Results), 2)
+
+	// a 20% drop wipes out the long, 100 past its balance
+	drop := report.Results[0]
+	assert(t, drop.Scenario.Name, "-20%")
+	assert(t, drop.Liquidated, []int64{0})
+	assert(t, len(drop.Accounts), 2)
+	assertClose(t, drop.Accounts[0].ProjectedEquity, -100)
+	assert(t, drop.Accounts[0].Positions, []string{"ETH"})
+	assertClose(t, drop.Accounts[1].ProjectedEquity, 1200)
+	assertClose(t, drop.Shortfall, 100)
+	assertClose(t, drop.InsuranceShortfall, 50)
+	assertClose(t, drop.Equity, 1100)
+	assertClose(t, drop.ProjectedEquity, 1100)
+
+	// 5% up leaves everyone above maintenance
+	rise := report.Results[1]
+	assert(t, rise.Liquidated, []int64{})
+	assertClose(t, rise.Accounts[0].ProjectedEquity, 150)
+	assertClose(t, rise.InsuranceShortfall, 0)
+
+	// the users themselves are untouched
+	assert(t, long.Position("ETH").MarkPrice, 100.0)
+	assertClose(t, long.Equity, 100)
+}
+
+func TestUnshockedMarketsKeepTheirMark(t *testing.T) {
+	u := newUser(0, 100, 10, true)
+
+	report := Run([]*margin.User{u}, configs, 0, []Scenario{Shock(-0.5, "BTC")})
+	assert(t, report.Results[0].Liquidated, []int64{})
+	assertClose(t, report.Results[0].Accounts[0].ProjectedEquity, 100)
+}
+
+func TestDefaultScenarios(t *testing.T) {
+	scenarios := DefaultScenarios("ETH", "BTC")
+	assert(t, len(scenarios), 8)
+	assert(t, scenarios[0].Name, "-50%")
+	assert(t, scenarios[0].Shocks, map[string]float64{"ETH": -0.5, "BTC": -0.5})
+}
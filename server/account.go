@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/fineas02/matching-engine/price"
+	"github.com/labstack/echo/v4"
+)
+
+// handlePriceUpdate marks every position in the repriced market to the new
+// mark price and samples its premium for funding, or its index for the
+// settlement price of a dated market.
+func (ex *Exchange) handlePriceUpdate(mp price.MarketPrice) {
+	if mp.Mark <= 0 {
+		return
+	}
+
+	if config, ok := ex.MarketConfig[Market(mp.Market)]; ok && config.IsDated() {
+		ex.Expiries.Sample(mp.Market, mp.Index)
+	} else {
+		ex.Funding.Sample(mp.Market, mp.Mark, mp.Index)
+	}
+
+	ex.mu.Lock()
+	for _, user := range ex.Users {
+		user.MarkToMarket(mp.Market, mp.Mark)
+	}
+	ex.mu.Unlock()
+
+	ex.signalLiquidationCheck()
+}
+
+// marginConfigs returns the market configs keyed the way margin expects.
+func (ex *Exchange) marginConfigs() map[string]*margin.MarketConfig {
+	configs := make(map[string]*margin.MarketConfig, len(ex.MarketConfig))
+	for market, config := range ex.MarketConfig {
+		configs[string(market)] = config
+	}
+	return configs
+}
+
+func (ex *Exchange) handleGetAccount(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	user, ok := ex.Users[int64(userID)]
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "user not found"})
+	}
+
+	return c.JSON(http.StatusOK, user.Account(ex.marginConfigs()))
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	adminKeyHeader = "X-Admin-Key"
+	apiKeyHeader   = "X-API-Key"
+)
+
+// requireAdmin only lets requests through that carry the exchange admin key.
+func (ex *Exchange) requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(adminKeyHeader)
+		if ex.AdminKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(ex.AdminKey)) != 1 {
+			return c.JSON(http.StatusUnauthorized, APIError{Error: "admin key required"})
+		}
+		return next(c)
+	}
+}
+
+// APIKeyResponse hands out a newly issued api key. It is only ever shown
+// once, the exchange only logs its fingerprint.
+type APIKeyResponse struct {
+	UserID int64
+	APIKey string
+}
+
+// SetAPIKey assigns key to the user, replacing any key it had before.
+func (ex *Exchange) SetAPIKey(userID int64, key string) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	for k, id := range ex.apiKeys {
+		if id == userID {
+			delete(ex.apiKeys, k)
+		}
+	}
+	ex.apiKeys[key] = userID
+}
+
+// authenticate resolves the api key of the request to a user. Browsers can't
+// set headers on a websocket handshake, so the key is also read from ?key=.
+func (ex *Exchange) authenticate(c echo.Context) (int64, bool) {
+	key := c.Request().Header.Get(apiKeyHeader)
+	if key == "" {
+		key = c.QueryParam("key")
+	}
+	if key == "" {
+		return 0, false
+	}
+
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	userID, ok := ex.apiKeys[key]
+	return userID, ok
+}
+
+// keyFingerprint identifies an api key in logs without revealing it: a
+// short prefix of its hash.
+func keyFingerprint(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// issueAPIKey gives the user a new random api key, replacing any key it had
+// before.
+func (ex *Exchange) issueAPIKey(userID int64) (string, error) {
+	key, err := newAPIKey()
+	if err != nil {
+		return "", err
+	}
+	ex.SetAPIKey(userID, key)
+	return key, nil
+}
+
+// handleIssueAPIKey creates or rotates the api key of a user and returns it.
+// The old key stops working right away.
+func (ex *Exchange) handleIssueAPIKey(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+
+	ex.mu.RLock()
+	_, ok := ex.Users[int64(userID)]
+	ex.mu.RUnlock()
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "user not found"})
+	}
+
+	key, err := ex.issueAPIKey(int64(userID))
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"userID":            userID,
+		"apiKeyFingerprint": keyFingerprint(key),
+	}).Info("api key issued")
+
+	return c.JSON(http.StatusOK, APIKeyResponse{UserID: int64(userID), APIKey: key})
+}
+
+func newAPIKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
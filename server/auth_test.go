@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// serve runs handler on a request with a JSON body and the given path
+// parameters, as name and value pairs.
+func serve(t *testing.T, handler echo.HandlerFunc, method, body string, header http.Header, params ...string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, "/", r)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	rec := httptest.NewRecorder()
+
+	names, values := []string{}, []string{}
+	for i := 0; i+1 < len(params); i += 2 {
+		names = append(names, params[i])
+		values = append(values, params[i+1])
+	}
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames(names...)
+	c.SetParamValues(values...)
+	assert(t, handler(c), nil)
+	return rec
+}
+
+// issueKey has the admin issue a new api key for the user.
+func issueKey(t *testing.T, ex *Exchange, userID string) string {
+	t.Helper()
+
+	header := http.Header{adminKeyHeader: {ex.AdminKey}}
+	rec := serve(t, ex.requireAdmin(ex.handleIssueAPIKey), http.MethodPost, "", header, "userID", userID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("issue api key: %d %s", rec.Code, rec.Body)
+	}
+
+	resp := APIKeyResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.APIKey
+}
+
+// withKey returns the headers of a request authenticated with key.
+func withKey(key string) http.Header {
+	return http.Header{apiKeyHeader: {key}}
+}
+
+func TestIssuedKeyAuthenticates(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 0})
+	ex.AdminKey = "admin"
+
+	issue := ex.requireAdmin(ex.handleIssueAPIKey)
+	assert(t, serve(t, issue, http.MethodPost, "", nil, "userID", "1").Code, http.StatusUnauthorized)
+	assert(t, serve(t, issue, http.MethodPost, "", http.Header{adminKeyHeader: {"admin"}}, "userID", "2").Code, http.StatusNotFound)
+
+	key := issueKey(t, ex, "1")
+	assert(t, len(key), 32)
+
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/ws/user?key="+key, nil), httptest.NewRecorder())
+	userID, ok := ex.authenticate(c)
+	assert(t, ok, true)
+	assert(t, userID, int64(1))
+
+	// rotating the key retires the old one
+	rotated := issueKey(t, ex, "1")
+	assert(t, rotated != key, true)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(apiKeyHeader, key)
+	_, ok = ex.authenticate(echo.New().NewContext(req, httptest.NewRecorder()))
+	assert(t, ok, false)
+
+	req.Header.Set(apiKeyHeader, rotated)
+	userID, ok = ex.authenticate(echo.New().NewContext(req, httptest.NewRecorder()))
+	assert(t, ok, true)
+	assert(t, userID, int64(1))
+}
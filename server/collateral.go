@@ -0,0 +1,160 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/fineas02/matching-engine/ledger"
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultCollateralPrices are the prices collateral starts out at, in the
+// settlement asset, until they are set through the admin endpoint or
+// CollateralPrices is replaced by a live source.
+var defaultCollateralPrices = map[string]float64{
+	"USDC":  0.0004,
+	"USDT":  0.0004,
+	"WPUNK": 30,
+}
+
+type (
+	// CollateralAsset is an asset accepted as collateral and what it
+	// currently counts for.
+	CollateralAsset struct {
+		Asset   string
+		Price   float64
+		Haircut float64
+	}
+
+	// CollateralPriceRequest sets the price of a collateral asset in the
+	// settlement asset.
+	CollateralPriceRequest struct {
+		Asset string
+		Price float64
+	}
+)
+
+// priceSetter is a collateral price source whose prices are set by hand,
+// like price.StaticSource.
+type priceSetter interface {
+	Set(market string, p float64)
+}
+
+// defaultCollateralConfig returns the haircuts of the accepted collateral,
+// stablecoins lose little, wrapped NFTs half their value.
+func defaultCollateralConfig() map[string]*margin.CollateralConfig {
+	return map[string]*margin.CollateralConfig{
+		"USDC":  {Haircut: 0.02},
+		"USDT":  {Haircut: 0.05},
+		"WPUNK": {Haircut: 0.5},
+	}
+}
+
+// markCollateral values the user's collateral at the current collateral
+// prices. Assets without a price keep their last one. Must be called with
+// ex.mu held.
+func (ex *Exchange) markCollateral(user *margin.User) {
+	for asset, config := range ex.CollateralConfig {
+		p, err := ex.CollateralPrices.IndexPrice(asset)
+		if err != nil {
+			continue
+		}
+		user.MarkCollateral(asset, p, config)
+	}
+	user.UpdateEquity()
+}
+
+// revalueCollateral marks the collateral of every user to the current prices
+// and has the accounts checked, since a falling price can take them below
+// maintenance.
+func (ex *Exchange) revalueCollateral() {
+	ex.mu.Lock()
+	for _, user := range ex.Users {
+		ex.markCollateral(user)
+	}
+	ex.mu.Unlock()
+
+	ex.signalLiquidationCheck()
+}
+
+// coverDeficit sells the user's collateral, riskiest first, to bring a
+// negative settlement balance back to zero.
+func (ex *Exchange) coverDeficit(userID int64) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	user, ok := ex.Users[userID]
+	if !ok {
+		return
+	}
+
+	ex.markCollateral(user)
+	sales := user.LiquidateCollateral()
+	for _, sale := range sales {
+		postings := ledger.Transfer(ledger.UserAccount(userID), ledger.AccountExternal, sale.Asset, sale.Amount)
+		postings = append(postings, ledger.Transfer(ledger.AccountExternal, ledger.UserAccount(userID), margin.SettlementAsset, sale.Proceeds)...)
+		ex.post(ledger.EntryCollateral, fmt.Sprintf("collateral:%d", userID), postings...)
+
+		logrus.WithFields(logrus.Fields{
+			"userID":   userID,
+			"asset":    sale.Asset,
+			"amount":   sale.Amount,
+			"price":    sale.Price,
+			"haircut":  sale.Haircut,
+			"proceeds": sale.Proceeds,
+		}).Warn("sold collateral to cover negative balance")
+	}
+
+	if len(sales) > 0 {
+		ex.publishBalance(user)
+	}
+}
+
+func (ex *Exchange) handleGetCollateral(c echo.Context) error {
+	assets := []CollateralAsset{}
+	for asset, config := range ex.CollateralConfig {
+		p, _ := ex.CollateralPrices.IndexPrice(asset)
+		assets = append(assets, CollateralAsset{
+			Asset:   asset,
+			Price:   p,
+			Haircut: config.Haircut,
+		})
+	}
+	sort.Slice(assets, func(i, j int) bool { return assets[i].Asset < assets[j].Asset })
+
+	return c.JSON(http.StatusOK, assets)
+}
+
+// handleSetCollateralPrice sets the price of a collateral asset and revalues
+// the collateral of every user at it. It only works while the prices aren't
+// taken from a live source.
+func (ex *Exchange) handleSetCollateralPrice(c echo.Context) error {
+	req := new(CollateralPriceRequest)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+	if _, ok := ex.CollateralConfig[req.Asset]; !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "unsupported collateral asset"})
+	}
+	if req.Price <= 0 || math.IsInf(req.Price, 0) || math.IsNaN(req.Price) {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid price"})
+	}
+
+	source, ok := ex.CollateralPrices.(priceSetter)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "collateral prices come from a live source"})
+	}
+	source.Set(req.Asset, req.Price)
+	ex.revalueCollateral()
+
+	logrus.WithFields(logrus.Fields{
+		"asset": req.Asset,
+		"price": req.Price,
+	}).Info("collateral price set")
+
+	return c.JSON(http.StatusOK, req)
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fineas02/matching-engine/ledger"
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/labstack/echo/v4"
+)
+
+func setCollateralPrice(t *testing.T, ex *Exchange, key, body string) int {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/collateral/price", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(adminKeyHeader, key)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	assert(t, ex.requireAdmin(ex.handleSetCollateralPrice)(c), nil)
+	return rec.Code
+}
+
+func TestSetCollateralPriceRevalues(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 0})
+	ex.AdminKey = "admin"
+	assert(t, ex.fundUser(1, "WPUNK", 2), nil)
+	assertClose(t, ex.Users[1].CollateralValue(), 2*30*0.5)
+
+	assert(t, setCollateralPrice(t, ex, "", `{"Asset": "WPUNK", "Price": 10}`), http.StatusUnauthorized)
+	assert(t, setCollateralPrice(t, ex, "admin", `{"Asset": "DOGE", "Price": 10}`), http.StatusBadRequest)
+	assert(t, setCollateralPrice(t, ex, "admin", `{"Asset": "WPUNK", "Price": 0}`), http.StatusBadRequest)
+	assertClose(t, ex.Users[1].CollateralValue(), 2*30*0.5)
+
+	assert(t, setCollateralPrice(t, ex, "admin", `{"Asset": "WPUNK", "Price": 10}`), http.StatusOK)
+	assertClose(t, ex.Users[1].CollateralValue(), 2*10*0.5)
+
+	// a live source can't be overridden by hand
+	ex.CollateralPrices = priceFunc(func(string) (float64, error) { return 10, nil })
+	assert(t, setCollateralPrice(t, ex, "admin", `{"Asset": "WPUNK", "Price": 20}`), http.StatusBadRequest)
+}
+
+func TestCoverDeficitSellsAtHaircut(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 0})
+	assert(t, ex.fundUser(1, "WPUNK", 2), nil)
+
+	ex.mu.Lock()
+	ex.Users[1].Balance[margin.SettlementAsset] -= 20
+	ex.post(ledger.EntryTrade, "loss",
+		ledger.Transfer(ledger.UserAccount(1), ledger.AccountPnL, margin.SettlementAsset, 20)...)
+	ex.mu.Unlock()
+
+	// a punk marked at 30 only fetches 15 after its haircut
+	ex.coverDeficit(1)
+	user := ex.Users[1]
+	assertClose(t, user.Balance[margin.SettlementAsset], 0)
+	assertClose(t, user.Balance["WPUNK"], 2-20.0/15)
+	assertLedger(t, ex)
+}
+
+// priceFunc is a price.Source backed by a function.
+type priceFunc func(market string) (float64, error)
+
+func (f priceFunc) IndexPrice(market string) (float64, error) { return f(market) }
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/fineas02/matching-engine/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultDepth = 20
+	maxDepth     = 500
+)
+
+type DepthResponse struct {
+	Market   Market
+	Sequence uint64
+	Checksum uint32
+	Bids     []orderbook.PriceLevel
+	Asks     []orderbook.PriceLevel
+}
+
+// handleGetDepth serves the aggregated (L2) view of a book. It takes an
+// optional depth (levels per side) and group (price bucket size) query param.
+func (ex *Exchange) handleGetDepth(c echo.Context) error {
+	market := Market(c.Param("market"))
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	depth := defaultDepth
+	if v := c.QueryParam("depth"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d <= 0 || d > maxDepth {
+			return c.JSON(http.StatusBadRequest, APIError{Error: "invalid depth"})
+		}
+		depth = d
+	}
+
+	grouping := 0.0
+	if v := c.QueryParam("group"); v != "" {
+		g, err := strconv.ParseFloat(v, 64)
+		if err != nil || g <= 0 {
+			return c.JSON(http.StatusBadRequest, APIError{Error: "invalid group"})
+		}
+		grouping = g
+	}
+
+	snapshot := ob.Depth(depth, grouping)
+
+	return c.JSON(http.StatusOK, DepthResponse{
+		Market:   market,
+		Sequence: snapshot.Sequence,
+		Checksum: snapshot.Checksum,
+		Bids:     snapshot.Bids,
+		Asks:     snapshot.Asks,
+	})
+}
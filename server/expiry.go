@@ -0,0 +1,174 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/fineas02/matching-engine/expiry"
+	"github.com/fineas02/matching-engine/fees"
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/fineas02/matching-engine/orderbook"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	UserEventSettlement = "settlement"
+
+	expiryCheckInterval = time.Second
+)
+
+// ContractResponse describes the contract of a market. Dated markets carry
+// their expiry, when they turn cancel-only and, once settled, their
+// settlement.
+type ContractResponse struct {
+	Market       Market
+	ContractType string
+	Status       string
+	Expiry       int64              `json:",omitempty"`
+	CancelOnlyAt int64              `json:",omitempty"`
+	Settlement   *expiry.Settlement `json:",omitempty"`
+}
+
+// AddMarket lists a new market. A dated market settles at its expiry, its
+// index source has to price it by the index it tracks, e.g. the floor of an
+// NFT collection. Markets are meant to be added before the exchange starts.
+func (ex *Exchange) AddMarket(market Market, config *margin.MarketConfig) error {
+	if _, ok := ex.orderbooks[market]; ok {
+		return fmt.Errorf("market %s already exists", market)
+	}
+
+	if config.IsDated() {
+		if err := ex.Expiries.Add(expiry.Contract{Market: string(market), Expiry: config.Expiry}); err != nil {
+			return err
+		}
+	}
+
+	ob := orderbook.NewOrderbook()
+	ex.orderbooks[market] = ob
+	ex.feeds[market] = newMarketFeed(market, ob)
+	ex.MarketConfig[market] = config
+	ex.Fees.SetSchedule(string(market), fees.DefaultSchedule())
+
+	return nil
+}
+
+// checkMarketOpen fails when the market doesn't take new orders anymore.
+func (ex *Exchange) checkMarketOpen(market Market) error {
+	switch status := ex.Expiries.Status(string(market)); status {
+	case expiry.StatusActive:
+		return nil
+	case expiry.StatusCancelOnly:
+		return fmt.Errorf("market %s is cancel-only until it expires", market)
+	default:
+		return fmt.Errorf("market %s has expired", market)
+	}
+}
+
+// runExpiries settles dated markets as they expire.
+func (ex *Exchange) runExpiries(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ex.settleExpiries()
+	}
+}
+
+// settleExpiries pulls the orders of every market that expired and settles
+// its positions at the settlement price. The market is archived afterwards
+// and takes no orders anymore.
+func (ex *Exchange) settleExpiries() {
+	settlements := ex.Expiries.Settle()
+	if len(settlements) == 0 {
+		return
+	}
+
+	for _, settlement := range settlements {
+		market := Market(settlement.Market)
+		ob := ex.orderbooks[market]
+		for _, order := range ob.GetAllOrders() {
+			ex.cancelBookOrder(ob, order, "market expired")
+		}
+
+		ex.mu.Lock()
+		ex.settlePositions(settlement)
+		ex.mu.Unlock()
+
+		logrus.WithFields(logrus.Fields{
+			"market":  settlement.Market,
+			"price":   settlement.Price,
+			"samples": settlement.Samples,
+		}).Info("market settled")
+	}
+
+	ex.signalLiquidationCheck()
+}
+
+// settlePositions closes every position in the market at the settlement
+// price and books the PnL into the balances. Must be called with ex.mu held.
+func (ex *Exchange) settlePositions(settlement expiry.Settlement) {
+	// go in user order so the settlement is deterministic
+	userIDs := make([]int64, 0, len(ex.Users))
+	for id := range ex.Users {
+		userIDs = append(userIDs, id)
+	}
+	sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+
+	for _, id := range userIDs {
+		user := ex.Users[id]
+		position, ok := user.Positions[settlement.Market]
+		if !ok {
+			continue
+		}
+
+		long := position.Side == margin.SideLong
+		fill := &Fill{
+			Market: Market(settlement.Market),
+			Bid:    !long,
+			Price:  settlement.Price,
+			Size:   position.Size,
+		}
+
+		pnl := user.HandleTrade(settlement.Market, position.Size, settlement.Price, position.Leverage, !long)
+		ex.postRealizedPNL(user, settlementReference(settlement), pnl)
+		ex.coverIsolatedDeficit(user, Market(settlement.Market), settlementReference(settlement))
+		ex.recordTrade(user.ID, Market(settlement.Market), settlementReference(settlement), !long, settlement.Price, fill.Size, 0, pnl)
+
+		ex.userStreams.publish(user.ID, UserEvent{
+			Type: UserEventSettlement,
+			Fill: fill,
+		})
+		ex.publishPosition(user, settlement.Market)
+		ex.publishBalance(user)
+	}
+}
+
+func settlementReference(settlement expiry.Settlement) string {
+	return fmt.Sprintf("settlement:%s:%d", settlement.Market, settlement.Expiry)
+}
+
+func (ex *Exchange) handleGetContract(c echo.Context) error {
+	market := Market(c.Param("market"))
+	if _, ok := ex.MarketConfig[market]; !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	resp := ContractResponse{
+		Market:       market,
+		ContractType: margin.ContractPerpetual,
+		Status:       ex.Expiries.Status(string(market)),
+	}
+	if contract, ok := ex.Expiries.Contract(string(market)); ok {
+		resp.ContractType = margin.ContractDated
+		resp.Expiry = contract.Expiry.UnixNano()
+		resp.CancelOnlyAt = contract.Expiry.Add(-ex.Expiries.Config().CancelOnly).UnixNano()
+	}
+	if settlement, ok := ex.Expiries.Settlement(string(market)); ok {
+		resp.Settlement = &settlement
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fineas02/matching-engine/orderbook"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ChannelBook   = "book"
+	ChannelTrades = "trades"
+
+	MessageSnapshot   = "snapshot"
+	MessageUpdate     = "update"
+	MessageTrade      = "trade"
+	MessageSubscribed = "subscribed"
+	MessageError      = "error"
+
+	feedSendBuffer   = 256
+	feedWriteTimeout = 10 * time.Second
+	feedPingInterval = 30 * time.Second
+)
+
+type (
+	// FeedRequest is sent by clients over the websocket to manage subscriptions.
+	FeedRequest struct {
+		Op      string // "subscribe" or "unsubscribe"
+		Channel string
+		Market  Market
+	}
+
+	// FeedMessage is pushed to clients over the websocket. Book messages carry
+	// the orderbook sequence, so an update is only valid on top of the
+	// snapshot or update with Sequence-1. Trade messages carry their own
+	// per market sequence.
+	FeedMessage struct {
+		Channel  string
+		Type     string
+		Market   Market
+		Sequence uint64
+		Checksum uint32
+		Bids     []orderbook.PriceLevel `json:",omitempty"`
+		Asks     []orderbook.PriceLevel `json:",omitempty"`
+		Trade    *orderbook.Trade       `json:",omitempty"`
+		Error    string                 `json:",omitempty"`
+	}
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// feedConn is a single websocket client. Messages are queued on send and
+// written by writeLoop, so publishers never block on a slow socket.
+type feedConn struct {
+	ws   *websocket.Conn
+	send chan []byte
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newFeedConn(ws *websocket.Conn) *feedConn {
+	return &feedConn{
+		ws:   ws,
+		send: make(chan []byte, feedSendBuffer),
+		done: make(chan struct{}),
+	}
+}
+
+// enqueue queues msg for writing. A client that can't keep up is dropped,
+// it will notice the gap on reconnect and re-sync from a snapshot.
+func (fc *feedConn) enqueue(msg []byte) {
+	select {
+	case <-fc.done:
+	case fc.send <- msg:
+	default:
+		logrus.Warn("dropping slow feed client")
+		fc.close()
+	}
+}
+
+func (fc *feedConn) enqueueJSON(v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	fc.enqueue(b)
+}
+
+func (fc *feedConn) close() {
+	fc.closeOnce.Do(func() {
+		close(fc.done)
+		fc.ws.Close()
+	})
+}
+
+func (fc *feedConn) writeLoop() {
+	ticker := time.NewTicker(feedPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fc.done:
+			return
+		case msg := <-fc.send:
+			fc.ws.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+			if err := fc.ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+				fc.close()
+				return
+			}
+		case <-ticker.C:
+			fc.ws.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+			if err := fc.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				fc.close()
+				return
+			}
+		}
+	}
+}
+
+type bookSub struct {
+	// pending is set until the snapshot has been sent, updates published in
+	// the meantime are buffered so none get lost or arrive before it.
+	pending bool
+	buffer  []orderbook.BookUpdate
+}
+
+// marketFeed fans out the changes of a single orderbook to its subscribers.
+type marketFeed struct {
+	market Market
+	ob     *orderbook.Orderbook
+
+	mu       sync.Mutex
+	tradeSeq uint64
+	book     map[*feedConn]*bookSub
+	trades   map[*feedConn]bool
+}
+
+func newMarketFeed(market Market, ob *orderbook.Orderbook) *marketFeed {
+	f := &marketFeed{
+		market: market,
+		ob:     ob,
+		book:   make(map[*feedConn]*bookSub),
+		trades: make(map[*feedConn]bool),
+	}
+	ob.SetListener(f)
+
+	return f
+}
+
+func (f *marketFeed) OnBookUpdate(u orderbook.BookUpdate) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var msg []byte
+	for conn, sub := range f.book {
+		if sub.pending {
+			sub.buffer = append(sub.buffer, u)
+			continue
+		}
+		if msg == nil {
+			msg = f.marshalUpdate(u)
+		}
+		conn.enqueue(msg)
+	}
+}
+
+func (f *marketFeed) OnTrade(t *orderbook.Trade) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tradeSeq++
+	if len(f.trades) == 0 {
+		return
+	}
+
+	msg, err := json.Marshal(FeedMessage{
+		Channel:  ChannelTrades,
+		Type:     MessageTrade,
+		Market:   f.market,
+		Sequence: f.tradeSeq,
+		Trade:    t,
+	})
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+
+	for conn := range f.trades {
+		conn.enqueue(msg)
+	}
+}
+
+func (f *marketFeed) marshalUpdate(u orderbook.BookUpdate) []byte {
+	msg, err := json.Marshal(FeedMessage{
+		Channel:  ChannelBook,
+		Type:     MessageUpdate,
+		Market:   f.market,
+		Sequence: u.Sequence,
+		Checksum: u.Checksum,
+		Bids:     u.Bids,
+		Asks:     u.Asks,
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+	return msg
+}
+
+// subscribeBook sends conn a full snapshot of the book followed by every
+// update after it.
+func (f *marketFeed) subscribeBook(conn *feedConn) {
+	f.mu.Lock()
+	if _, ok := f.book[conn]; ok {
+		f.mu.Unlock()
+		return
+	}
+	sub := &bookSub{pending: true}
+	f.book[conn] = sub
+	f.mu.Unlock()
+
+	snapshot := f.ob.Depth(0, 0)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	conn.enqueueJSON(FeedMessage{
+		Channel:  ChannelBook,
+		Type:     MessageSnapshot,
+		Market:   f.market,
+		Sequence: snapshot.Sequence,
+		Checksum: snapshot.Checksum,
+		Bids:     snapshot.Bids,
+		Asks:     snapshot.Asks,
+	})
+
+	for _, u := range sub.buffer {
+		if u.Sequence > snapshot.Sequence {
+			conn.enqueue(f.marshalUpdate(u))
+		}
+	}
+	sub.pending = false
+	sub.buffer = nil
+}
+
+func (f *marketFeed) subscribeTrades(conn *feedConn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.trades[conn] = true
+	conn.enqueueJSON(FeedMessage{
+		Channel:  ChannelTrades,
+		Type:     MessageSubscribed,
+		Market:   f.market,
+		Sequence: f.tradeSeq,
+	})
+}
+
+func (f *marketFeed) unsubscribe(conn *feedConn, channel string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if channel == "" || channel == ChannelBook {
+		delete(f.book, conn)
+	}
+	if channel == "" || channel == ChannelTrades {
+		delete(f.trades, conn)
+	}
+}
+
+// handleFeed upgrades the request to a websocket and serves market data
+// subscriptions on it until the client goes away.
+func (ex *Exchange) handleFeed(c echo.Context) error {
+	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return err
+	}
+
+	conn := newFeedConn(ws)
+	go conn.writeLoop()
+
+	defer func() {
+		for _, f := range ex.feeds {
+			f.unsubscribe(conn, "")
+		}
+		conn.close()
+	}()
+
+	for {
+		req := FeedRequest{}
+		if err := ws.ReadJSON(&req); err != nil {
+			return nil
+		}
+
+		f, ok := ex.feeds[req.Market]
+		if !ok {
+			conn.enqueueJSON(FeedMessage{Type: MessageError, Market: req.Market, Error: "market not found"})
+			continue
+		}
+
+		switch {
+		case req.Op == "subscribe" && req.Channel == ChannelBook:
+			f.subscribeBook(conn)
+		case req.Op == "subscribe" && req.Channel == ChannelTrades:
+			f.subscribeTrades(conn)
+		case req.Op == "unsubscribe":
+			f.unsubscribe(conn, req.Channel)
+		default:
+			conn.enqueueJSON(FeedMessage{Type: MessageError, Channel: req.Channel, Market: req.Market, Error: "invalid request"})
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/fineas02/matching-engine/fees"
+	"github.com/fineas02/matching-engine/ledger"
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// FeeAccount is where the exchange keeps the fees it charges. Collected
+	// is every fee paid, Rebates every maker rebate paid out of it, Markets
+	// the net of both per market.
+	FeeAccount struct {
+		Balance   float64
+		Collected float64
+		Rebates   float64
+		Markets   map[Market]float64
+	}
+
+	UserFeesResponse struct {
+		UserID   int64
+		Volume   float64
+		Override bool
+		Rates    map[Market]fees.Rates
+	}
+
+	FeeOverrideRequest struct {
+		UserID int64
+		Maker  float64
+		Taker  float64
+	}
+)
+
+// chargeFee moves the fee of a fill of the order from the user to the fee
+// account, or from the fee account to the user when it is a rebate. Must be
+// called with ex.mu held.
+func (ex *Exchange) chargeFee(market Market, user *margin.User, orderID int64, fee float64) {
+	if fee == 0 {
+		return
+	}
+
+	user.Balance[margin.SettlementAsset] -= fee
+	user.Fees += fee
+	user.UpdateEquity()
+	ex.post(ledger.EntryFee, orderReference(orderID),
+		ledger.Transfer(ledger.UserAccount(user.ID), ledger.AccountFees, margin.SettlementAsset, fee)...)
+
+	if ex.FeeAccount.Markets == nil {
+		ex.FeeAccount.Markets = make(map[Market]float64)
+	}
+	ex.FeeAccount.Balance += fee
+	ex.FeeAccount.Markets[market] += fee
+	if fee > 0 {
+		ex.FeeAccount.Collected += fee
+	} else {
+		ex.FeeAccount.Rebates -= fee
+	}
+}
+
+func (ex *Exchange) handleGetFeeAccount(c echo.Context) error {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	account := ex.FeeAccount
+	account.Markets = make(map[Market]float64, len(ex.FeeAccount.Markets))
+	for market, amount := range ex.FeeAccount.Markets {
+		account.Markets[market] = amount
+	}
+
+	return c.JSON(http.StatusOK, account)
+}
+
+func (ex *Exchange) handleGetUserFees(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+
+	ex.mu.RLock()
+	_, ok := ex.Users[int64(userID)]
+	ex.mu.RUnlock()
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "user not found"})
+	}
+
+	markets := make([]Market, 0, len(ex.orderbooks))
+	for market := range ex.orderbooks {
+		markets = append(markets, market)
+	}
+	sort.Slice(markets, func(i, j int) bool { return markets[i] < markets[j] })
+
+	resp := UserFeesResponse{
+		UserID:   int64(userID),
+		Volume:   ex.Fees.Volume(int64(userID)),
+		Override: ex.Fees.HasOverride(int64(userID)),
+		Rates:    make(map[Market]fees.Rates, len(markets)),
+	}
+	for _, market := range markets {
+		resp.Rates[market] = ex.Fees.Rates(string(market), int64(userID))
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (ex *Exchange) handleSetFeeOverride(c echo.Context) error {
+	req := new(FeeOverrideRequest)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	ex.mu.RLock()
+	_, ok := ex.Users[req.UserID]
+	ex.mu.RUnlock()
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "user not found"})
+	}
+
+	ex.Fees.SetOverride(req.UserID, fees.Rates{Maker: req.Maker, Taker: req.Taker})
+
+	return c.JSON(http.StatusOK, map[string]any{"msg": "fee override set"})
+}
+
+func (ex *Exchange) handleClearFeeOverride(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+
+	ex.Fees.ClearOverride(int64(userID))
+
+	return c.JSON(http.StatusOK, map[string]any{"msg": "fee override cleared"})
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/fineas02/matching-engine/funding"
+	"github.com/fineas02/matching-engine/ledger"
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const fundingCheckInterval = time.Second
+
+type (
+	// FundingPayment is what a user paid on one position at a funding time,
+	// Amount is negative when the user received funding.
+	FundingPayment struct {
+		Market    Market
+		Rate      float64
+		MarkPrice float64
+		Size      float64
+		Amount    float64
+		Timestamp int64
+	}
+
+	FundingResponse struct {
+		Market        Market
+		PredictedRate float64
+		NextFunding   int64
+		History       []funding.Rate
+	}
+)
+
+// runFunding pays funding whenever a market reaches its funding time.
+func (ex *Exchange) runFunding(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ex.settleFunding()
+	}
+}
+
+// settleFunding moves the funding of every market that is due between its
+// longs and shorts.
+func (ex *Exchange) settleFunding() {
+	rates := ex.Funding.Settle()
+	if len(rates) == 0 {
+		return
+	}
+
+	ex.mu.Lock()
+	for _, rate := range rates {
+		ex.applyFunding(rate)
+	}
+	ex.mu.Unlock()
+
+	ex.signalLiquidationCheck()
+}
+
+// applyFunding pays rate on every open position in its market. Must be
+// called with ex.mu held.
+func (ex *Exchange) applyFunding(rate funding.Rate) {
+	// go in user order so the payments are deterministic
+	userIDs := make([]int64, 0, len(ex.Users))
+	for id := range ex.Users {
+		userIDs = append(userIDs, id)
+	}
+	sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+
+	for _, id := range userIDs {
+		user := ex.Users[id]
+		position := user.Position(rate.Market)
+		if position.Size == 0 {
+			continue
+		}
+
+		amount := user.ApplyFunding(rate.Market, rate.Rate, rate.MarkPrice)
+		ex.post(ledger.EntryFunding, fmt.Sprintf("funding:%s:%d", rate.Market, rate.Timestamp),
+			ledger.Transfer(ledger.UserAccount(user.ID), ledger.AccountFunding, margin.SettlementAsset, amount)...)
+
+		ex.userStreams.publish(user.ID, UserEvent{
+			Type: UserEventFunding,
+			Funding: &FundingPayment{
+				Market:    Market(rate.Market),
+				Rate:      rate.Rate,
+				MarkPrice: rate.MarkPrice,
+				Size:      position.Size,
+				Amount:    amount,
+				Timestamp: rate.Timestamp,
+			},
+		})
+		ex.publishBalance(user)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"market":    rate.Market,
+		"rate":      rate.Rate,
+		"markPrice": rate.MarkPrice,
+	}).Info("funding paid")
+}
+
+func (ex *Exchange) handleGetFunding(c echo.Context) error {
+	market := Market(c.Param("market"))
+	if _, ok := ex.orderbooks[market]; !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	return c.JSON(http.StatusOK, FundingResponse{
+		Market:        market,
+		PredictedRate: ex.Funding.Predicted(string(market)),
+		NextFunding:   ex.Funding.NextFunding(string(market)).UnixNano(),
+		History:       ex.Funding.History(string(market)),
+	})
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/fineas02/matching-engine/ledger"
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	UserEventAutoDeleverage = "auto_deleverage"
+
+	// liquidationFeeRate is the share of a liquidation's notional the
+	// insurance fund takes, as long as the fill left that much above the
+	// bankruptcy price.
+	liquidationFeeRate = 0.01
+)
+
+type (
+	// InsuranceFund absorbs liquidations. It takes a fee out of those that
+	// fill better than the bankruptcy price and pays the loss of those that
+	// fill worse.
+	InsuranceFund struct {
+		Balance float64
+		History []InsuranceFundEntry
+	}
+
+	InsuranceFundEntry struct {
+		LiquidationID int64
+		UserID        int64
+		Market        Market
+		Amount        float64
+		Balance       float64
+		Timestamp     int64
+	}
+
+	// ADLRank is where a position sits in the auto-deleveraging queue of its
+	// market and side. Rank 1 is deleveraged first, zero means the position
+	// isn't in the queue because it isn't in profit.
+	ADLRank struct {
+		Market    Market
+		Side      string
+		Score     float64
+		Rank      int
+		QueueSize int
+	}
+
+	adlEntry struct {
+		user     *margin.User
+		position *margin.Position
+		score    float64
+	}
+)
+
+// settleLiquidation moves the difference between the fill and the bankruptcy
+// price between the user and the insurance fund. A positive surplus means
+// the fill was better than bankruptcy. The loss of an isolated position is
+// covered into its own margin, or by coverIsolatedDeficit once it is closed.
+// Must be called with ex.mu held.
+func (ex *Exchange) settleLiquidation(user *margin.User, event *LiquidationEvent, surplus float64) {
+	asset := string(event.Market)
+	isolated := user.MarginMode(asset) == margin.MarginIsolated
+	position, open := user.Positions[asset]
+
+	amount := 0.0
+	if surplus > 0 {
+		amount = math.Min(surplus, liquidationFeeRate*event.Size*event.Price)
+	} else if !isolated || open {
+		// the fund can't pay out more than it has, whatever is left stays
+		// with the user as a negative balance
+		amount = -math.Min(-surplus, math.Max(ex.Insurance.Balance, 0))
+	}
+	if amount == 0 {
+		return
+	}
+
+	if isolated && open && amount < 0 {
+		position.IsolatedMargin -= amount
+	} else {
+		user.Balance[margin.SettlementAsset] -= amount
+	}
+	user.UpdateEquity()
+	ex.post(ledger.EntryLiquidation, liquidationReference(event.ID),
+		ledger.Transfer(ledger.UserAccount(user.ID), ledger.AccountInsurance, margin.SettlementAsset, amount)...)
+
+	ex.recordInsurance(event.ID, user.ID, event.Market, amount)
+	event.InsuranceFund = amount
+}
+
+// coverIsolatedDeficit has the insurance fund pay the loss the user's closed
+// isolated positions couldn't cover with their margin. The counterparties
+// were paid in full already, what the fund can't cover is written off
+// against the PnL account. Must be called with ex.mu held.
+func (ex *Exchange) coverIsolatedDeficit(user *margin.User, market Market, reference string) {
+	deficit := user.TakeIsolatedDeficit()
+	if deficit <= 0 {
+		return
+	}
+
+	covered := math.Min(deficit, math.Max(ex.Insurance.Balance, 0))
+	account := ledger.UserAccount(user.ID)
+	postings := ledger.Transfer(ledger.AccountInsurance, account, margin.SettlementAsset, covered)
+	if uncovered := deficit - covered; uncovered > 0 {
+		postings = append(postings, ledger.Transfer(ledger.AccountPnL, account, margin.SettlementAsset, uncovered)...)
+		logrus.WithFields(logrus.Fields{
+			"userID":    user.ID,
+			"market":    market,
+			"uncovered": uncovered,
+		}).Warn("insurance fund can't cover isolated deficit")
+	}
+	ex.post(ledger.EntryLiquidation, reference, postings...)
+
+	if covered > 0 {
+		ex.recordInsurance(0, user.ID, market, -covered)
+	}
+}
+
+// recordInsurance books amount into the insurance fund, negative when the
+// fund paid out. Must be called with ex.mu held.
+func (ex *Exchange) recordInsurance(liquidationID, userID int64, market Market, amount float64) {
+	ex.Insurance.Balance += amount
+	ex.Insurance.History = append(ex.Insurance.History, InsuranceFundEntry{
+		LiquidationID: liquidationID,
+		UserID:        userID,
+		Market:        market,
+		Amount:        amount,
+		Balance:       ex.Insurance.Balance,
+		Timestamp:     time.Now().UnixNano(),
+	})
+}
+
+// adlQueue ranks the profitable positions on side of market by PnL ratio times
+// effective leverage, highest first. Must be called with ex.mu held.
+func (ex *Exchange) adlQueue(market Market, side string) []adlEntry {
+	queue := []adlEntry{}
+
+	for _, user := range ex.Users {
+		position, ok := user.Positions[string(market)]
+		if !ok || position.Side != side || position.UnrealizedPNL <= 0 {
+			continue
+		}
+
+		cost := position.Size * position.OpenPrice
+		if cost == 0 {
+			continue
+		}
+
+		queue = append(queue, adlEntry{
+			user:     user,
+			position: position,
+			score:    position.UnrealizedPNL / cost * user.EffectiveLeverage(),
+		})
+	}
+
+	sort.Slice(queue, func(i, j int) bool {
+		if queue[i].score == queue[j].score {
+			return queue[i].user.ID < queue[j].user.ID
+		}
+		return queue[i].score > queue[j].score
+	})
+
+	return queue
+}
+
+// autoDeleverage closes size of the bankrupt user's position against the top
+// of the opposite ADL queue at the bankruptcy price and returns the size it
+// managed to close. Must be called with ex.mu held.
+func (ex *Exchange) autoDeleverage(liquidationID int64, user *margin.User, position margin.Position, size, bankruptcy float64) float64 {
+	long := position.Side == margin.SideLong
+	opposite := margin.SideLong
+	if long {
+		opposite = margin.SideShort
+	}
+
+	remaining := size
+	for _, entry := range ex.adlQueue(Market(position.Asset), opposite) {
+		if remaining <= 0 {
+			break
+		}
+
+		qty := math.Min(remaining, entry.position.Size)
+		leverage := entry.position.Leverage
+
+		pnl := user.HandleTrade(position.Asset, qty, bankruptcy, position.Leverage, !long)
+		counterPNL := entry.user.HandleTrade(position.Asset, qty, bankruptcy, leverage, long)
+		ex.postRealizedPNL(user, liquidationReference(liquidationID), pnl)
+		ex.postRealizedPNL(entry.user, liquidationReference(liquidationID), counterPNL)
+		ex.coverIsolatedDeficit(user, Market(position.Asset), liquidationReference(liquidationID))
+		ex.coverIsolatedDeficit(entry.user, Market(position.Asset), liquidationReference(liquidationID))
+		ex.recordTrade(user.ID, Market(position.Asset), liquidationReference(liquidationID), !long, bankruptcy, qty, 0, pnl)
+		ex.recordTrade(entry.user.ID, Market(position.Asset), liquidationReference(liquidationID), long, bankruptcy, qty, 0, counterPNL)
+		remaining -= qty
+
+		ex.userStreams.publish(entry.user.ID, UserEvent{
+			Type: UserEventAutoDeleverage,
+			Fill: &Fill{
+				Market: Market(position.Asset),
+				Bid:    long,
+				Price:  bankruptcy,
+				Size:   qty,
+			},
+		})
+		ex.publishPosition(entry.user, position.Asset)
+		ex.publishBalance(entry.user)
+	}
+
+	if filled := size - remaining; filled > 0 {
+		ex.publishPosition(user, position.Asset)
+		ex.publishBalance(user)
+	}
+
+	return size - remaining
+}
+
+// adlRanks returns the ADL queue position of each of the user's positions.
+// Must be called with ex.mu held.
+func (ex *Exchange) adlRanks(user *margin.User) []ADLRank {
+	ranks := []ADLRank{}
+
+	for asset, position := range user.Positions {
+		rank := ADLRank{
+			Market: Market(asset),
+			Side:   position.Side,
+		}
+
+		queue := ex.adlQueue(Market(asset), position.Side)
+		rank.QueueSize = len(queue)
+		for i, entry := range queue {
+			if entry.user.ID == user.ID {
+				rank.Rank = i + 1
+				rank.Score = entry.score
+				break
+			}
+		}
+
+		ranks = append(ranks, rank)
+	}
+
+	sort.Slice(ranks, func(i, j int) bool { return ranks[i].Market < ranks[j].Market })
+
+	return ranks
+}
+
+func (ex *Exchange) handleGetInsuranceFund(c echo.Context) error {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	fund := InsuranceFund{
+		Balance: ex.Insurance.Balance,
+		History: make([]InsuranceFundEntry, len(ex.Insurance.History)),
+	}
+	copy(fund.History, ex.Insurance.History)
+
+	return c.JSON(http.StatusOK, fund)
+}
+
+func (ex *Exchange) handleGetADLRank(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	user, ok := ex.Users[int64(userID)]
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "user not found"})
+	}
+
+	return c.JSON(http.StatusOK, ex.adlRanks(user))
+}
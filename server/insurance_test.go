@@ -0,0 +1,177 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/fineas02/matching-engine/orderbook"
+)
+
+// openLong leaves user 1 long 10 ETH from 100 with an equity of 10 at a
+// mark of 91, bankrupt at 90.
+func openLong(t *testing.T, ex *Exchange) {
+	t.Helper()
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	user := ex.Users[1]
+	user.HandleTrade(string(MarketETH), 10, 100, 10, true)
+	user.MarkToMarket(string(MarketETH), 91)
+	assertClose(t, user.BankruptcyPrice(string(MarketETH)), 90)
+}
+
+func TestInsuranceFundCoversLoss(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 100, 2: 1000})
+	seedInsurance(ex, 100)
+	openLong(t, ex)
+
+	// the book only takes the step 2 below bankruptcy
+	ex.orderbooks[MarketETH].PlaceLimitOrder(88, orderbook.NewOrder(true, 2.5, 2, 1))
+
+	event, ok := ex.liquidationStep(1, ex.Users[1].Position(string(MarketETH)), ex.MarketConfig[MarketETH])
+	assert(t, ok, true)
+	assert(t, event.AutoDeleveraged, false)
+	assertClose(t, event.Size, 2.5)
+	assertClose(t, event.Price, 88)
+	assertClose(t, event.InsuranceFund, -5)
+	assertClose(t, ex.Insurance.Balance, 95)
+	assert(t, len(ex.Insurance.History), 1)
+	assertLedger(t, ex)
+}
+
+func TestInsuranceFundTakesSurplus(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 100, 2: 1000})
+	openLong(t, ex)
+
+	// closing 5 above bankruptcy leaves 12.5, the fund takes 1% of notional
+	ex.orderbooks[MarketETH].PlaceLimitOrder(95, orderbook.NewOrder(true, 2.5, 2, 1))
+
+	event, ok := ex.liquidationStep(1, ex.Users[1].Position(string(MarketETH)), ex.MarketConfig[MarketETH])
+	assert(t, ok, true)
+	assertClose(t, event.InsuranceFund, 2.375)
+	assertClose(t, ex.Insurance.Balance, 2.375)
+	assertLedger(t, ex)
+}
+
+func TestExhaustedFundAutoDeleverages(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 100, 2: 1000, 3: 10000})
+	seedInsurance(ex, 1)
+	openLong(t, ex)
+
+	ex.mu.Lock()
+	ex.Users[2].HandleTrade(string(MarketETH), 4, 100, 10, false)
+	ex.Users[3].HandleTrade(string(MarketETH), 6, 100, 2, false)
+	for _, user := range ex.Users {
+		user.MarkToMarket(string(MarketETH), 91)
+	}
+	ex.mu.Unlock()
+
+	// the book would close the step 2 below bankruptcy, more than the fund has
+	ex.orderbooks[MarketETH].PlaceLimitOrder(88, orderbook.NewOrder(true, 2.5, 2, 1))
+
+	event, ok := ex.liquidationStep(1, ex.Users[1].Position(string(MarketETH)), ex.MarketConfig[MarketETH])
+	assert(t, ok, true)
+	assert(t, event.AutoDeleveraged, true)
+	assertClose(t, event.Size, 2.5)
+	assertClose(t, event.Price, 90)
+
+	// the fund and the book are left alone, the top of the queue pays
+	assertClose(t, ex.Insurance.Balance, 1)
+	assertClose(t, ex.orderbooks[MarketETH].BidTotalVolume(), 2.5)
+	assertClose(t, ex.Users[1].Position(string(MarketETH)).Size, 7.5)
+	assertClose(t, ex.Users[2].Position(string(MarketETH)).Size, 1.5)
+	assertClose(t, ex.Users[3].Position(string(MarketETH)).Size, 6)
+	assertClose(t, ex.Users[2].Balance[margin.SettlementAsset], 1000+2.5*10)
+	assertLedger(t, ex)
+}
+
+func TestADLQueueRanksProfitAndLeverage(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 1000, 2: 1000, 3: 1000, 4: 1000})
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	eth := string(MarketETH)
+	// 2 and 3 made the same 10%, 2 on three times the size and so more
+	// leverage. 1 made 20% with little leverage, 4 is losing.
+	ex.Users[1].HandleTrade(eth, 1, 110, 1, false)
+	ex.Users[2].HandleTrade(eth, 30, 100, 10, false)
+	ex.Users[3].HandleTrade(eth, 10, 100, 10, false)
+	ex.Users[4].HandleTrade(eth, 10, 80, 10, false)
+	for _, user := range ex.Users {
+		user.MarkToMarket(eth, 90)
+	}
+
+	queue := ex.adlQueue(MarketETH, margin.SideShort)
+	ids := []int64{}
+	for _, entry := range queue {
+		ids = append(ids, entry.user.ID)
+	}
+	assert(t, ids, []int64{2, 3, 1})
+
+	ranks := ex.adlRanks(ex.Users[4])
+	assert(t, ranks[0].Rank, 0)
+	assert(t, ranks[0].QueueSize, 3)
+	assert(t, len(ex.adlQueue(MarketETH, margin.SideLong)), 0)
+}
+
+// openIsolatedLong leaves user 1 long 10 ETH from 100 on an isolated margin
+// of 100, bankrupt at 90.
+func openIsolatedLong(t *testing.T, ex *Exchange) {
+	t.Helper()
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	user := ex.Users[1]
+	assert(t, user.SetMarginMode(string(MarketETH), margin.MarginIsolated), nil)
+	user.HandleTrade(string(MarketETH), 10, 100, 10, true)
+	user.MarkToMarket(string(MarketETH), 91)
+	assertClose(t, user.Position(string(MarketETH)).IsolatedMargin, 100)
+	assertClose(t, user.Balance[margin.SettlementAsset], 900)
+}
+
+func TestIsolatedLiquidationLeavesCrossBalance(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 1000, 2: 1000})
+	seedInsurance(ex, 100)
+	openIsolatedLong(t, ex)
+
+	ex.orderbooks[MarketETH].PlaceLimitOrder(88, orderbook.NewOrder(true, 2.5, 2, 1))
+
+	event, ok := ex.liquidationStep(1, ex.Users[1].Position(string(MarketETH)), ex.MarketConfig[MarketETH])
+	assert(t, ok, true)
+	assertClose(t, event.InsuranceFund, -5)
+
+	// the step lost 30 of the margin and released a quarter of the rest, the
+	// fund paid what went below bankruptcy back into the margin. The cross
+	// balance only got the release and paid the fee.
+	position := ex.Users[1].Position(string(MarketETH))
+	assertClose(t, position.Size, 7.5)
+	assertClose(t, position.IsolatedMargin, 70*0.75+5)
+	assertClose(t, ex.Users[1].Balance[margin.SettlementAsset], 900+70*0.25-0.11)
+	assertClose(t, ex.Insurance.Balance, 95)
+	assertLedger(t, ex)
+}
+
+func TestIsolatedDeficitIsCoveredByFund(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 1000, 2: 1000})
+	seedInsurance(ex, 30)
+	openIsolatedLong(t, ex)
+
+	// closing everything at 85 loses 150 on a margin of 100
+	ob := ex.orderbooks[MarketETH]
+	ob.PlaceLimitOrder(85, orderbook.NewOrder(true, 10, 2, 1))
+	matches := ob.PlaceMarketOrder(orderbook.NewOrder(false, 10, 1, 10))
+	assert(t, ex.handleMatches(MarketETH, matches), nil)
+
+	// the fund pays what it has, the rest is written off, the cross balance
+	// only pays the fee and the buyer is paid in full
+	_, open := ex.Users[1].Positions[string(MarketETH)]
+	assert(t, open, false)
+	assertClose(t, ex.Users[1].Balance[margin.SettlementAsset], 900-0.425)
+	assertClose(t, ex.Users[1].IsolatedDeficit, 0)
+	assertClose(t, ex.Insurance.Balance, 0)
+	assert(t, len(ex.Insurance.History), 1)
+	assertLedger(t, ex)
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/fineas02/matching-engine/ledger"
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// ledgerTolerance absorbs float noise when reconciling the ledger with the
+// balances it mirrors
+const ledgerTolerance = 1e-6
+
+type LedgerResponse struct {
+	UserID   int64
+	Balances map[string]float64
+	Entries  []ledger.Entry
+}
+
+func orderReference(orderID int64) string {
+	return fmt.Sprintf("order:%d", orderID)
+}
+
+func liquidationReference(liquidationID int64) string {
+	return fmt.Sprintf("liquidation:%d", liquidationID)
+}
+
+// post journals a balance movement. The movement itself has already
+// happened, so a rejected entry can only be logged.
+func (ex *Exchange) post(entryType, reference string, postings ...ledger.Posting) {
+	if _, err := ex.Ledger.Post(entryType, reference, postings...); err != nil {
+		logrus.WithError(err).Error("ledger entry rejected")
+	}
+}
+
+// postRealizedPNL journals PnL the user realized on a trade against the PnL
+// account.
+func (ex *Exchange) postRealizedPNL(user *margin.User, reference string, pnl float64) {
+	ex.post(ledger.EntryTrade, reference,
+		ledger.Transfer(ledger.AccountPnL, ledger.UserAccount(user.ID), margin.SettlementAsset, pnl)...)
+}
+
+// checkLedger verifies that the books sum to zero and agree with the
+// balances they journal. Isolated margin is still the user's, so it counts
+// towards the user's account. Must be called with ex.mu held.
+func (ex *Exchange) checkLedger() error {
+	if err := ex.Ledger.Check(); err != nil {
+		return err
+	}
+
+	for userID, user := range ex.Users {
+		expected := make(map[string]float64, len(user.Balance))
+		for asset, amount := range user.Balance {
+			expected[asset] = amount
+		}
+		for _, position := range user.Positions {
+			expected[margin.SettlementAsset] += position.IsolatedMargin
+		}
+
+		account := ledger.UserAccount(userID)
+		for asset, amount := range expected {
+			if booked := ex.Ledger.Balance(account, asset); math.Abs(booked-amount) > ledgerTolerance {
+				return fmt.Errorf("%s: %s balance %f, ledger %f", account, asset, amount, booked)
+			}
+		}
+	}
+
+	if booked := ex.Ledger.Balance(ledger.AccountFees, margin.SettlementAsset); math.Abs(booked-ex.FeeAccount.Balance) > ledgerTolerance {
+		return fmt.Errorf("fee account balance %f, ledger %f", ex.FeeAccount.Balance, booked)
+	}
+	pending := map[string]float64{margin.SettlementAsset: 0}
+	for asset := range ex.CollateralConfig {
+		pending[asset] = 0
+	}
+	for _, withdrawal := range ex.wallet.withdrawals {
+		if withdrawal.Status == WithdrawalRiskChecked {
+			pending[withdrawal.Asset] += withdrawal.Amount
+		}
+	}
+	for asset, amount := range pending {
+		if booked := ex.Ledger.Balance(AccountWithdrawals, asset); math.Abs(booked-amount) > ledgerTolerance {
+			return fmt.Errorf("pending %s withdrawals %f, ledger %f", asset, amount, booked)
+		}
+	}
+	if booked := ex.Ledger.Balance(AccountNFTEscrow, margin.SettlementAsset); math.Abs(booked-ex.nftEscrowed()) > ledgerTolerance {
+		return fmt.Errorf("nft escrow %f, ledger %f", ex.nftEscrowed(), booked)
+	}
+	if booked := ex.Ledger.Balance(ledger.AccountInsurance, margin.SettlementAsset); math.Abs(booked-ex.Insurance.Balance) > ledgerTolerance {
+		return fmt.Errorf("insurance fund balance %f, ledger %f", ex.Insurance.Balance, booked)
+	}
+
+	return nil
+}
+
+func (ex *Exchange) handleGetLedger(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+
+	ex.mu.RLock()
+	_, ok := ex.Users[int64(userID)]
+	ex.mu.RUnlock()
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "user not found"})
+	}
+
+	account := ledger.UserAccount(int64(userID))
+
+	return c.JSON(http.StatusOK, LedgerResponse{
+		UserID:   int64(userID),
+		Balances: ex.Ledger.Balances(account),
+		Entries:  ex.Ledger.Entries(account),
+	})
+}
+
+func (ex *Exchange) handleCheckLedger(c echo.Context) error {
+	ex.mu.RLock()
+	err := ex.checkLedger()
+	ex.mu.RUnlock()
+
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, APIError{Error: err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]any{"msg": "ledger balanced"})
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+type UserLimitsRequest struct {
+	UserID              int64
+	MaxPositionNotional float64
+	MaxOpenOrders       int
+}
+
+// defaultRiskTiers steps the leverage down and the maintenance margin up as
+// positions grow.
+func defaultRiskTiers() []margin.RiskTier {
+	return []margin.RiskTier{
+		{MaxNotional: 10000, MaximumLeverage: 10, MaintenanceMargin: 0.05},
+		{MaxNotional: 50000, MaximumLeverage: 5, MaintenanceMargin: 0.1},
+		{MaxNotional: 200000, MaximumLeverage: 2, MaintenanceMargin: 0.25},
+	}
+}
+
+func (ex *Exchange) handleGetRiskTiers(c echo.Context) error {
+	config, ok := ex.MarketConfig[Market(c.Param("market"))]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	tiers := config.RiskTiers
+	if len(tiers) == 0 {
+		tier, _ := config.Tier(0)
+		tiers = []margin.RiskTier{tier}
+	}
+
+	return c.JSON(http.StatusOK, tiers)
+}
+
+func (ex *Exchange) handleGetLimits(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	user, ok := ex.Users[int64(userID)]
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "user not found"})
+	}
+
+	return c.JSON(http.StatusOK, user.Limits)
+}
+
+func (ex *Exchange) handleSetLimits(c echo.Context) error {
+	req := new(UserLimitsRequest)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+	if req.MaxPositionNotional < 0 || req.MaxOpenOrders < 0 {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "limits can't be negative"})
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	user, ok := ex.Users[req.UserID]
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "user not found"})
+	}
+
+	user.Limits = margin.Limits{
+		MaxPositionNotional: req.MaxPositionNotional,
+		MaxOpenOrders:       req.MaxOpenOrders,
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"userID":              req.UserID,
+		"maxPositionNotional": req.MaxPositionNotional,
+		"maxOpenOrders":       req.MaxOpenOrders,
+	}).Info("user limits set")
+
+	return c.JSON(http.StatusOK, user.Limits)
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestOrderNeedsLeverage(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 100000})
+
+	// 600 at 100 falls in the 2x tier, an order without a leverage doesn't
+	// get to reserve the flat 10%
+	req := &PlaceOrderRequest{UserID: 1, Type: LimitOrder, Market: MarketETH, Bid: true, Size: 600, Price: 100}
+	assert(t, ex.handleCheckOrder(req) != nil, true)
+
+	status, _ := placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 600, Price: 100, Leverage: -1})
+	assert(t, status, http.StatusBadRequest)
+	status, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 600, Price: 100, Leverage: 5})
+	assert(t, status, http.StatusBadRequest)
+
+	status, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 600, Price: 100, Leverage: 2})
+	assert(t, status, http.StatusOK)
+	assertClose(t, ex.Users[1].ReservedMargin(), 30000)
+}
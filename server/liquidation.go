@@ -0,0 +1,275 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/fineas02/matching-engine/orderbook"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	UserEventLiquidation = "liquidation"
+
+	// liquidationStep is the largest share of a position closed by a single
+	// liquidation order. The account is checked again after every step, so a
+	// partial close that restores margin leaves the rest of the position open.
+	liquidationStep = 0.25
+)
+
+// LiquidationEvent records one liquidation step and what it closed at.
+// InsuranceFund is what the step paid into the insurance fund, negative when
+// the fund covered a loss. AutoDeleveraged steps closed against opposing
+// positions at the bankruptcy price instead of going to the book.
+type LiquidationEvent struct {
+	ID               int64
+	UserID           int64
+	Market           Market
+	Bid              bool
+	Size             float64
+	Price            float64
+	MarkPrice        float64
+	LiquidationPrice float64
+	BankruptcyPrice  float64
+	InsuranceFund    float64
+	AutoDeleveraged  bool
+	Timestamp        int64
+}
+
+var liquidationIDCounter int64
+
+// signalLiquidationCheck asks the liquidation worker to check all accounts.
+// Signals coalesce, so this never blocks.
+func (ex *Exchange) signalLiquidationCheck() {
+	select {
+	case ex.liquidationCheck <- struct{}{}:
+	default:
+	}
+}
+
+// runLiquidations is the only place liquidations are run from, so they never
+// overlap and the trades they cause can safely signal another check.
+func (ex *Exchange) runLiquidations() {
+	for range ex.liquidationCheck {
+		ex.checkLiquidations()
+	}
+}
+
+// checkLiquidations liquidates every account whose equity dropped below its
+// maintenance margin.
+func (ex *Exchange) checkLiquidations() {
+	configs := ex.marginConfigs()
+
+	ex.mu.Lock()
+	candidates := []int64{}
+	for userID, user := range ex.Users {
+		user.UpdateLiquidationPrices(configs)
+		if user.IsLiquidatable(configs) {
+			candidates = append(candidates, userID)
+		}
+	}
+	ex.mu.Unlock()
+
+	for _, userID := range candidates {
+		ex.liquidate(userID, configs)
+	}
+}
+
+// liquidate pulls the user's open orders and then closes its largest
+// liquidatable position step by step until no position is below maintenance
+// anymore or there is no book left to close them against. A negative
+// settlement balance is covered by selling collateral before and after.
+func (ex *Exchange) liquidate(userID int64, configs map[string]*margin.MarketConfig) {
+	ex.cancelUserOrders(userID, "liquidation")
+	ex.coverDeficit(userID)
+	defer ex.coverDeficit(userID)
+
+	for {
+		ex.mu.Lock()
+		user, ok := ex.Users[userID]
+		if !ok {
+			ex.mu.Unlock()
+			return
+		}
+		user.UpdateLiquidationPrices(configs)
+		position, found := largestPosition(user, user.LiquidatablePositions(configs))
+		ex.mu.Unlock()
+
+		if !found {
+			return
+		}
+
+		event, ok := ex.liquidationStep(userID, position, configs[position.Asset])
+		if !ok {
+			logrus.WithFields(logrus.Fields{
+				"userID": userID,
+				"market": position.Asset,
+			}).Warn("no liquidity to liquidate position")
+			return
+		}
+
+		ex.recordLiquidation(event)
+		// auto-deleveraging shrinks positions outside the book
+		ex.enforceReduceOnly(event.Market)
+	}
+}
+
+// liquidationStep closes part of position. It goes to the book when the book
+// can take the whole step and the insurance fund can cover any loss against
+// the bankruptcy price, and auto-deleverages opposing positions otherwise.
+func (ex *Exchange) liquidationStep(userID int64, position margin.Position, config *margin.MarketConfig) (LiquidationEvent, bool) {
+	market := Market(position.Asset)
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return LiquidationEvent{}, false
+	}
+
+	// closing a long sells into the bids, closing a short buys the asks
+	bid := position.Side == margin.SideShort
+
+	size := position.Size * liquidationStep
+	if config != nil {
+		size = math.Max(size, config.MinOrder)
+	}
+	size = math.Min(size, position.Size)
+
+	ex.mu.Lock()
+	user := ex.Users[userID]
+	bankruptcy := user.BankruptcyPrice(position.Asset)
+	fund := ex.Insurance.Balance
+	ex.mu.Unlock()
+
+	event := LiquidationEvent{
+		ID:               atomic.AddInt64(&liquidationIDCounter, 1),
+		UserID:           userID,
+		Market:           market,
+		Bid:              bid,
+		MarkPrice:        position.MarkPrice,
+		LiquidationPrice: position.LiquidationPrice,
+		BankruptcyPrice:  bankruptcy,
+		Timestamp:        time.Now().UnixNano(),
+	}
+
+	// look at what the book would give before touching it
+	expected, available := ob.MarketOrderPrice(bid, size)
+	deficit := -liquidationSurplus(position, available, expected, bankruptcy)
+
+	if available < size || deficit > fund {
+		ex.mu.Lock()
+		filled := ex.autoDeleverage(event.ID, user, position, size, bankruptcy)
+		ex.mu.Unlock()
+
+		if filled > 0 {
+			event.Size = filled
+			event.Price = bankruptcy
+			event.AutoDeleveraged = true
+			return event, true
+		}
+
+		// nobody to deleverage, take what the book has left
+		size = available
+	}
+
+	if size <= 0 {
+		return LiquidationEvent{}, false
+	}
+
+	order := orderbook.NewOrder(bid, size, userID, position.Leverage)
+	matches, _ := ex.handlePlaceMarketOrder(market, order)
+	if err := ex.handleMatches(market, matches); err != nil {
+		logrus.Error(err)
+	}
+
+	filled, notional := 0.0, 0.0
+	for _, match := range matches {
+		filled += match.SizeFilled
+		notional += match.SizeFilled * match.Price
+	}
+	if filled == 0 {
+		return LiquidationEvent{}, false
+	}
+
+	event.Size = filled
+	event.Price = notional / filled
+
+	ex.mu.Lock()
+	ex.settleLiquidation(user, &event, liquidationSurplus(position, filled, event.Price, bankruptcy))
+	ex.mu.Unlock()
+
+	return event, true
+}
+
+// liquidationSurplus returns how much better than the bankruptcy price size
+// of position closed at price, negative when it closed worse.
+func liquidationSurplus(position margin.Position, size, price, bankruptcy float64) float64 {
+	if position.Side == margin.SideLong {
+		return size * (price - bankruptcy)
+	}
+	return size * (bankruptcy - price)
+}
+
+func (ex *Exchange) recordLiquidation(event LiquidationEvent) {
+	ex.mu.Lock()
+	ex.liquidations = append(ex.liquidations, event)
+	ex.mu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"userID": event.UserID,
+		"market": event.Market,
+		"size":   event.Size,
+		"price":  event.Price,
+		"mark":   event.MarkPrice,
+	}).Warn("liquidated position")
+
+	ex.userStreams.publish(event.UserID, UserEvent{
+		Type:        UserEventLiquidation,
+		Liquidation: &event,
+	})
+}
+
+// cancelUserOrders takes every resting order of the user off all books.
+func (ex *Exchange) cancelUserOrders(userID int64, reason string) {
+	for _, ob := range ex.orderbooks {
+		for _, order := range ob.GetAllOrders() {
+			if order.UserID == userID {
+				ex.cancelBookOrder(ob, order, reason)
+			}
+		}
+	}
+}
+
+// largestPosition returns the position with the largest notional among the
+// user's positions in assets.
+func largestPosition(user *margin.User, assets []string) (margin.Position, bool) {
+	var (
+		largest margin.Position
+		found   bool
+	)
+
+	for _, asset := range assets {
+		position, ok := user.Positions[asset]
+		if !ok {
+			continue
+		}
+		if !found || position.Notional() > largest.Notional() {
+			largest = *position
+			found = true
+		}
+	}
+
+	return largest, found
+}
+
+func (ex *Exchange) handleGetLiquidations(c echo.Context) error {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	liquidations := make([]LiquidationEvent, len(ex.liquidations))
+	copy(liquidations, ex.liquidations)
+
+	return c.JSON(http.StatusOK, liquidations)
+}
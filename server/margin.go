@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	MarginModeRequest struct {
+		UserID int64
+		Market Market
+		Mode   string
+	}
+
+	// IsolatedMarginRequest adds Amount to the isolated margin of a position,
+	// a negative Amount removes margin.
+	IsolatedMarginRequest struct {
+		UserID int64
+		Market Market
+		Amount float64
+	}
+)
+
+func (ex *Exchange) handleSetMarginMode(c echo.Context) error {
+	req := new(MarginModeRequest)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	if _, ok := ex.orderbooks[req.Market]; !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	user, ok := ex.Users[req.UserID]
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "user not found"})
+	}
+
+	if err := user.SetMarginMode(string(req.Market), req.Mode); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, user.Account(ex.marginConfigs()))
+}
+
+func (ex *Exchange) handleAdjustIsolatedMargin(c echo.Context) error {
+	req := new(IsolatedMarginRequest)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	if req.Amount == 0 {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "amount must not be zero"})
+	}
+
+	ex.mu.Lock()
+	user, ok := ex.Users[req.UserID]
+	if !ok {
+		ex.mu.Unlock()
+		return c.JSON(http.StatusNotFound, APIError{Error: "user not found"})
+	}
+
+	configs := ex.marginConfigs()
+	if err := user.AdjustIsolatedMargin(string(req.Market), req.Amount, configs); err != nil {
+		ex.mu.Unlock()
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	ex.publishPosition(user, string(req.Market))
+	ex.publishBalance(user)
+	account := user.Account(configs)
+	ex.mu.Unlock()
+
+	// moving margin changes the equity left behind the cross positions
+	ex.signalLiquidationCheck()
+
+	return c.JSON(http.StatusOK, account)
+}
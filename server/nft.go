@@ -0,0 +1,324 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/fineas02/matching-engine/ledger"
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/fineas02/matching-engine/nft"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// AccountNFTEscrow holds what resting NFT bids reserved until they fill or
+// are cancelled
+const AccountNFTEscrow = "exchange:nft-escrow"
+
+type (
+	// PlaceNFTOrderRequest lists a token, or bids for one. A bid without a
+	// TokenID is a collection bid, with Traits it only takes tokens that have
+	// every one of them.
+	PlaceNFTOrderRequest struct {
+		Collection string
+		TokenID    string
+		Traits     map[string]string
+		Bid        bool
+		Price      float64
+	}
+
+	PlaceNFTOrderResponse struct {
+		Order *nft.Order
+		Trade *nft.Trade `json:",omitempty"`
+	}
+
+	// TokenResponse is a token with its owner and traits.
+	TokenResponse struct {
+		Collection string
+		TokenID    string
+		Owner      int64
+		Traits     map[string]string `json:",omitempty"`
+	}
+
+	// MintRequest registers a token deposited by the user.
+	MintRequest struct {
+		UserID     int64
+		Collection string
+		TokenID    string
+	}
+)
+
+func nftReference(collection string, orderID int64) string {
+	return fmt.Sprintf("nft:%s:%d", collection, orderID)
+}
+
+// AddCollection opens a spot book for the tokens of an NFT collection.
+// Collections are meant to be added before the exchange starts.
+func (ex *Exchange) AddCollection(collection string) error {
+	if collection == "" {
+		return fmt.Errorf("missing collection")
+	}
+	if _, ok := ex.nftBooks[collection]; ok {
+		return fmt.Errorf("collection %s already exists", collection)
+	}
+
+	ex.nftBooks[collection] = nft.NewBook(collection, ex.NFTs, ex.NFTMetadata)
+	return nil
+}
+
+// placeNFTOrder places a listing or a bid in the book of its collection.
+// A bid reserves its price from the bidder's free margin until it fills or
+// is cancelled.
+func (ex *Exchange) placeNFTOrder(userID int64, req *PlaceNFTOrderRequest) (*nft.Order, *nft.Trade, error) {
+	book, ok := ex.nftBooks[req.Collection]
+	if !ok {
+		return nil, nil, fmt.Errorf("collection %s not found", req.Collection)
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	user, ok := ex.Users[userID]
+	if !ok {
+		return nil, nil, fmt.Errorf("user not found")
+	}
+
+	order := nft.NewOrder(userID, req.Collection, req.TokenID, req.Bid, req.Price)
+	order.Traits = req.Traits
+	if order.Bid {
+		if err := ex.reserveNFTBid(user, order); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	trade, err := book.Place(order)
+	if err != nil {
+		if order.Bid {
+			ex.releaseNFTBid(order)
+		}
+		return nil, nil, err
+	}
+	if trade != nil {
+		ex.settleNFTTrade(trade)
+	}
+
+	return order, trade, nil
+}
+
+// reserveNFTBid moves the price of the bid into escrow. Must be called with
+// ex.mu held.
+func (ex *Exchange) reserveNFTBid(user *margin.User, order *nft.Order) error {
+	if order.Price <= 0 {
+		return fmt.Errorf("invalid price %f", order.Price)
+	}
+	if free := user.Withdrawable(margin.SettlementAsset, ex.marginConfigs()); order.Price > free {
+		return fmt.Errorf("insufficient free margin: available %f, bid %f", free, order.Price)
+	}
+
+	user.Balance[margin.SettlementAsset] -= order.Price
+	user.UpdateEquity()
+	ex.nftEscrow[order.ID] = order.Price
+	ex.post(ledger.EntryNFT, nftReference(order.Collection, order.ID),
+		ledger.Transfer(ledger.UserAccount(user.ID), AccountNFTEscrow, margin.SettlementAsset, order.Price)...)
+	ex.publishBalance(user)
+
+	return nil
+}
+
+// releaseNFTBid returns what the bid still has in escrow to the bidder.
+// Must be called with ex.mu held.
+func (ex *Exchange) releaseNFTBid(order *nft.Order) {
+	amount, ok := ex.nftEscrow[order.ID]
+	if !ok {
+		return
+	}
+	delete(ex.nftEscrow, order.ID)
+
+	user, ok := ex.Users[order.UserID]
+	if !ok || amount <= 0 {
+		return
+	}
+
+	user.Balance[margin.SettlementAsset] += amount
+	user.UpdateEquity()
+	ex.post(ledger.EntryNFT, nftReference(order.Collection, order.ID),
+		ledger.Transfer(AccountNFTEscrow, ledger.UserAccount(user.ID), margin.SettlementAsset, amount)...)
+	ex.publishBalance(user)
+}
+
+// settleNFTTrade pays the seller out of the bid's escrow and returns the
+// rest to the buyer when the bid filled below its price. The token already
+// changed hands in the registry. Must be called with ex.mu held.
+func (ex *Exchange) settleNFTTrade(trade *nft.Trade) {
+	if seller, ok := ex.Users[trade.Seller]; ok {
+		seller.Balance[margin.SettlementAsset] += trade.Price
+		seller.UpdateEquity()
+		ex.post(ledger.EntryNFT, nftReference(trade.Collection, trade.BidOrderID),
+			ledger.Transfer(AccountNFTEscrow, ledger.UserAccount(seller.ID), margin.SettlementAsset, trade.Price)...)
+		ex.publishBalance(seller)
+	} else {
+		logrus.WithField("userID", trade.Seller).Error("nft seller not found")
+	}
+
+	ex.nftEscrow[trade.BidOrderID] -= trade.Price
+	ex.releaseNFTBid(&nft.Order{ID: trade.BidOrderID, UserID: trade.Buyer, Collection: trade.Collection})
+
+	reference := nftReference(trade.Collection, trade.BidOrderID)
+	ex.recordTrade(trade.Buyer, Market(trade.Collection), reference, true, trade.Price, 1, 0, 0)
+	ex.recordTrade(trade.Seller, Market(trade.Collection), reference, false, trade.Price, 1, 0, 0)
+
+	logrus.WithFields(logrus.Fields{
+		"collection": trade.Collection,
+		"tokenID":    trade.TokenID,
+		"price":      trade.Price,
+		"buyer":      trade.Buyer,
+		"seller":     trade.Seller,
+	}).Info("nft traded")
+}
+
+// cancelNFTOrder takes the user's resting order off its book and releases
+// its escrow.
+func (ex *Exchange) cancelNFTOrder(userID, orderID int64) (*nft.Order, error) {
+	for _, book := range ex.nftBooks {
+		order, ok := book.Order(orderID)
+		if !ok {
+			continue
+		}
+		if order.UserID != userID {
+			return nil, fmt.Errorf("order %d is not yours", orderID)
+		}
+
+		ex.mu.Lock()
+		defer ex.mu.Unlock()
+
+		if _, err := book.Cancel(orderID); err != nil {
+			return nil, err
+		}
+		ex.releaseNFTBid(order)
+		return order, nil
+	}
+
+	return nil, fmt.Errorf("order %d not found", orderID)
+}
+
+// nftEscrowed returns the sum reserved by resting NFT bids. Must be called
+// with ex.mu held.
+func (ex *Exchange) nftEscrowed() float64 {
+	escrowed := 0.0
+	for _, amount := range ex.nftEscrow {
+		escrowed += amount
+	}
+	return escrowed
+}
+
+func (ex *Exchange) handlePlaceNFTOrder(c echo.Context) error {
+	userID, ok := ex.authenticate(c)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, APIError{Error: "invalid api key"})
+	}
+
+	req := new(PlaceNFTOrderRequest)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	order, trade, err := ex.placeNFTOrder(userID, req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, PlaceNFTOrderResponse{Order: order, Trade: trade})
+}
+
+func (ex *Exchange) handleCancelNFTOrder(c echo.Context) error {
+	userID, ok := ex.authenticate(c)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, APIError{Error: "invalid api key"})
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid order id"})
+	}
+
+	order, err := ex.cancelNFTOrder(userID, id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+func (ex *Exchange) handleGetNFTBook(c echo.Context) error {
+	book, ok := ex.nftBooks[c.Param("collection")]
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "collection not found"})
+	}
+
+	return c.JSON(http.StatusOK, book.Snapshot())
+}
+
+func (ex *Exchange) handleGetNFTTrades(c echo.Context) error {
+	book, ok := ex.nftBooks[c.Param("collection")]
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "collection not found"})
+	}
+
+	return c.JSON(http.StatusOK, book.Trades())
+}
+
+func (ex *Exchange) handleGetNFTTokens(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+
+	return c.JSON(http.StatusOK, ex.NFTs.Tokens(int64(userID)))
+}
+
+func (ex *Exchange) handleGetNFTToken(c echo.Context) error {
+	collection, tokenID := c.Param("collection"), c.Param("tokenID")
+
+	owner, ok := ex.NFTs.Owner(collection, tokenID)
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "token not found"})
+	}
+	traits, _ := ex.NFTMetadata.Traits(collection, tokenID)
+
+	return c.JSON(http.StatusOK, TokenResponse{
+		Collection: collection,
+		TokenID:    tokenID,
+		Owner:      owner,
+		Traits:     traits,
+	})
+}
+
+func (ex *Exchange) handleMintNFT(c echo.Context) error {
+	req := new(MintRequest)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+	if _, ok := ex.nftBooks[req.Collection]; !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "collection not found"})
+	}
+
+	ex.mu.RLock()
+	_, ok := ex.Users[req.UserID]
+	ex.mu.RUnlock()
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "user not found"})
+	}
+
+	if err := ex.NFTs.Mint(req.Collection, req.TokenID, req.UserID); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"userID":     req.UserID,
+		"collection": req.Collection,
+		"tokenID":    req.TokenID,
+	}).Info("nft registered")
+
+	return c.JSON(http.StatusOK, nft.Token{Collection: req.Collection, TokenID: req.TokenID})
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/fineas02/matching-engine/margin"
+)
+
+// newNFTExchange opens a punks book with token 1 owned by user 1, and issues
+// keys for users 1 and 2.
+func newNFTExchange(t *testing.T) (*Exchange, string, string) {
+	t.Helper()
+
+	ex, _ := newTestExchange(t, map[int64]float64{1: 100, 2: 100})
+	ex.AdminKey = "admin"
+	assert(t, ex.AddCollection("punks"), nil)
+	assert(t, ex.NFTs.Mint("punks", "1", 1), nil)
+
+	return ex, issueKey(t, ex, "1"), issueKey(t, ex, "2")
+}
+
+func placeNFTOrder(t *testing.T, ex *Exchange, key, body string) (int, PlaceNFTOrderResponse) {
+	t.Helper()
+
+	rec := serve(t, ex.handlePlaceNFTOrder, http.MethodPost, body, withKey(key))
+	resp := PlaceNFTOrderResponse{}
+	if rec.Code == http.StatusOK {
+		assert(t, json.Unmarshal(rec.Body.Bytes(), &resp), nil)
+	}
+	return rec.Code, resp
+}
+
+func balance(ex *Exchange, userID int64) float64 {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	return ex.Users[userID].Balance[margin.SettlementAsset]
+}
+
+func escrowed(ex *Exchange) float64 {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	return ex.nftEscrowed()
+}
+
+func TestNFTBidIsEscrowedUntilItFills(t *testing.T) {
+	ex, seller, buyer := newNFTExchange(t)
+
+	status, _ := placeNFTOrder(t, ex, "", `{"Collection": "punks", "Bid": true, "Price": 60}`)
+	assert(t, status, http.StatusUnauthorized)
+
+	status, resp := placeNFTOrder(t, ex, buyer, `{"Collection": "punks", "Bid": true, "Price": 60}`)
+	assert(t, status, http.StatusOK)
+	assert(t, resp.Trade == nil, true)
+	assertClose(t, balance(ex, 2), 40)
+	assertClose(t, escrowed(ex), 60)
+	assertLedger(t, ex)
+
+	// the listing takes the resting bid at its price, the seller is paid out
+	// of escrow
+	status, resp = placeNFTOrder(t, ex, seller, `{"Collection": "punks", "TokenID": "1", "Price": 50}`)
+	assert(t, status, http.StatusOK)
+	assertClose(t, resp.Trade.Price, 60)
+	assertClose(t, balance(ex, 1), 160)
+	assertClose(t, balance(ex, 2), 40)
+	assertClose(t, escrowed(ex), 0)
+
+	owner, _ := ex.NFTs.Owner("punks", "1")
+	assert(t, owner, int64(2))
+	assertLedger(t, ex)
+}
+
+func TestNFTBidBelowItsPriceIsRefunded(t *testing.T) {
+	ex, seller, buyer := newNFTExchange(t)
+
+	status, _ := placeNFTOrder(t, ex, seller, `{"Collection": "punks", "TokenID": "1", "Price": 50}`)
+	assert(t, status, http.StatusOK)
+
+	// the bid reserves 60 but fills at the listing's 50
+	status, resp := placeNFTOrder(t, ex, buyer, `{"Collection": "punks", "Bid": true, "Price": 60}`)
+	assert(t, status, http.StatusOK)
+	assertClose(t, resp.Trade.Price, 50)
+	assertClose(t, balance(ex, 1), 150)
+	assertClose(t, balance(ex, 2), 50)
+	assertClose(t, escrowed(ex), 0)
+	assertLedger(t, ex)
+}
+
+func TestNFTBidEscrowReleased(t *testing.T) {
+	ex, seller, buyer := newNFTExchange(t)
+
+	status, resp := placeNFTOrder(t, ex, buyer, `{"Collection": "punks", "TokenID": "1", "Bid": true, "Price": 30}`)
+	assert(t, status, http.StatusOK)
+	id := strconv.FormatInt(resp.Order.ID, 10)
+
+	// only the bidder can cancel it
+	rec := serve(t, ex.handleCancelNFTOrder, http.MethodDelete, "", withKey(seller), "id", id)
+	assert(t, rec.Code, http.StatusNotFound)
+	assertClose(t, escrowed(ex), 30)
+
+	rec = serve(t, ex.handleCancelNFTOrder, http.MethodDelete, "", withKey(buyer), "id", id)
+	assert(t, rec.Code, http.StatusOK)
+	assertClose(t, balance(ex, 2), 100)
+	assertClose(t, escrowed(ex), 0)
+	assertLedger(t, ex)
+
+	// a bid the book refuses gives its escrow straight back, one the user
+	// can't afford never takes any
+	status, _ = placeNFTOrder(t, ex, seller, `{"Collection": "punks", "TokenID": "1", "Bid": true, "Price": 30}`)
+	assert(t, status, http.StatusBadRequest)
+	assertClose(t, balance(ex, 1), 100)
+
+	status, _ = placeNFTOrder(t, ex, buyer, `{"Collection": "punks", "Bid": true, "Price": 150}`)
+	assert(t, status, http.StatusBadRequest)
+	assertClose(t, balance(ex, 2), 100)
+	assertClose(t, escrowed(ex), 0)
+	assertLedger(t, ex)
+}
+
+func TestCheckLedgerCatchesEscrowMismatch(t *testing.T) {
+	ex, _, buyer := newNFTExchange(t)
+
+	status, resp := placeNFTOrder(t, ex, buyer, `{"Collection": "punks", "Bid": true, "Price": 30}`)
+	assert(t, status, http.StatusOK)
+	assertLedger(t, ex)
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	ex.nftEscrow[resp.Order.ID] += 1
+	assert(t, ex.checkLedger() != nil, true)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/fineas02/matching-engine/price"
+	"github.com/labstack/echo/v4"
+)
+
+const priceUpdateInterval = time.Second
+
+// updatePrice feeds the current state of the market's book into the price
+// service and returns the new mark.
+func (ex *Exchange) updatePrice(market Market) price.MarketPrice {
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return price.MarketPrice{Market: string(market)}
+	}
+
+	return ex.Prices.Update(string(market), ob.MidPrice(), ob.LastPrice())
+}
+
+// markPrice returns the mark price of the market, computing it first if the
+// market hasn't been priced yet.
+func (ex *Exchange) markPrice(market Market) float64 {
+	if mark := ex.Prices.Mark(string(market)); mark != 0 {
+		return mark
+	}
+	return ex.updatePrice(market).Mark
+}
+
+// runPriceUpdates keeps the index and mark prices fresh even when nothing
+// trades.
+func (ex *Exchange) runPriceUpdates(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for market := range ex.orderbooks {
+			ex.updatePrice(market)
+		}
+		ex.revalueCollateral()
+	}
+}
+
+func (ex *Exchange) handleGetPrice(c echo.Context) error {
+	market := Market(c.Param("market"))
+	if _, ok := ex.orderbooks[market]; !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	mp, ok := ex.Prices.Get(string(market))
+	if !ok {
+		mp = ex.updatePrice(market)
+	}
+
+	return c.JSON(http.StatusOK, mp)
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/fineas02/matching-engine/orderbook"
+)
+
+const (
+	UserEventAmend = "amend"
+
+	reduceOnlyReason = "reduce-only order would increase the position"
+
+	// reduceOnlyEpsilon absorbs float noise when sizing reduce-only orders
+	reduceOnlyEpsilon = 1e-9
+)
+
+// closingOrders sums the size of the user's resting orders on the closing
+// side, split into regular and reduce-only orders. Must be called with ex.mu
+// held.
+func (ex *Exchange) closingOrders(orders []*orderbook.Order, userID int64, closingBid bool) (float64, float64) {
+	regular, reduceOnly := 0.0, 0.0
+	for _, order := range orders {
+		if order.UserID != userID || order.Bid != closingBid {
+			continue
+		}
+		if _, ok := ex.reduceOnly[order.ID]; ok {
+			reduceOnly += order.Size
+		} else {
+			regular += order.Size
+		}
+	}
+	return regular, reduceOnly
+}
+
+// sizeReduceOnly sizes a reduce-only or close-position request so it can't
+// increase the user's position. A close-position order takes the closing
+// side and the full size of the position. Market orders are capped at the
+// position, limit orders at what is left of it once every resting order on
+// the closing side filled, so they can't increase it whichever fills first.
+func (ex *Exchange) sizeReduceOnly(req *PlaceOrderRequest) error {
+	ob, ok := ex.orderbooks[req.Market]
+	if !ok {
+		return fmt.Errorf("market not found")
+	}
+	orders := ob.GetAllOrders()
+
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	user, ok := ex.Users[req.UserID]
+	if !ok {
+		return fmt.Errorf("user not found")
+	}
+
+	position := user.Position(string(req.Market))
+	if position.Size == 0 {
+		return fmt.Errorf("no position to reduce in %s", req.Market)
+	}
+
+	closingBid := position.Side == margin.SideShort
+	if req.ClosePosition {
+		req.Bid = closingBid
+		req.Size = position.Size
+		req.ReduceOnly = true
+	}
+	if req.Bid != closingBid {
+		return fmt.Errorf(reduceOnlyReason)
+	}
+
+	capacity := position.Size
+	if req.Type == LimitOrder {
+		regular, reduceOnly := ex.closingOrders(orders, req.UserID, closingBid)
+		capacity -= regular + reduceOnly
+	}
+	if capacity <= reduceOnlyEpsilon {
+		return fmt.Errorf("open orders already close the whole position")
+	}
+
+	req.Size = math.Min(req.Size, capacity)
+	return nil
+}
+
+// enforceReduceOnly cancels or shrinks the resting reduce-only orders in the
+// market that could increase a position after it changed. Older orders keep
+// their size first. Regular orders on the closing side count as if they
+// filled first.
+func (ex *Exchange) enforceReduceOnly(market Market) {
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return
+	}
+	orders := ob.GetAllOrders()
+	sort.Slice(orders, func(i, j int) bool {
+		if orders[i].Timestamp == orders[j].Timestamp {
+			return orders[i].ID < orders[j].ID
+		}
+		return orders[i].Timestamp < orders[j].Timestamp
+	})
+
+	type resize struct {
+		order *orderbook.Order
+		size  float64
+	}
+	resizes := []resize{}
+
+	ex.mu.Lock()
+	if len(ex.reduceOnly) == 0 {
+		ex.mu.Unlock()
+		return
+	}
+
+	live := make(map[int64]bool, len(orders))
+	capacity := make(map[int64]float64)
+	for _, order := range orders {
+		live[order.ID] = true
+		if _, ok := ex.reduceOnly[order.ID]; !ok {
+			continue
+		}
+
+		user, ok := ex.Users[order.UserID]
+		if !ok {
+			continue
+		}
+		position := user.Position(string(market))
+		closingBid := position.Side == margin.SideShort
+		if position.Size == 0 || order.Bid != closingBid {
+			resizes = append(resizes, resize{order: order})
+			continue
+		}
+
+		left, ok := capacity[user.ID]
+		if !ok {
+			regular, _ := ex.closingOrders(orders, user.ID, closingBid)
+			left = position.Size - regular
+		}
+		size := math.Max(math.Min(order.Size, left), 0)
+		if size <= reduceOnlyEpsilon {
+			size = 0
+		}
+		if size < order.Size {
+			resizes = append(resizes, resize{order: order, size: size})
+		}
+		capacity[user.ID] = left - size
+	}
+
+	// filled and cancelled orders are gone from the book
+	for id, m := range ex.reduceOnly {
+		if m == market && !live[id] {
+			delete(ex.reduceOnly, id)
+		}
+	}
+	ex.mu.Unlock()
+
+	for _, r := range resizes {
+		if r.size == 0 {
+			ex.cancelBookOrder(ob, r.order, reduceOnlyReason)
+			continue
+		}
+		if r.order.Limit == nil {
+			continue
+		}
+
+		price := r.order.Limit.Price
+		ex.releaseOrderMargin(r.order.UserID, r.order.ID, r.order.Size-r.size)
+		ob.ReduceOrder(r.order, r.size)
+		ex.publishOrderEvent(UserEventAmend, &Order{
+			UserID:     r.order.UserID,
+			ID:         r.order.ID,
+			Price:      price,
+			Size:       r.order.Size,
+			Bid:        r.order.Bid,
+			Timestamp:  r.order.Timestamp,
+			ReduceOnly: true,
+		}, reduceOnlyReason)
+	}
+}
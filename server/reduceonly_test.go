@@ -0,0 +1,187 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/labstack/echo/v4"
+)
+
+// placeOrder places req through the API and returns the status and the id
+// of the order.
+func placeOrder(t *testing.T, ex *Exchange, req PlaceOrderRequest) (int, int64) {
+	t.Helper()
+
+	if req.Market == "" {
+		req.Market = MarketETH
+	}
+	if req.Leverage == 0 {
+		req.Leverage = 1
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/order", strings.NewReader(string(body)))
+	r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	assert(t, ex.handlePlaceOrder(echo.New().NewContext(r, rec)), nil)
+
+	resp := PlaceOrderResponse{}
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code, resp.OrderID
+}
+
+// openPosition gives the user a position of size in ETH at 100, short when
+// size is negative.
+func openPosition(ex *Exchange, userID int64, size float64) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	ex.Users[userID].HandleTrade(string(MarketETH), math.Abs(size), 100, 1, size > 0)
+}
+
+// restingSize returns the size of the order in the book, 0 once it's gone.
+func restingSize(ex *Exchange, orderID int64) float64 {
+	order, ok := ex.orderbooks[MarketETH].Orders[orderID]
+	if !ok {
+		return 0
+	}
+	return order.Size
+}
+
+func TestReduceOnlyShrinksAfterPartialClose(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 10000, 2: 10000})
+	openPosition(ex, 1, 10)
+
+	status, reduceOnly := placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 10, Price: 110, ReduceOnly: true})
+	assert(t, status, http.StatusOK)
+
+	status, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: LimitOrder, Bid: true, Size: 4, Price: 100})
+	assert(t, status, http.StatusOK)
+	status, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: MarketOrder, Size: 4})
+	assert(t, status, http.StatusOK)
+
+	// only 6 is left to close
+	assertClose(t, ex.Users[1].Position(string(MarketETH)).Size, 6)
+	assertClose(t, restingSize(ex, reduceOnly), 6)
+}
+
+func TestReduceOnlyCancelledWhenPositionFlips(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 10000, 2: 10000})
+	openPosition(ex, 1, 5)
+
+	status, reduceOnly := placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 5, Price: 110, ReduceOnly: true})
+	assert(t, status, http.StatusOK)
+
+	status, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: LimitOrder, Bid: true, Size: 8, Price: 100})
+	assert(t, status, http.StatusOK)
+	status, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: MarketOrder, Size: 8})
+	assert(t, status, http.StatusOK)
+
+	// short 3 now, an ask would only add to it
+	position := ex.Users[1].Position(string(MarketETH))
+	assert(t, position.Side, margin.SideShort)
+	assertClose(t, position.Size, 3)
+	assertClose(t, restingSize(ex, reduceOnly), 0)
+
+	// and it no longer counts as an open order
+	ex.Users[1].Limits = margin.Limits{MaxOpenOrders: 1}
+	assert(t, ex.Users[1].CheckOpenOrders(), nil)
+}
+
+func TestRegularOrderTakesPriorityOverReduceOnly(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 10000})
+	openPosition(ex, 1, 10)
+
+	status, reduceOnly := placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 6, Price: 110, ReduceOnly: true})
+	assert(t, status, http.StatusOK)
+
+	// the newer regular order keeps its size, the older reduce-only one
+	// shrinks to what is left of the position
+	status, regular := placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 7, Price: 120})
+	assert(t, status, http.StatusOK)
+	assertClose(t, restingSize(ex, regular), 7)
+	assertClose(t, restingSize(ex, reduceOnly), 3)
+
+	// with the position spoken for, there's no room for another
+	status, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 1, Price: 130, ReduceOnly: true})
+	assert(t, status, http.StatusBadRequest)
+}
+
+func TestClosePositionSizesToThePosition(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 10000, 2: 10000})
+	openPosition(ex, 1, -4)
+
+	// the side and size of the request don't matter, the position decides
+	status, closing := placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 1, Price: 90, ClosePosition: true})
+	assert(t, status, http.StatusOK)
+	order := ex.orderbooks[MarketETH].Orders[closing]
+	assert(t, order.Bid, true)
+	assertClose(t, order.Size, 4)
+
+	ex.mu.RLock()
+	_, ok := ex.reduceOnly[closing]
+	ex.mu.RUnlock()
+	assert(t, ok, true)
+
+	// the resting order already closes everything
+	status, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Price: 95, ClosePosition: true})
+	assert(t, status, http.StatusBadRequest)
+
+	status, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Size: 4})
+	assert(t, status, http.StatusOK)
+	_, open := ex.Users[1].Positions[string(MarketETH)]
+	assert(t, open, false)
+
+	// nothing left to close
+	status, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: MarketOrder, ClosePosition: true})
+	assert(t, status, http.StatusBadRequest)
+}
+
+func TestReduceOnlyMarketOrderCantFlip(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 10000, 2: 10000})
+	openPosition(ex, 1, 3)
+
+	status, bid := placeOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: LimitOrder, Bid: true, Size: 10, Price: 100})
+	assert(t, status, http.StatusOK)
+
+	// selling 10 would leave user 1 short 7, it only closes the 3
+	status, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: MarketOrder, Size: 10, ReduceOnly: true})
+	assert(t, status, http.StatusOK)
+	_, open := ex.Users[1].Positions[string(MarketETH)]
+	assert(t, open, false)
+	assertClose(t, restingSize(ex, bid), 7)
+
+	// and a reduce-only order on the opening side is refused outright
+	openPosition(ex, 1, 3)
+	status, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: MarketOrder, Bid: true, Size: 1, ReduceOnly: true})
+	assert(t, status, http.StatusBadRequest)
+	assertLedger(t, ex)
+}
+
+func TestReduceOnlyCountsTowardsOpenOrderLimit(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 10000})
+	openPosition(ex, 1, 10)
+	ex.Users[1].Limits = margin.Limits{MaxOpenOrders: 2}
+
+	status, _ := placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 2, Price: 110, ReduceOnly: true})
+	assert(t, status, http.StatusOK)
+	status, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 2, Price: 120, ReduceOnly: true})
+	assert(t, status, http.StatusOK)
+
+	status, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 2, Price: 130, ReduceOnly: true})
+	assert(t, status, http.StatusBadRequest)
+	status, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 2, Price: 90})
+	assert(t, status, http.StatusBadRequest)
+}
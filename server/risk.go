@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/fineas02/matching-engine/risk"
+	"github.com/labstack/echo/v4"
+)
+
+// StressRequest runs custom scenarios, the default ones when empty.
+type StressRequest struct {
+	Scenarios []risk.Scenario
+}
+
+// stressTest runs the scenarios against every account and the insurance
+// fund as they are now.
+func (ex *Exchange) stressTest(scenarios []risk.Scenario) risk.Report {
+	configs := ex.marginConfigs()
+
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	users := make([]*margin.User, 0, len(ex.Users))
+	for _, user := range ex.Users {
+		users = append(users, user)
+	}
+
+	return risk.Run(users, configs, ex.Insurance.Balance, scenarios)
+}
+
+// defaultScenarios shocks all markets together.
+func (ex *Exchange) defaultScenarios() []risk.Scenario {
+	markets := make([]string, 0, len(ex.orderbooks))
+	for market := range ex.orderbooks {
+		markets = append(markets, string(market))
+	}
+	sort.Strings(markets)
+
+	return risk.DefaultScenarios(markets...)
+}
+
+func (ex *Exchange) handleGetRiskReport(c echo.Context) error {
+	return c.JSON(http.StatusOK, ex.stressTest(ex.defaultScenarios()))
+}
+
+func (ex *Exchange) handleStressTest(c echo.Context) error {
+	req := new(StressRequest)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	scenarios := req.Scenarios
+	if len(scenarios) == 0 {
+		scenarios = ex.defaultScenarios()
+	}
+	for i, scenario := range scenarios {
+		for market, shock := range scenario.Shocks {
+			if _, ok := ex.orderbooks[Market(market)]; !ok {
+				return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("market %s not found", market)})
+			}
+			if shock <= -1 {
+				return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("shock %f would take %s to zero", shock, market)})
+			}
+		}
+		if scenario.Name == "" {
+			scenarios[i].Name = fmt.Sprintf("scenario %d", i+1)
+		}
+	}
+
+	return c.JSON(http.StatusOK, ex.stressTest(scenarios))
+}
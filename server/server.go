@@ -4,11 +4,21 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"sync"
+	"time"
 
+	"github.com/fineas02/matching-engine/clock"
+	"github.com/fineas02/matching-engine/expiry"
+	"github.com/fineas02/matching-engine/fees"
+	"github.com/fineas02/matching-engine/funding"
+	"github.com/fineas02/matching-engine/ledger"
 	"github.com/fineas02/matching-engine/margin"
+	"github.com/fineas02/matching-engine/nft"
 	orderbook "github.com/fineas02/matching-engine/orderbook"
+	"github.com/fineas02/matching-engine/price"
+	"github.com/fineas02/matching-engine/statement"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
 )
@@ -23,26 +33,34 @@ type (
 	OrderType string
 	Market    string
 
+	// PlaceOrderRequest is a new order. A ReduceOnly order can only reduce
+	// the position, it is capped and cancelled as the position changes. A
+	// ClosePosition order takes the side and size of the whole position and
+	// is reduce-only.
 	PlaceOrderRequest struct {
-		UserID   int64
-		Leverage float64
-		Type     OrderType
-		Bid      bool
-		Size     float64
-		Price    float64
-		Market   Market
+		UserID        int64
+		Leverage      float64
+		Type          OrderType
+		Bid           bool
+		Size          float64
+		Price         float64
+		Market        Market
+		ReduceOnly    bool
+		ClosePosition bool
 	}
 
 	Order struct {
-		UserID    int64
-		ID        int64
-		Price     float64
-		Size      float64
-		Bid       bool
-		Timestamp int64
+		UserID     int64
+		ID         int64
+		Price      float64
+		Size       float64
+		Bid        bool
+		Timestamp  int64
+		ReduceOnly bool `json:",omitempty"`
 	}
 
 	OrderbookData struct {
+		Sequence       uint64
 		TotalBidVolume float64
 		TotalAskVolume float64
 		Asks           []*Order
@@ -65,12 +83,22 @@ func StartServer(ex *Exchange) {
 	e := echo.New()
 	e.HTTPErrorHandler = httpErrorHandler
 
-	ex.registerUser(0)
-	ex.registerUser(1)
-	ex.registerUser(2)
+	for userID := int64(0); userID < 3; userID++ {
+		ex.registerUser(userID)
+		if err := ex.fundUser(userID, margin.SettlementAsset, demoBalance); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	go ex.runPriceUpdates(priceUpdateInterval)
+	go ex.runLiquidations()
+	go ex.runFunding(fundingCheckInterval)
+	go ex.runWallet(walletProcessInterval)
+	go ex.runExpiries(expiryCheckInterval)
 
 	e.GET("/trades/:market", ex.handleGetTrades)
-	e.GET("/book/:market", ex.handleGetMarket)
+	e.GET("/book/:market", ex.handleGetDepth)
+	e.GET("/book/:market/l3", ex.handleGetMarket, ex.requireAdmin)
 	e.GET("/order/:userID", ex.handleGetOrders)
 	e.POST("/order", ex.handlePlaceOrder)
 
@@ -79,6 +107,47 @@ func StartServer(ex *Exchange) {
 	e.GET("book/:market/bid", ex.handleGetBestBid)
 	e.GET("book/:market/ask", ex.handleGetBestAsk)
 
+	e.GET("/markets/:market/price", ex.handleGetPrice)
+	e.GET("/markets/:market/funding", ex.handleGetFunding)
+	e.GET("/markets/:market/risk-tiers", ex.handleGetRiskTiers)
+	e.GET("/markets/:market/contract", ex.handleGetContract)
+	e.GET("/account/:userID", ex.handleGetAccount)
+	e.GET("/collateral", ex.handleGetCollateral)
+	e.POST("/collateral/price", ex.handleSetCollateralPrice, ex.requireAdmin)
+	e.GET("/limits/:userID", ex.handleGetLimits)
+	e.POST("/limits", ex.handleSetLimits, ex.requireAdmin)
+	e.POST("/margin/mode", ex.handleSetMarginMode)
+	e.POST("/margin/isolated", ex.handleAdjustIsolatedMargin)
+	e.POST("/deposit", ex.handleDeposit)
+	e.POST("/deposit/:id/confirm", ex.handleConfirmDeposit, ex.requireAdmin)
+	e.POST("/withdraw", ex.handleWithdraw)
+	e.GET("/deposits/:userID", ex.handleGetDeposits)
+	e.GET("/withdrawals/:userID", ex.handleGetWithdrawals)
+	e.GET("/ledger/check", ex.handleCheckLedger, ex.requireAdmin)
+	e.GET("/ledger/:userID", ex.handleGetLedger)
+	e.GET("/statements/:userID", ex.handleGetStatement)
+	e.GET("/fees", ex.handleGetFeeAccount, ex.requireAdmin)
+	e.GET("/fees/:userID", ex.handleGetUserFees)
+	e.POST("/fees/override", ex.handleSetFeeOverride, ex.requireAdmin)
+	e.DELETE("/fees/override/:userID", ex.handleClearFeeOverride, ex.requireAdmin)
+	e.GET("/liquidations", ex.handleGetLiquidations, ex.requireAdmin)
+	e.GET("/risk", ex.handleGetRiskReport, ex.requireAdmin)
+	e.POST("/risk/stress", ex.handleStressTest, ex.requireAdmin)
+	e.GET("/insurance", ex.handleGetInsuranceFund)
+	e.GET("/adl/:userID", ex.handleGetADLRank)
+
+	e.POST("/nft/order", ex.handlePlaceNFTOrder)
+	e.DELETE("/nft/order/:id", ex.handleCancelNFTOrder)
+	e.POST("/nft/mint", ex.handleMintNFT, ex.requireAdmin)
+	e.GET("/nft/tokens/:userID", ex.handleGetNFTTokens)
+	e.GET("/nft/:collection/token/:tokenID", ex.handleGetNFTToken)
+	e.GET("/nft/:collection/book", ex.handleGetNFTBook)
+	e.GET("/nft/:collection/trades", ex.handleGetNFTTrades)
+
+	e.GET("/ws", ex.handleFeed)
+	e.GET("/ws/user", ex.handleUserStream)
+	e.POST("/keys/:userID", ex.handleIssueAPIKey, ex.requireAdmin)
+
 	e.Start(":3000")
 }
 
@@ -101,35 +170,151 @@ type Exchange struct {
 	mu    sync.RWMutex
 	Users map[int64]*margin.User
 
+	// AdminKey guards the admin endpoints. Empty disables them
+	AdminKey string
+
 	MarketConfig map[Market]*margin.MarketConfig
 
 	// Orders maps users to their orders
 	Orders     map[int64][]*orderbook.Order
 	orderbooks map[Market]*orderbook.Orderbook
+	feeds      map[Market]*marketFeed
+
+	// apiKeys maps api keys to the user they authenticate
+	apiKeys     map[string]int64
+	userStreams *userStreams
+
+	// Prices holds the index and mark price of every market
+	Prices *price.Service
+
+	// Funding ties the perpetual markets to their index
+	Funding *funding.Service
+
+	// Expiries settles the dated markets
+	Expiries *expiry.Service
+
+	// Ledger journals every balance movement
+	Ledger *ledger.Ledger
+	wallet *wallet
+	clock  clock.Clock
+
+	// Fees prices fills, FeeAccount collects what they pay
+	Fees       *fees.Service
+	FeeAccount FeeAccount
+
+	// CollateralConfig holds the haircut of every asset accepted as
+	// collateral next to the settlement asset, CollateralPrices their price
+	// in the settlement asset
+	CollateralConfig map[string]*margin.CollateralConfig
+	CollateralPrices price.Source
+
+	// Insurance covers liquidations that close worse than bankruptcy
+	Insurance InsuranceFund
+
+	// reduceOnly holds the market of every resting reduce-only order
+	reduceOnly map[int64]Market
+
+	// tradeHistory keeps every fill of every user for statements
+	tradeHistory map[int64][]statement.Trade
+
+	// NFTs records who owns the tokens held by the exchange and NFTMetadata
+	// their traits, nftBooks trade them by collection and nftEscrow holds
+	// what every resting bid reserved
+	NFTs        *nft.Registry
+	NFTMetadata *nft.Metadata
+	nftBooks    map[string]*nft.Book
+	nftEscrow   map[int64]float64
+
+	liquidations     []LiquidationEvent
+	liquidationCheck chan struct{}
 }
 
-func NewExchange() (*Exchange, error) {
+// NewExchange creates an exchange whose index prices come from index.
+// A nil index leaves the mark price to follow the books.
+func NewExchange(index price.Source) (*Exchange, error) {
+	if index == nil {
+		index = price.NewStaticSource(nil)
+	}
+
 	orderbooks := make(map[Market]*orderbook.Orderbook)
 	orderbooks[MarketETH] = orderbook.NewOrderbook()
 
 	marketConfigs := make(map[Market]*margin.MarketConfig)
 	marketConfigs[MarketETH] = NewMarketConfig(0.10, 10.0, 0.05, 0.01, 0.01, 0.001) // use marketConfigs
+	marketConfigs[MarketETH].RiskTiers = defaultRiskTiers()
 
-	return &Exchange{
+	feeds := make(map[Market]*marketFeed)
+	for market, ob := range orderbooks {
+		feeds[market] = newMarketFeed(market, ob)
+	}
+
+	ex := &Exchange{
 		Users:        make(map[int64]*margin.User),
 		Orders:       make(map[int64][]*orderbook.Order),
 		orderbooks:   orderbooks,
+		feeds:        feeds,
+		apiKeys:      make(map[string]int64),
+		userStreams:  newUserStreams(),
+		wallet:       newWallet(),
+		Prices:       price.NewService(index, price.DefaultConfig()),
 		MarketConfig: marketConfigs,
-	}, nil
+		AdminKey:     os.Getenv("EXCHANGE_ADMIN_KEY"),
+
+		CollateralConfig: defaultCollateralConfig(),
+		CollateralPrices: price.NewStaticSource(defaultCollateralPrices),
+
+		reduceOnly:       make(map[int64]Market),
+		tradeHistory:     make(map[int64][]statement.Trade),
+		NFTs:             nft.NewRegistry(),
+		NFTMetadata:      nft.NewMetadata(),
+		nftBooks:         make(map[string]*nft.Book),
+		nftEscrow:        make(map[int64]float64),
+		liquidationCheck: make(chan struct{}, 1),
+	}
+	ex.SetClock(clock.System{})
+	ex.Prices.OnUpdate(ex.handlePriceUpdate)
+
+	return ex, nil
+}
+
+// SetClock replaces the clock funding, expiries, fee volumes and the ledger
+// run on. Their state starts over, so it is meant to be called before the
+// exchange starts.
+func (ex *Exchange) SetClock(clk clock.Clock) {
+	ex.clock = clk
+	ex.Funding = funding.NewService(clk, funding.DefaultConfig())
+	ex.Ledger = ledger.New(clk)
+
+	ex.Expiries = expiry.NewService(clk, expiry.DefaultConfig())
+	for market, config := range ex.MarketConfig {
+		if !config.IsDated() {
+			continue
+		}
+		if err := ex.Expiries.Add(expiry.Contract{Market: string(market), Expiry: config.Expiry}); err != nil {
+			logrus.Error(err)
+		}
+	}
+
+	ex.Fees = fees.NewService(clk)
+	for market := range ex.orderbooks {
+		ex.Fees.SetSchedule(string(market), fees.DefaultSchedule())
+	}
 }
 
 func (ex *Exchange) registerUser(userID int64) {
 	user := margin.NewUser(userID)
 	ex.Users[user.ID] = user
 
+	// the key is handed out through the admin endpoint, which rotates it
+	key, err := ex.issueAPIKey(user.ID)
+	if err != nil {
+		logrus.Error(err)
+	}
+
 	logrus.WithFields(logrus.Fields{
-		"balance": user.Balance,
-		"id":      userID,
+		"balance":           user.Balance,
+		"id":                userID,
+		"apiKeyFingerprint": keyFingerprint(key),
 	}).Info("new exchange user")
 }
 
@@ -192,15 +377,39 @@ func (ex *Exchange) cancelOrder(c echo.Context) error {
 	id, _ := strconv.Atoi(idStr)
 
 	ob := ex.orderbooks[MarketETH]
-	order := ob.Orders[int64(id)]
+	order, ok := ob.Orders[int64(id)]
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "order not found"})
+	}
 
-	ob.CancelOrder(order)
+	ex.cancelBookOrder(ob, order, "")
 
 	log.Println("order canceled id => ", id)
 
 	return c.JSON(200, map[string]any{"msg": "order deleted"})
 }
 
+// cancelBookOrder takes a resting order off the book, frees its margin and
+// lets its owner know.
+func (ex *Exchange) cancelBookOrder(ob *orderbook.Orderbook, order *orderbook.Order, reason string) {
+	if order.Limit == nil {
+		return
+	}
+	price := order.Limit.Price
+
+	ob.CancelOrder(order)
+	ex.releaseOrderMargin(order.UserID, order.ID, order.Size)
+
+	ex.publishOrderEvent(UserEventCancel, &Order{
+		UserID:    order.UserID,
+		ID:        order.ID,
+		Price:     price,
+		Size:      order.Size,
+		Bid:       order.Bid,
+		Timestamp: order.Timestamp,
+	}, reason)
+}
+
 type GetOrdersResponse struct {
 	Asks []Order
 	Bids []Order
@@ -227,13 +436,15 @@ func (ex *Exchange) handleGetOrders(c echo.Context) error {
 			continue
 		}
 
+		_, reduceOnly := ex.reduceOnly[orderbookOrders[i].ID]
 		order := Order{
-			ID:        orderbookOrders[i].ID,
-			UserID:    orderbookOrders[i].UserID,
-			Price:     orderbookOrders[i].Limit.Price,
-			Size:      orderbookOrders[i].Size,
-			Timestamp: orderbookOrders[i].Timestamp,
-			Bid:       orderbookOrders[i].Bid,
+			ID:         orderbookOrders[i].ID,
+			UserID:     orderbookOrders[i].UserID,
+			Price:      orderbookOrders[i].Limit.Price,
+			Size:       orderbookOrders[i].Size,
+			Timestamp:  orderbookOrders[i].Timestamp,
+			Bid:        orderbookOrders[i].Bid,
+			ReduceOnly: reduceOnly,
 		}
 
 		if order.Bid {
@@ -255,6 +466,7 @@ func (ex *Exchange) handleGetMarket(c echo.Context) error {
 	}
 
 	orderbookData := OrderbookData{
+		Sequence:       ob.Sequence(),
 		TotalBidVolume: ob.BidTotalVolume(),
 		TotalAskVolume: ob.AskTotalVolume(),
 		Asks:           []*Order{},
@@ -293,34 +505,73 @@ func (ex *Exchange) handleGetMarket(c echo.Context) error {
 
 }
 
-// Check if the order size is within the maximum allowable size given the user's balance and the market's max leverage
-func (ex *Exchange) handleCheckMaxContractSize(userID int64, market Market, orderSize float64) error {
-	ex.mu.RLock()
-	user, userExists := ex.Users[userID]
-	ex.mu.RUnlock()
+// reserveOrderMargin checks the order against the user's limits and the
+// market's risk tiers and holds back its initial margin out of the user's
+// available margin. Limit orders are priced at their limit price, market
+// orders at what the book would fill them at.
+func (ex *Exchange) reserveOrderMargin(req *PlaceOrderRequest, order *orderbook.Order) error {
+	config, ok := ex.MarketConfig[req.Market]
+	if !ok {
+		return fmt.Errorf("market not found")
+	}
 
-	if !userExists {
-		return fmt.Errorf("user not found")
+	price := req.Price
+	if req.Type == MarketOrder {
+		price, _ = ex.orderbooks[req.Market].MarketOrderPrice(req.Bid, req.Size)
+	}
+	if price == 0 {
+		price = ex.markPrice(req.Market)
 	}
 
-	marketConfig, marketExists := ex.MarketConfig[market]
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
 
-	if !marketExists {
-		return fmt.Errorf("market not found")
+	user, ok := ex.Users[req.UserID]
+	if !ok {
+		return fmt.Errorf("user not found")
 	}
 
-	equity := user.UpdateEquity()
-	price := ex.calculatePrice(market) // assuming you have a method to get the current price
-	maxContractSize := (equity * marketConfig.MaximumLeverage) / price
+	if err := user.CheckOrder(string(req.Market), req.Bid, req.Size, price, req.Leverage, config); err != nil {
+		return err
+	}
+
+	tier, _, _ := user.OrderTier(string(req.Market), req.Bid, req.Size, price, config)
+	amount := margin.OrderMargin(config, tier, req.Size, price, req.Leverage)
+	return user.ReserveOrderMargin(order.ID, string(req.Market), req.Bid, req.Size, amount, ex.marginConfigs())
+}
+
+// reserveReduceOnly records a reduce-only order. It frees margin rather than
+// tie it up, so it reserves none, but it still counts towards the user's
+// open orders.
+func (ex *Exchange) reserveReduceOnly(req *PlaceOrderRequest, order *orderbook.Order) error {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
 
-	if orderSize > maxContractSize {
-		return fmt.Errorf("order size too large: balance %f, maxContractSize %f, order size %f",
-			equity, maxContractSize, orderSize)
+	user, ok := ex.Users[req.UserID]
+	if !ok {
+		return fmt.Errorf("user not found")
+	}
+	if err := user.CheckOpenOrders(); err != nil {
+		return err
 	}
 
+	if err := user.ReserveOrderMargin(order.ID, string(req.Market), req.Bid, req.Size, 0, ex.marginConfigs()); err != nil {
+		return err
+	}
+	ex.reduceOnly[order.ID] = req.Market
 	return nil
 }
 
+// releaseOrderMargin frees the margin reserved for size of the order.
+func (ex *Exchange) releaseOrderMargin(userID, orderID int64, size float64) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	if user, ok := ex.Users[userID]; ok {
+		user.ReleaseOrderMargin(orderID, size)
+	}
+}
+
 func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order) ([]orderbook.Match, []*MatchedOrder) {
 	ob := ex.orderbooks[market]
 	matches := ob.PlaceMarketOrder(order)
@@ -433,23 +684,60 @@ func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
 		return err
 	}
 
+	if req.ReduceOnly || req.ClosePosition {
+		if err := ex.sizeReduceOnly(req); err != nil {
+			ex.rejectOrder(req, err)
+			return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+		}
+	}
+
 	// Perform the check before placing the order
-	if err := ex.handleCheckMaxContractSize(req.UserID, req.Market, req.Size); err != nil {
+	if err := ex.handleCheckOrder(req); err != nil {
+		ex.rejectOrder(req, err)
 		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
 	}
 
 	// If the check passes, create the order and add it to the orderbook
 	order := orderbook.NewOrder(req.Bid, req.Size, req.UserID, req.Leverage)
 
+	reserve := ex.reserveOrderMargin
+	if req.ReduceOnly {
+		reserve = ex.reserveReduceOnly
+	}
+	if err := reserve(req, order); err != nil {
+		ex.rejectOrder(req, err)
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	ex.publishOrderEvent(UserEventAck, &Order{
+		UserID:     order.UserID,
+		ID:         order.ID,
+		Price:      req.Price,
+		Size:       order.Size,
+		Bid:        order.Bid,
+		Timestamp:  order.Timestamp,
+		ReduceOnly: req.ReduceOnly,
+	}, "")
+
 	if req.Type == MarketOrder {
 		matches, _ := ex.handlePlaceMarketOrder(req.Market, order)
-		if err := ex.handleMatches(matches); err != nil {
+		err := ex.handleMatches(req.Market, matches)
+
+		// whatever didn't fill of a market order is gone
+		ex.releaseOrderMargin(order.UserID, order.ID, order.Size)
+
+		if err != nil {
 			return err
 		}
 	} else if req.Type == LimitOrder {
 		if err := ex.handlePlaceLimitOrder(req.Market, req.Price, order); err != nil {
 			return err
 		}
+		// a regular order on the closing side leaves less room for the
+		// reduce-only ones
+		if !req.ReduceOnly {
+			ex.enforceReduceOnly(req.Market)
+		}
 	}
 
 	resp := &PlaceOrderResponse{
@@ -458,14 +746,89 @@ func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
 	return c.JSON(200, resp)
 }
 
-func (ex *Exchange) handleMatches(matches []orderbook.Match) error {
-	// Assume a default user (could be your margin user) to receive the fees
-	feeRecipientUser, ok := ex.Users[2]
+// handleCheckOrder runs the pre-trade checks on the request that don't need
+// the order itself. Margin is checked when it is reserved.
+func (ex *Exchange) handleCheckOrder(req *PlaceOrderRequest) error {
+	ob, ok := ex.orderbooks[req.Market]
 	if !ok {
-		return fmt.Errorf("fee recipient user not found")
+		return fmt.Errorf("market not found")
+	}
+
+	if err := ex.checkMarketOpen(req.Market); err != nil {
+		return err
 	}
 
-	for _, match := range matches {
+	// reduce-only orders only ever close, every other order has to say
+	// what leverage it opens at
+	if !req.ReduceOnly && !(req.Leverage > 0) {
+		return fmt.Errorf("invalid leverage %f", req.Leverage)
+	}
+
+	if req.Type == MarketOrder {
+		available := ob.BidTotalVolume()
+		if req.Bid {
+			available = ob.AskTotalVolume()
+		}
+		if req.Size > available {
+			return fmt.Errorf("not enough volume [size: %.2f] for market order [size: %.2f]", available, req.Size)
+		}
+	}
+
+	return nil
+}
+
+func (ex *Exchange) rejectOrder(req *PlaceOrderRequest, err error) {
+	ex.mu.RLock()
+	_, ok := ex.Users[req.UserID]
+	ex.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	ex.publishOrderEvent(UserEventReject, &Order{
+		UserID:    req.UserID,
+		Price:     req.Price,
+		Size:      req.Size,
+		Bid:       req.Bid,
+		Timestamp: time.Now().UnixNano(),
+	}, err.Error())
+}
+
+// handleMatches settles the matches with the users involved and reprices the
+// market afterwards, which marks every position in it to market again.
+func (ex *Exchange) handleMatches(market Market, matches []orderbook.Match) error {
+	ex.mu.Lock()
+	err := ex.settleMatches(market, matches)
+	ex.mu.Unlock()
+
+	if len(matches) > 0 {
+		ex.updatePrice(market)
+		ex.enforceReduceOnly(market)
+	}
+
+	return err
+}
+
+func (ex *Exchange) settleMatches(market Market, matches []orderbook.Match) error {
+	// Orders are already matched, so walk back from their final size to find
+	// what was left of each order after every individual fill
+	remainingAsk := make([]float64, len(matches))
+	remainingBid := make([]float64, len(matches))
+	left := make(map[int64]float64)
+	for i := len(matches) - 1; i >= 0; i-- {
+		match := matches[i]
+		for _, order := range []*orderbook.Order{match.Ask, match.Bid} {
+			if _, ok := left[order.ID]; !ok {
+				left[order.ID] = order.Size
+			}
+		}
+		remainingAsk[i] = left[match.Ask.ID]
+		remainingBid[i] = left[match.Bid.ID]
+		left[match.Ask.ID] += match.SizeFilled
+		left[match.Bid.ID] += match.SizeFilled
+	}
+
+	for i, match := range matches {
 		fromUser, ok := ex.Users[match.Ask.UserID]
 		if !ok {
 			return fmt.Errorf("user not found: %d", match.Ask.UserID)
@@ -476,34 +839,69 @@ func (ex *Exchange) handleMatches(matches []orderbook.Match) error {
 			return fmt.Errorf("user not found: %d", match.Bid.UserID)
 		}
 
-		// Calculate the fee from the trade amount
-		tradeAmount := match.SizeFilled * match.Ask.Leverage // assuming this is the amount of the trade
-		fee := tradeAmount * 0.01                            // taking a 1% fee for example
+		// Price the fees before the fill counts towards the users' volume
+		notional := match.SizeFilled * match.Price
+		askFee := ex.Fees.Fee(string(market), fromUser.ID, notional, match.BidTaker)
+		bidFee := ex.Fees.Fee(string(market), toUser.ID, notional, !match.BidTaker)
 
 		// Let's log the status before the trade
 		logrus.WithFields(logrus.Fields{
 			"fromUserBalance": fromUser.Balance["ETH"],
 			"toUserBalance":   toUser.Balance["ETH"],
-			"tradeAmount":     tradeAmount,
+			"notional":        notional,
 		}).Info("Before trade")
 
-		// Let the users handle their trades
-		fromUser.HandleTrade("ETH", match.SizeFilled, false)
-		toUser.HandleTrade("ETH", match.SizeFilled, true)
-
-		// Deduct the fee from the users
-		fromUser.Balance["ETH"] -= fee
-		toUser.Balance["ETH"] -= fee
-
-		// Add the fee to the fee recipient user's balance
-		feeRecipientUser.Balance["ETH"] += fee * 2 // because we took fees from both users
+		// Let the users handle their trades, the margin reserved for the
+		// filled size is now position margin
+		fromUser.ReleaseOrderMargin(match.Ask.ID, match.SizeFilled)
+		toUser.ReleaseOrderMargin(match.Bid.ID, match.SizeFilled)
+		askPNL := fromUser.HandleTrade(string(market), match.SizeFilled, match.Price, match.Ask.Leverage, false)
+		bidPNL := toUser.HandleTrade(string(market), match.SizeFilled, match.Price, match.Bid.Leverage, true)
+		ex.postRealizedPNL(fromUser, orderReference(match.Ask.ID), askPNL)
+		ex.postRealizedPNL(toUser, orderReference(match.Bid.ID), bidPNL)
+		ex.coverIsolatedDeficit(fromUser, market, orderReference(match.Ask.ID))
+		ex.coverIsolatedDeficit(toUser, market, orderReference(match.Bid.ID))
+
+		ex.chargeFee(market, fromUser, match.Ask.ID, askFee)
+		ex.chargeFee(market, toUser, match.Bid.ID, bidFee)
+		ex.Fees.RecordTrade(fromUser.ID, notional)
+		ex.Fees.RecordTrade(toUser.ID, notional)
+		ex.recordTrade(fromUser.ID, market, orderReference(match.Ask.ID), false, match.Price, match.SizeFilled, askFee, askPNL)
+		ex.recordTrade(toUser.ID, market, orderReference(match.Bid.ID), true, match.Price, match.SizeFilled, bidFee, bidPNL)
 
 		// Let's log the status after the trade
 		logrus.WithFields(logrus.Fields{
 			"fromUserBalance": fromUser.Balance["ETH"],
 			"toUserBalance":   toUser.Balance["ETH"],
-			"fee recipient":   feeRecipientUser.Balance["ETH"],
+			"askFee":          askFee,
+			"bidFee":          bidFee,
 		}).Info("After trade")
+
+		ex.publishFill(match.Ask.UserID, &Fill{
+			OrderID:   match.Ask.ID,
+			Market:    market,
+			Price:     match.Price,
+			Size:      match.SizeFilled,
+			Remaining: remainingAsk[i],
+			Fee:       askFee,
+			Maker:     match.BidTaker,
+		})
+		ex.publishFill(match.Bid.UserID, &Fill{
+			OrderID:   match.Bid.ID,
+			Market:    market,
+			Bid:       true,
+			Price:     match.Price,
+			Size:      match.SizeFilled,
+			Remaining: remainingBid[i],
+			Fee:       bidFee,
+			Maker:     !match.BidTaker,
+		})
+
+		ex.publishPosition(fromUser, string(market))
+		ex.publishPosition(toUser, string(market))
+		ex.publishBalance(fromUser)
+		ex.publishBalance(toUser)
 	}
+
 	return nil
 }
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fineas02/matching-engine/clock"
+	"github.com/fineas02/matching-engine/ledger"
+	"github.com/fineas02/matching-engine/margin"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func assertClose(t *testing.T, a, b float64) {
+	t.Helper()
+	if math.Abs(a-b) > 1e-9 {
+		t.Errorf("%v != %v", a, b)
+	}
+}
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newTestExchange creates an exchange on a fake clock with a user for every
+// balance, funded with it.
+func newTestExchange(t *testing.T, balances map[int64]float64) (*Exchange, *clock.Fake) {
+	t.Helper()
+
+	ex, err := NewExchange(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewFake(start)
+	ex.SetClock(clk)
+
+	for userID, balance := range balances {
+		ex.registerUser(userID)
+		if balance > 0 {
+			if err := ex.fundUser(userID, margin.SettlementAsset, balance); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return ex, clk
+}
+
+// seedInsurance pays amount into the insurance fund from outside.
+func seedInsurance(ex *Exchange, amount float64) {
+	ex.Insurance.Balance += amount
+	ex.post(ledger.EntryLiquidation, "seed",
+		ledger.Transfer(ledger.AccountExternal, ledger.AccountInsurance, margin.SettlementAsset, amount)...)
+}
+
+// assertLedger fails the test when the ledger disagrees with the balances.
+func assertLedger(t *testing.T, ex *Exchange) {
+	t.Helper()
+
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	if err := ex.checkLedger(); err != nil {
+		t.Error(err)
+	}
+}
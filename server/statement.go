@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fineas02/matching-engine/ledger"
+	"github.com/fineas02/matching-engine/statement"
+	"github.com/labstack/echo/v4"
+)
+
+// recordTrade adds a fill to the user's trade history, which statements
+// take the market of realized PnL from. Must be called with ex.mu held.
+func (ex *Exchange) recordTrade(userID int64, market Market, reference string, bid bool, price, size, fee, pnl float64) {
+	ex.tradeHistory[userID] = append(ex.tradeHistory[userID], statement.Trade{
+		Timestamp:   ex.clock.Now().UnixNano(),
+		Market:      string(market),
+		Reference:   reference,
+		Bid:         bid,
+		Price:       price,
+		Size:        size,
+		Fee:         fee,
+		RealizedPNL: pnl,
+	})
+}
+
+// parseStatementTime reads an RFC 3339 time from the query, def when it is
+// missing.
+func parseStatementTime(c echo.Context, param string, def time.Time) (time.Time, error) {
+	value := c.QueryParam(param)
+	if value == "" {
+		return def, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s time %q, expected RFC 3339", param, value)
+	}
+	return t, nil
+}
+
+// handleGetStatement returns the statement of a user between the from and
+// to query times, all of its history by default. format=csv exports it as
+// CSV.
+func (ex *Exchange) handleGetStatement(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+
+	from, err := parseStatementTime(c, "from", time.Unix(0, 0))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	to, err := parseStatementTime(c, "to", ex.clock.Now().Add(time.Nanosecond))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	if !from.Before(to) {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "from has to be before to"})
+	}
+
+	ex.mu.RLock()
+	_, ok := ex.Users[int64(userID)]
+	trades := make([]statement.Trade, len(ex.tradeHistory[int64(userID)]))
+	copy(trades, ex.tradeHistory[int64(userID)])
+	ex.mu.RUnlock()
+
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "user not found"})
+	}
+
+	entries := ex.Ledger.Entries(ledger.UserAccount(int64(userID)))
+	s := statement.Build(int64(userID), entries, trades, from, to)
+
+	switch c.QueryParam("format") {
+	case "", "json":
+		return c.JSON(http.StatusOK, s)
+	case "csv":
+		c.Response().Header().Set(echo.HeaderContentType, "text/csv")
+		c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=statement-%d.csv", userID))
+		c.Response().WriteHeader(http.StatusOK)
+		return statement.WriteCSV(c.Response(), s)
+	default:
+		return c.JSON(http.StatusBadRequest, APIError{Error: "format has to be json or csv"})
+	}
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	UserEventAck         = "ack"
+	UserEventReject      = "reject"
+	UserEventPartialFill = "partial_fill"
+	UserEventFill        = "fill"
+	UserEventCancel      = "cancel"
+	UserEventPosition    = "position"
+	UserEventBalance     = "balance"
+	UserEventFunding     = "funding"
+
+	// UserEventReplayGap is sent when a client asks to replay from a sequence
+	// that is no longer kept. The client has to re-sync its state over REST.
+	UserEventReplayGap = "replay_gap"
+
+	// userStreamHistory is the number of events kept per user for replay
+	userStreamHistory = 1000
+)
+
+type (
+	// Fill is one execution of an order. Fee is what the fill cost, negative
+	// for a maker rebate.
+	Fill struct {
+		OrderID   int64
+		Market    Market
+		Bid       bool
+		Price     float64
+		Size      float64
+		Remaining float64
+		Fee       float64
+		Maker     bool
+	}
+
+	// UserEvent is pushed on a user's private stream. Sequence is per user
+	// and increases by one for every event.
+	UserEvent struct {
+		Sequence    uint64
+		Type        string
+		UserID      int64
+		Timestamp   int64
+		Order       *Order             `json:",omitempty"`
+		Fill        *Fill              `json:",omitempty"`
+		Position    *margin.Position   `json:",omitempty"`
+		Liquidation *LiquidationEvent  `json:",omitempty"`
+		Funding     *FundingPayment    `json:",omitempty"`
+		Deposit     *Deposit           `json:",omitempty"`
+		Withdrawal  *Withdrawal        `json:",omitempty"`
+		Balance     map[string]float64 `json:",omitempty"`
+		Reason      string             `json:",omitempty"`
+	}
+)
+
+type userStream struct {
+	seq     uint64
+	history []UserEvent
+	conns   map[*feedConn]bool
+}
+
+// userStreams keeps the private event stream of every user.
+type userStreams struct {
+	mu      sync.Mutex
+	streams map[int64]*userStream
+}
+
+func newUserStreams() *userStreams {
+	return &userStreams{
+		streams: make(map[int64]*userStream),
+	}
+}
+
+func (us *userStreams) stream(userID int64) *userStream {
+	s, ok := us.streams[userID]
+	if !ok {
+		s = &userStream{conns: make(map[*feedConn]bool)}
+		us.streams[userID] = s
+	}
+	return s
+}
+
+// publish sequences the event, keeps it for replay and sends it to every
+// connection of the user.
+func (us *userStreams) publish(userID int64, event UserEvent) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	s := us.stream(userID)
+	s.seq++
+
+	event.Sequence = s.seq
+	event.UserID = userID
+	event.Timestamp = time.Now().UnixNano()
+
+	s.history = append(s.history, event)
+	if len(s.history) > userStreamHistory {
+		s.history = s.history[len(s.history)-userStreamHistory:]
+	}
+
+	if len(s.conns) == 0 {
+		return
+	}
+
+	msg, err := json.Marshal(event)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	for conn := range s.conns {
+		conn.enqueue(msg)
+	}
+}
+
+// subscribe replays every kept event after since and then streams new ones.
+func (us *userStreams) subscribe(conn *feedConn, userID int64, since uint64) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	s := us.stream(userID)
+
+	if len(s.history) > 0 && since+1 < s.history[0].Sequence {
+		conn.enqueueJSON(UserEvent{
+			Sequence: s.history[0].Sequence - 1,
+			Type:     UserEventReplayGap,
+			UserID:   userID,
+			Reason:   "requested sequence is no longer available",
+		})
+	}
+
+	for _, event := range s.history {
+		if event.Sequence > since {
+			conn.enqueueJSON(event)
+		}
+	}
+
+	s.conns[conn] = true
+}
+
+func (us *userStreams) unsubscribe(conn *feedConn, userID int64) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	delete(us.stream(userID).conns, conn)
+}
+
+// handleUserStream serves the private stream of the authenticated user.
+// Pass ?since=<sequence> to replay the events missed while disconnected.
+func (ex *Exchange) handleUserStream(c echo.Context) error {
+	userID, ok := ex.authenticate(c)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, APIError{Error: "invalid api key"})
+	}
+
+	var since uint64
+	if v := c.QueryParam("since"); v != "" {
+		s, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: "invalid since"})
+		}
+		since = s
+	}
+
+	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return err
+	}
+
+	conn := newFeedConn(ws)
+	go conn.writeLoop()
+
+	ex.userStreams.subscribe(conn, userID, since)
+	defer func() {
+		ex.userStreams.unsubscribe(conn, userID)
+		conn.close()
+	}()
+
+	// The stream is push only, reading is needed to notice the client leaving
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return nil
+		}
+	}
+}
+
+func (ex *Exchange) publishOrderEvent(eventType string, order *Order, reason string) {
+	ex.userStreams.publish(order.UserID, UserEvent{
+		Type:   eventType,
+		Order:  order,
+		Reason: reason,
+	})
+}
+
+func (ex *Exchange) publishFill(userID int64, fill *Fill) {
+	eventType := UserEventPartialFill
+	if fill.Remaining == 0.0 {
+		eventType = UserEventFill
+	}
+
+	ex.userStreams.publish(userID, UserEvent{
+		Type: eventType,
+		Fill: fill,
+	})
+}
+
+func (ex *Exchange) publishPosition(user *margin.User, asset string) {
+	position := user.Position(asset)
+
+	ex.userStreams.publish(user.ID, UserEvent{
+		Type:     UserEventPosition,
+		Position: &position,
+	})
+}
+
+func (ex *Exchange) publishBalance(user *margin.User) {
+	balance := make(map[string]float64, len(user.Balance))
+	for asset, amount := range user.Balance {
+		balance[asset] = amount
+	}
+
+	ex.userStreams.publish(user.ID, UserEvent{
+		Type:    UserEventBalance,
+		Balance: balance,
+	})
+}
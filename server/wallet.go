@@ -0,0 +1,445 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/fineas02/matching-engine/ledger"
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	UserEventDeposit    = "deposit"
+	UserEventWithdrawal = "withdrawal"
+
+	DepositPending   = "pending"
+	DepositConfirmed = "confirmed"
+	DepositCredited  = "credited"
+
+	WithdrawalRequested   = "requested"
+	WithdrawalRiskChecked = "risk_checked"
+	WithdrawalSent        = "sent"
+	WithdrawalRejected    = "rejected"
+
+	// AccountWithdrawals holds withdrawals that passed the risk check until
+	// they are sent
+	AccountWithdrawals = "exchange:withdrawals"
+
+	walletProcessInterval = time.Second
+	// demoBalance is what the demo users get deposited at startup
+	demoBalance = 1000.0
+)
+
+type (
+	Deposit struct {
+		ID        int64
+		UserID    int64
+		Asset     string
+		Amount    float64
+		TxID      string
+		Status    string
+		CreatedAt int64
+		UpdatedAt int64
+	}
+
+	Withdrawal struct {
+		ID        int64
+		UserID    int64
+		Asset     string
+		Amount    float64
+		Address   string
+		Status    string
+		Reason    string `json:",omitempty"`
+		CreatedAt int64
+		UpdatedAt int64
+	}
+
+	DepositRequest struct {
+		Asset  string
+		Amount float64
+		TxID   string
+	}
+
+	WithdrawRequest struct {
+		Asset   string
+		Amount  float64
+		Address string
+	}
+)
+
+// wallet keeps the deposits and withdrawals of all users in the order they
+// were made.
+type wallet struct {
+	deposits    []*Deposit
+	withdrawals []*Withdrawal
+}
+
+func newWallet() *wallet {
+	return &wallet{}
+}
+
+func (ex *Exchange) checkTransferAmount(asset string, amount float64) error {
+	if _, ok := ex.CollateralConfig[asset]; !ok && asset != margin.SettlementAsset {
+		return fmt.Errorf("unsupported asset %s", asset)
+	}
+	if amount <= 0 || math.IsInf(amount, 0) || math.IsNaN(amount) {
+		return fmt.Errorf("invalid amount %f", amount)
+	}
+	return nil
+}
+
+// requestDeposit records an incoming deposit. It is credited once the chain
+// watcher confirms it through confirmDeposit, a transaction is only ever
+// recorded once per asset.
+func (ex *Exchange) requestDeposit(userID int64, asset string, amount float64, txID string) (Deposit, error) {
+	if err := ex.checkTransferAmount(asset, amount); err != nil {
+		return Deposit{}, err
+	}
+	if txID == "" {
+		return Deposit{}, fmt.Errorf("missing transaction id")
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	if _, ok := ex.Users[userID]; !ok {
+		return Deposit{}, fmt.Errorf("user not found")
+	}
+	for _, deposit := range ex.wallet.deposits {
+		if deposit.Asset == asset && deposit.TxID == txID {
+			return Deposit{}, fmt.Errorf("transaction %s already deposited", txID)
+		}
+	}
+
+	now := ex.clock.Now().UnixNano()
+	deposit := &Deposit{
+		ID:        int64(len(ex.wallet.deposits) + 1),
+		UserID:    userID,
+		Asset:     asset,
+		Amount:    amount,
+		TxID:      txID,
+		Status:    DepositPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	ex.wallet.deposits = append(ex.wallet.deposits, deposit)
+	ex.publishDeposit(deposit)
+
+	return *deposit, nil
+}
+
+// requestWithdrawal records a withdrawal. Whether the user can afford it is
+// decided by the risk check when it is processed.
+func (ex *Exchange) requestWithdrawal(userID int64, asset string, amount float64, address string) (Withdrawal, error) {
+	if err := ex.checkTransferAmount(asset, amount); err != nil {
+		return Withdrawal{}, err
+	}
+	if address == "" {
+		return Withdrawal{}, fmt.Errorf("missing withdrawal address")
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	if _, ok := ex.Users[userID]; !ok {
+		return Withdrawal{}, fmt.Errorf("user not found")
+	}
+
+	now := ex.clock.Now().UnixNano()
+	withdrawal := &Withdrawal{
+		ID:        int64(len(ex.wallet.withdrawals) + 1),
+		UserID:    userID,
+		Asset:     asset,
+		Amount:    amount,
+		Address:   address,
+		Status:    WithdrawalRequested,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	ex.wallet.withdrawals = append(ex.wallet.withdrawals, withdrawal)
+	ex.publishWithdrawal(withdrawal)
+
+	return *withdrawal, nil
+}
+
+// runWallet moves deposits and withdrawals along.
+func (ex *Exchange) runWallet(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ex.processWallet()
+	}
+}
+
+// processWallet moves every deposit and withdrawal that is ready one state
+// further. Pending deposits wait for confirmDeposit.
+func (ex *Exchange) processWallet() {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	for _, deposit := range ex.wallet.deposits {
+		if deposit.Status == DepositConfirmed {
+			ex.creditDeposit(deposit)
+		}
+	}
+
+	for _, withdrawal := range ex.wallet.withdrawals {
+		switch withdrawal.Status {
+		case WithdrawalRequested:
+			ex.riskCheckWithdrawal(withdrawal)
+		case WithdrawalRiskChecked:
+			ex.sendWithdrawal(withdrawal)
+		}
+	}
+}
+
+// confirmDeposit marks a pending deposit as confirmed on chain, it is
+// credited on the next run of processWallet.
+func (ex *Exchange) confirmDeposit(depositID int64) (Deposit, error) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	if depositID < 1 || depositID > int64(len(ex.wallet.deposits)) {
+		return Deposit{}, fmt.Errorf("deposit %d not found", depositID)
+	}
+	deposit := ex.wallet.deposits[depositID-1]
+	if deposit.Status != DepositPending {
+		return Deposit{}, fmt.Errorf("deposit %d is %s", depositID, deposit.Status)
+	}
+
+	ex.markDepositConfirmed(deposit)
+	return *deposit, nil
+}
+
+// markDepositConfirmed must be called with ex.mu held.
+func (ex *Exchange) markDepositConfirmed(deposit *Deposit) {
+	deposit.Status = DepositConfirmed
+	deposit.UpdatedAt = ex.clock.Now().UnixNano()
+	ex.publishDeposit(deposit)
+}
+
+// creditDeposit adds a confirmed deposit to the user's balance. Must be
+// called with ex.mu held.
+func (ex *Exchange) creditDeposit(deposit *Deposit) {
+	user, ok := ex.Users[deposit.UserID]
+	if !ok {
+		return
+	}
+
+	user.Balance[deposit.Asset] += deposit.Amount
+	ex.markCollateral(user)
+	ex.post(ledger.EntryDeposit, depositReference(deposit.ID),
+		ledger.Transfer(ledger.AccountExternal, ledger.UserAccount(user.ID), deposit.Asset, deposit.Amount)...)
+
+	deposit.Status = DepositCredited
+	deposit.UpdatedAt = ex.clock.Now().UnixNano()
+	ex.publishDeposit(deposit)
+	ex.publishBalance(user)
+}
+
+// riskCheckWithdrawal takes the withdrawal out of the user's balance if the
+// user can spare it: it has to be covered by the balance itself, not by
+// unrealized profits, and leave the margin of open positions and orders in
+// place, counting collateral at its haircut value. Must be called with ex.mu
+// held.
+func (ex *Exchange) riskCheckWithdrawal(withdrawal *Withdrawal) {
+	user, ok := ex.Users[withdrawal.UserID]
+	if !ok {
+		return
+	}
+
+	withdrawable := user.Withdrawable(withdrawal.Asset, ex.marginConfigs())
+	if withdrawal.Amount > withdrawable {
+		withdrawal.Status = WithdrawalRejected
+		withdrawal.Reason = fmt.Sprintf("insufficient free margin: withdrawable %f", withdrawable)
+		withdrawal.UpdatedAt = ex.clock.Now().UnixNano()
+		ex.publishWithdrawal(withdrawal)
+		return
+	}
+
+	user.Balance[withdrawal.Asset] -= withdrawal.Amount
+	user.UpdateEquity()
+	ex.post(ledger.EntryWithdrawal, withdrawalReference(withdrawal.ID),
+		ledger.Transfer(ledger.UserAccount(user.ID), AccountWithdrawals, withdrawal.Asset, withdrawal.Amount)...)
+
+	withdrawal.Status = WithdrawalRiskChecked
+	withdrawal.UpdatedAt = ex.clock.Now().UnixNano()
+	ex.publishWithdrawal(withdrawal)
+	ex.publishBalance(user)
+}
+
+// sendWithdrawal pays out a risk checked withdrawal. Must be called with
+// ex.mu held.
+func (ex *Exchange) sendWithdrawal(withdrawal *Withdrawal) {
+	ex.post(ledger.EntryWithdrawal, withdrawalReference(withdrawal.ID),
+		ledger.Transfer(AccountWithdrawals, ledger.AccountExternal, withdrawal.Asset, withdrawal.Amount)...)
+
+	withdrawal.Status = WithdrawalSent
+	withdrawal.UpdatedAt = ex.clock.Now().UnixNano()
+	ex.publishWithdrawal(withdrawal)
+}
+
+// fundUser credits amount to the user right away, skipping confirmations.
+// It seeds the demo users.
+func (ex *Exchange) fundUser(userID int64, asset string, amount float64) error {
+	ex.mu.RLock()
+	txID := fmt.Sprintf("seed:%d", len(ex.wallet.deposits)+1)
+	ex.mu.RUnlock()
+
+	deposit, err := ex.requestDeposit(userID, asset, amount, txID)
+	if err != nil {
+		return err
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	d := ex.wallet.deposits[deposit.ID-1]
+	ex.markDepositConfirmed(d)
+	ex.creditDeposit(d)
+
+	return nil
+}
+
+func depositReference(depositID int64) string {
+	return fmt.Sprintf("deposit:%d", depositID)
+}
+
+func withdrawalReference(withdrawalID int64) string {
+	return fmt.Sprintf("withdrawal:%d", withdrawalID)
+}
+
+func (ex *Exchange) publishDeposit(deposit *Deposit) {
+	d := *deposit
+	ex.userStreams.publish(deposit.UserID, UserEvent{
+		Type:    UserEventDeposit,
+		Deposit: &d,
+	})
+}
+
+func (ex *Exchange) publishWithdrawal(withdrawal *Withdrawal) {
+	w := *withdrawal
+	ex.userStreams.publish(withdrawal.UserID, UserEvent{
+		Type:       UserEventWithdrawal,
+		Withdrawal: &w,
+	})
+}
+
+func (ex *Exchange) handleDeposit(c echo.Context) error {
+	userID, ok := ex.authenticate(c)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, APIError{Error: "invalid api key"})
+	}
+
+	req := new(DepositRequest)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	deposit, err := ex.requestDeposit(userID, req.Asset, req.Amount, req.TxID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"userID": userID,
+		"asset":  deposit.Asset,
+		"amount": deposit.Amount,
+	}).Info("deposit pending")
+
+	return c.JSON(http.StatusOK, deposit)
+}
+
+// handleConfirmDeposit is called by the chain watcher once a deposit has
+// enough confirmations.
+func (ex *Exchange) handleConfirmDeposit(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid deposit id"})
+	}
+
+	deposit, err := ex.confirmDeposit(id)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"userID":    deposit.UserID,
+		"depositID": deposit.ID,
+		"txID":      deposit.TxID,
+	}).Info("deposit confirmed")
+
+	return c.JSON(http.StatusOK, deposit)
+}
+
+func (ex *Exchange) handleWithdraw(c echo.Context) error {
+	userID, ok := ex.authenticate(c)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, APIError{Error: "invalid api key"})
+	}
+
+	req := new(WithdrawRequest)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	withdrawal, err := ex.requestWithdrawal(userID, req.Asset, req.Amount, req.Address)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"userID": userID,
+		"asset":  withdrawal.Asset,
+		"amount": withdrawal.Amount,
+	}).Info("withdrawal requested")
+
+	return c.JSON(http.StatusOK, withdrawal)
+}
+
+func (ex *Exchange) handleGetDeposits(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	deposits := []Deposit{}
+	for _, deposit := range ex.wallet.deposits {
+		if deposit.UserID == int64(userID) {
+			deposits = append(deposits, *deposit)
+		}
+	}
+	sort.Slice(deposits, func(i, j int) bool { return deposits[i].ID > deposits[j].ID })
+
+	return c.JSON(http.StatusOK, deposits)
+}
+
+func (ex *Exchange) handleGetWithdrawals(c echo.Context) error {
+	userID, err := strconv.Atoi(c.Param("userID"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	withdrawals := []Withdrawal{}
+	for _, withdrawal := range ex.wallet.withdrawals {
+		if withdrawal.UserID == int64(userID) {
+			withdrawals = append(withdrawals, *withdrawal)
+		}
+	}
+	sort.Slice(withdrawals, func(i, j int) bool { return withdrawals[i].ID > withdrawals[j].ID })
+
+	return c.JSON(http.StatusOK, withdrawals)
+}
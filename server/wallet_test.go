@@ -0,0 +1,217 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fineas02/matching-engine/margin"
+	"github.com/labstack/echo/v4"
+)
+
+func TestDepositWaitsForConfirmation(t *testing.T) {
+	ex, clk := newTestExchange(t, map[int64]float64{1: 0})
+
+	deposit, err := ex.requestDeposit(1, margin.SettlementAsset, 5, "0xabc")
+	assert(t, err, nil)
+	assert(t, deposit.Status, DepositPending)
+
+	// however long it waits, nothing but a confirmation credits it
+	clk.Advance(time.Hour)
+	ex.processWallet()
+	assert(t, ex.wallet.deposits[0].Status, DepositPending)
+	assertClose(t, ex.Users[1].Balance[margin.SettlementAsset], 0)
+
+	deposit, err = ex.confirmDeposit(deposit.ID)
+	assert(t, err, nil)
+	assert(t, deposit.Status, DepositConfirmed)
+	assertClose(t, ex.Users[1].Balance[margin.SettlementAsset], 0)
+
+	ex.processWallet()
+	assert(t, ex.wallet.deposits[0].Status, DepositCredited)
+	assertClose(t, ex.Users[1].Balance[margin.SettlementAsset], 5)
+	assertLedger(t, ex)
+
+	// a deposit is confirmed once
+	_, err = ex.confirmDeposit(deposit.ID)
+	assert(t, err != nil, true)
+	_, err = ex.confirmDeposit(2)
+	assert(t, err != nil, true)
+	_, err = ex.confirmDeposit(0)
+	assert(t, err != nil, true)
+}
+
+func TestDepositRejections(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 0, 2: 0})
+
+	_, err := ex.requestDeposit(1, margin.SettlementAsset, 5, "0xabc")
+	assert(t, err, nil)
+
+	// the same transaction can't be deposited twice, by anyone
+	_, err = ex.requestDeposit(1, margin.SettlementAsset, 5, "0xabc")
+	assert(t, err != nil, true)
+	_, err = ex.requestDeposit(2, margin.SettlementAsset, 7, "0xabc")
+	assert(t, err != nil, true)
+	_, err = ex.requestDeposit(1, "USDC", 5, "0xabc")
+	assert(t, err, nil)
+
+	_, err = ex.requestDeposit(1, margin.SettlementAsset, 5, "")
+	assert(t, err != nil, true)
+	_, err = ex.requestDeposit(3, margin.SettlementAsset, 5, "0xdef")
+	assert(t, err != nil, true)
+	_, err = ex.requestDeposit(1, margin.SettlementAsset, -5, "0xdef")
+	assert(t, err != nil, true)
+	_, err = ex.requestDeposit(1, "DOGE", 5, "0xdef")
+	assert(t, err != nil, true)
+
+	assert(t, len(ex.wallet.deposits), 2)
+}
+
+func TestConfirmDepositNeedsAdmin(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 0})
+	ex.AdminKey = "admin"
+
+	deposit, err := ex.requestDeposit(1, margin.SettlementAsset, 5, "0xabc")
+	assert(t, err, nil)
+
+	confirm := func(key string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set(adminKeyHeader, key)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues("1")
+		assert(t, ex.requireAdmin(ex.handleConfirmDeposit)(c), nil)
+		return rec.Code
+	}
+
+	assert(t, confirm(""), http.StatusUnauthorized)
+	assert(t, confirm("user"), http.StatusUnauthorized)
+	assert(t, ex.wallet.deposits[deposit.ID-1].Status, DepositPending)
+
+	assert(t, confirm("admin"), http.StatusOK)
+	assert(t, ex.wallet.deposits[deposit.ID-1].Status, DepositConfirmed)
+	assert(t, confirm("admin"), http.StatusBadRequest)
+}
+
+func TestWithdrawalIsRiskCheckedAndSent(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 100})
+
+	withdrawal, err := ex.requestWithdrawal(1, margin.SettlementAsset, 40, "0xuser")
+	assert(t, err, nil)
+	assert(t, withdrawal.Status, WithdrawalRequested)
+	assertClose(t, ex.Users[1].Balance[margin.SettlementAsset], 100)
+
+	ex.processWallet()
+	assert(t, ex.wallet.withdrawals[0].Status, WithdrawalRiskChecked)
+	assertClose(t, ex.Users[1].Balance[margin.SettlementAsset], 60)
+	assertLedger(t, ex)
+
+	ex.processWallet()
+	assert(t, ex.wallet.withdrawals[0].Status, WithdrawalSent)
+	assertClose(t, ex.Users[1].Balance[margin.SettlementAsset], 60)
+	assertLedger(t, ex)
+}
+
+func TestWithdrawalRejections(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 100})
+
+	_, err := ex.requestWithdrawal(1, margin.SettlementAsset, 40, "")
+	assert(t, err != nil, true)
+	_, err = ex.requestWithdrawal(2, margin.SettlementAsset, 40, "0xuser")
+	assert(t, err != nil, true)
+	_, err = ex.requestWithdrawal(1, margin.SettlementAsset, 0, "0xuser")
+	assert(t, err != nil, true)
+	_, err = ex.requestWithdrawal(1, "DOGE", 40, "0xuser")
+	assert(t, err != nil, true)
+	assert(t, len(ex.wallet.withdrawals), 0)
+
+	// the margin of an open position can't be withdrawn
+	ex.mu.Lock()
+	ex.Users[1].HandleTrade(string(MarketETH), 5, 100, 10, true)
+	ex.Users[1].MarkToMarket(string(MarketETH), 100)
+	ex.mu.Unlock()
+
+	_, err = ex.requestWithdrawal(1, margin.SettlementAsset, 60, "0xuser")
+	assert(t, err, nil)
+
+	ex.processWallet()
+	withdrawal := ex.wallet.withdrawals[0]
+	assert(t, withdrawal.Status, WithdrawalRejected)
+	assert(t, withdrawal.Reason != "", true)
+	assertClose(t, ex.Users[1].Balance[margin.SettlementAsset], 100)
+
+	// a rejected withdrawal stays rejected
+	ex.processWallet()
+	assert(t, withdrawal.Status, WithdrawalRejected)
+	assertLedger(t, ex)
+}
+
+func TestDepositAndWithdrawThroughTheAPI(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 0})
+	ex.AdminKey = "admin"
+	key := issueKey(t, ex, "1")
+
+	// the private endpoints need the user's key
+	rec := serve(t, ex.handleDeposit, http.MethodPost, `{"Asset": "ETH", "Amount": 50, "TxID": "0xabc"}`, nil)
+	assert(t, rec.Code, http.StatusUnauthorized)
+	rec = serve(t, ex.handleDeposit, http.MethodPost, `{"Asset": "ETH", "Amount": 50, "TxID": "0xabc"}`, withKey("wrong"))
+	assert(t, rec.Code, http.StatusUnauthorized)
+
+	rec = serve(t, ex.handleDeposit, http.MethodPost, `{"Asset": "ETH", "Amount": 50, "TxID": "0xabc"}`, withKey(key))
+	assert(t, rec.Code, http.StatusOK)
+	deposit := Deposit{}
+	assert(t, json.Unmarshal(rec.Body.Bytes(), &deposit), nil)
+	assert(t, deposit.UserID, int64(1))
+	assert(t, deposit.Status, DepositPending)
+
+	rec = serve(t, ex.handleDeposit, http.MethodPost, `{"Asset": "ETH", "Amount": 50, "TxID": "0xabc"}`, withKey(key))
+	assert(t, rec.Code, http.StatusBadRequest)
+
+	header := http.Header{adminKeyHeader: {"admin"}}
+	rec = serve(t, ex.requireAdmin(ex.handleConfirmDeposit), http.MethodPost, "", header, "id", strconv.FormatInt(deposit.ID, 10))
+	assert(t, rec.Code, http.StatusOK)
+	ex.processWallet()
+	assertClose(t, ex.Users[1].Balance[margin.SettlementAsset], 50)
+
+	rec = serve(t, ex.handleWithdraw, http.MethodPost, `{"Asset": "ETH", "Amount": 20, "Address": "0xuser"}`, nil)
+	assert(t, rec.Code, http.StatusUnauthorized)
+	rec = serve(t, ex.handleWithdraw, http.MethodPost, `{"Asset": "ETH", "Amount": 20}`, withKey(key))
+	assert(t, rec.Code, http.StatusBadRequest)
+
+	rec = serve(t, ex.handleWithdraw, http.MethodPost, `{"Asset": "ETH", "Amount": 20, "Address": "0xuser"}`, withKey(key))
+	assert(t, rec.Code, http.StatusOK)
+	withdrawal := Withdrawal{}
+	assert(t, json.Unmarshal(rec.Body.Bytes(), &withdrawal), nil)
+	assert(t, withdrawal.UserID, int64(1))
+	assert(t, withdrawal.Status, WithdrawalRequested)
+
+	ex.processWallet()
+	ex.processWallet()
+	assert(t, ex.wallet.withdrawals[0].Status, WithdrawalSent)
+	assertClose(t, ex.Users[1].Balance[margin.SettlementAsset], 30)
+	assertLedger(t, ex)
+}
+
+func TestPendingCollateralWithdrawalBalancesLedger(t *testing.T) {
+	ex, _ := newTestExchange(t, map[int64]float64{1: 100})
+	assert(t, ex.fundUser(1, "USDC", 1000), nil)
+
+	_, err := ex.requestWithdrawal(1, "USDC", 400, "0xuser")
+	assert(t, err, nil)
+	_, err = ex.requestWithdrawal(1, margin.SettlementAsset, 10, "0xuser")
+	assert(t, err, nil)
+
+	// both are risk checked and wait to be sent, each in its own asset
+	ex.processWallet()
+	assert(t, ex.wallet.withdrawals[0].Status, WithdrawalRiskChecked)
+	assert(t, ex.wallet.withdrawals[1].Status, WithdrawalRiskChecked)
+	assertClose(t, ex.Users[1].Balance["USDC"], 600)
+	assertLedger(t, ex)
+
+	ex.processWallet()
+	assertLedger(t, ex)
+}
@@ -0,0 +1,207 @@
+package statement
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fineas02/matching-engine/ledger"
+)
+
+// Trade is one fill of a user as kept in the trade history. Reference is the
+// ledger reference its realized PnL and fee were journaled under.
+type Trade struct {
+	Timestamp   int64
+	Market      string
+	Reference   string
+	Bid         bool
+	Price       float64
+	Size        float64
+	Fee         float64
+	RealizedPNL float64
+}
+
+// Statement summarizes the activity of a user between From and To. Amounts
+// are what the user's account received, negative when it paid: Fees is
+// negative for fees paid and Funding for funding paid. Withdrawals are
+// positive. Liquidations is what went between the user and the insurance
+// fund, Conversions the change of each asset from collateral sales and NFTs
+// what the user received for NFTs sold, less what it paid for NFTs bought.
+// Activity lists every movement of the account in the period.
+type Statement struct {
+	UserID          int64
+	From            int64
+	To              int64
+	OpeningBalances map[string]float64
+	ClosingBalances map[string]float64
+	RealizedPNL     map[string]float64
+	TotalPNL        float64
+	Fees            float64
+	Funding         float64
+	Deposits        map[string]float64
+	Withdrawals     map[string]float64
+	Liquidations    float64
+	Conversions     map[string]float64
+	NFTs            float64
+	Trades          []Trade
+	Activity        []Line
+}
+
+// Line is one movement of a user's account, the rows of the CSV export.
+type Line struct {
+	Timestamp int64
+	Type      string
+	Market    string
+	Asset     string
+	Amount    float64
+	Reference string
+}
+
+// marketOf returns the market an entry belongs to: the market of the trade
+// journaled under its reference, or the market named in references of the
+// form kind:market:id.
+func marketOf(reference string, markets map[string]string) string {
+	if market, ok := markets[reference]; ok {
+		return market
+	}
+	if parts := strings.Split(reference, ":"); len(parts) == 3 {
+		return parts[1]
+	}
+	return ""
+}
+
+// Build puts together the statement of the user from the ledger entries of
+// its account and its trade history, both oldest first. Entries from From
+// on and before To count, earlier ones make up the opening balances.
+func Build(userID int64, entries []ledger.Entry, trades []Trade, from, to time.Time) Statement {
+	s := Statement{
+		UserID:          userID,
+		From:            from.UnixNano(),
+		To:              to.UnixNano(),
+		OpeningBalances: make(map[string]float64),
+		ClosingBalances: make(map[string]float64),
+		RealizedPNL:     make(map[string]float64),
+		Deposits:        make(map[string]float64),
+		Withdrawals:     make(map[string]float64),
+		Conversions:     make(map[string]float64),
+		Trades:          []Trade{},
+		Activity:        []Line{},
+	}
+
+	markets := make(map[string]string, len(trades))
+	for _, trade := range trades {
+		markets[trade.Reference] = trade.Market
+		if trade.Timestamp >= s.From && trade.Timestamp < s.To {
+			s.Trades = append(s.Trades, trade)
+		}
+	}
+
+	for _, line := range lines(userID, entries, markets) {
+		if line.Timestamp >= s.To {
+			break
+		}
+		if line.Timestamp < s.From {
+			s.OpeningBalances[line.Asset] += line.Amount
+			s.ClosingBalances[line.Asset] += line.Amount
+			continue
+		}
+		s.ClosingBalances[line.Asset] += line.Amount
+		s.Activity = append(s.Activity, line)
+
+		switch line.Type {
+		case ledger.EntryTrade:
+			s.RealizedPNL[line.Market] += line.Amount
+			s.TotalPNL += line.Amount
+		case ledger.EntryFee:
+			s.Fees += line.Amount
+		case ledger.EntryFunding:
+			s.Funding += line.Amount
+		case ledger.EntryDeposit:
+			s.Deposits[line.Asset] += line.Amount
+		case ledger.EntryWithdrawal:
+			s.Withdrawals[line.Asset] -= line.Amount
+		case ledger.EntryLiquidation:
+			s.Liquidations += line.Amount
+		case ledger.EntryCollateral:
+			s.Conversions[line.Asset] += line.Amount
+		case ledger.EntryNFT:
+			s.NFTs += line.Amount
+		}
+	}
+
+	return s
+}
+
+// lines flattens the postings of the entries on the user's account.
+func lines(userID int64, entries []ledger.Entry, markets map[string]string) []Line {
+	account := ledger.UserAccount(userID)
+
+	lines := []Line{}
+	for _, entry := range entries {
+		for _, posting := range entry.Postings {
+			if posting.Account != account {
+				continue
+			}
+			lines = append(lines, Line{
+				Timestamp: entry.Timestamp,
+				Type:      entry.Type,
+				Market:    marketOf(entry.Reference, markets),
+				Asset:     posting.Asset,
+				Amount:    posting.Amount,
+				Reference: entry.Reference,
+			})
+		}
+	}
+	return lines
+}
+
+// WriteCSV writes the statement as account movements: the opening balance
+// of every asset, every movement in the period and the closing balances.
+func WriteCSV(w io.Writer, s Statement) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"timestamp", "type", "market", "asset", "amount", "reference"}); err != nil {
+		return err
+	}
+
+	write := func(line Line) error {
+		return cw.Write([]string{
+			time.Unix(0, line.Timestamp).UTC().Format(time.RFC3339Nano),
+			line.Type,
+			line.Market,
+			line.Asset,
+			strconv.FormatFloat(line.Amount, 'f', -1, 64),
+			line.Reference,
+		})
+	}
+
+	for _, asset := range sortedAssets(s.OpeningBalances) {
+		if err := write(Line{Timestamp: s.From, Type: "opening_balance", Asset: asset, Amount: s.OpeningBalances[asset]}); err != nil {
+			return err
+		}
+	}
+	for _, line := range s.Activity {
+		if err := write(line); err != nil {
+			return err
+		}
+	}
+	for _, asset := range sortedAssets(s.ClosingBalances) {
+		if err := write(Line{Timestamp: s.To, Type: "closing_balance", Asset: asset, Amount: s.ClosingBalances[asset]}); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func sortedAssets(balances map[string]float64) []string {
+	assets := make([]string, 0, len(balances))
+	for asset := range balances {
+		assets = append(assets, asset)
+	}
+	sort.Strings(assets)
+	return assets
+}
@@ -0,0 +1,104 @@
+package statement
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fineas02/matching-engine/clock"
+	"github.com/fineas02/matching-engine/ledger"
+)
+
+func assert(t *testing.T, a, b any) {
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func assertClose(t *testing.T, a, b float64) {
+	if math.Abs(a-b) > 1e-9 {
+		t.Errorf("%v != %v", a, b)
+	}
+}
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// history journals a day of activity of user 1 and returns the ledger
+// entries of its account and its trades.
+func history(t *testing.T) ([]ledger.Entry, []Trade) {
+	clk := clock.NewFake(start)
+	l := ledger.New(clk)
+	user := ledger.UserAccount(1)
+
+	post := func(entryType, reference string, postings ...ledger.Posting) {
+		if _, err := l.Post(entryType, reference, postings...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	post(ledger.EntryDeposit, "deposit:1", ledger.Transfer(ledger.AccountExternal, user, "ETH", 1000)...)
+
+	clk.Advance(time.Hour)
+	post(ledger.EntryTrade, "order:7", ledger.Transfer(ledger.AccountPnL, user, "ETH", 50)...)
+	post(ledger.EntryFee, "order:7", ledger.Transfer(user, ledger.AccountFees, "ETH", 2)...)
+	post(ledger.EntryFunding, "funding:ETH:1", ledger.Transfer(user, ledger.AccountFunding, "ETH", 1)...)
+
+	clk.Advance(time.Hour)
+	post(ledger.EntryTrade, "order:9", ledger.Transfer(ledger.AccountPnL, user, "ETH", -20)...)
+	post(ledger.EntryTrade, "settlement:PUNKS-0329:1", ledger.Transfer(ledger.AccountPnL, user, "ETH", 5)...)
+	post(ledger.EntryDeposit, "deposit:2", ledger.Transfer(ledger.AccountExternal, user, "USDC", 300)...)
+	post(ledger.EntryWithdrawal, "withdrawal:1", ledger.Transfer(user, "exchange:withdrawals", "ETH", 100)...)
+
+	clk.Advance(time.Hour)
+	post(ledger.EntryDeposit, "deposit:3", ledger.Transfer(ledger.AccountExternal, user, "ETH", 500)...)
+
+	// another user's activity doesn't show up
+	post(ledger.EntryDeposit, "deposit:4", ledger.Transfer(ledger.AccountExternal, ledger.UserAccount(2), "ETH", 500)...)
+
+	trades := []Trade{
+		{Timestamp: start.Add(time.Hour).UnixNano(), Market: "ETH", Reference: "order:7", Price: 110, Size: 5, Fee: 2, RealizedPNL: 50},
+		{Timestamp: start.Add(2 * time.Hour).UnixNano(), Market: "BTC", Reference: "order:9", Bid: true, Price: 200, Size: 1, RealizedPNL: -20},
+	}
+	return l.Entries(user), trades
+}
+
+func TestBuildStatement(t *testing.T) {
+	entries, trades := history(t)
+
+	s := Build(1, entries, trades, start.Add(time.Minute), start.Add(2*time.Hour+time.Minute))
+	assert(t, s.OpeningBalances, map[string]float64{"ETH": 1000})
+	assert(t, s.ClosingBalances, map[string]float64{"ETH": 932, "USDC": 300})
+	assert(t, s.RealizedPNL, map[string]float64{"ETH": 50, "BTC": -20, "PUNKS-0329": 5})
+	assertClose(t, s.TotalPNL, 35)
+	assertClose(t, s.Fees, -2)
+	assertClose(t, s.Funding, -1)
+	assert(t, s.Deposits, map[string]float64{"USDC": 300})
+	assert(t, s.Withdrawals, map[string]float64{"ETH": 100})
+	assert(t, len(s.Trades), 2)
+	assert(t, len(s.Activity), 7)
+
+	// the closing balance follows from the opening balance and the activity
+	eth := s.OpeningBalances["ETH"] + s.TotalPNL + s.Fees + s.Funding + s.Deposits["ETH"] - s.Withdrawals["ETH"]
+	assertClose(t, s.ClosingBalances["ETH"], eth)
+}
+
+func TestStatementCSV(t *testing.T) {
+	entries, trades := history(t)
+	s := Build(1, entries, trades, start.Add(time.Minute), start.Add(90*time.Minute))
+
+	var buf bytes.Buffer
+	assert(t, WriteCSV(&buf, s), nil)
+
+	rows := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert(t, rows, []string{
+		"timestamp,type,market,asset,amount,reference",
+		"2024-01-01T00:01:00Z,opening_balance,,ETH,1000,",
+		"2024-01-01T01:00:00Z,trade,ETH,ETH,50,order:7",
+		"2024-01-01T01:00:00Z,fee,ETH,ETH,-2,order:7",
+		"2024-01-01T01:00:00Z,funding,ETH,ETH,-1,funding:ETH:1",
+		"2024-01-01T01:30:00Z,closing_balance,,ETH,1047,",
+	})
+}